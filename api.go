@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	API_READ_TIMEOUT = 5 * time.Second              // per request, so a stuck client can't pile up
+	API_TOKEN_ENV    = "TRACKBALL_SCROLL_API_TOKEN" // token for when -api-token-file isn't given
+)
+
+// apiServer serves settings, devices, profiles and statistics as JSON over
+// HTTP on a loopback address, for GUIs and quick tweaks with curl. Every
+// request must carry the token as Authorization: Bearer <token>
+type apiServer struct {
+	token     string
+	scrollers []*trackballscroll.Scroller
+	settings  *settings
+	metrics   *Metrics
+}
+
+// apiError is the body of every failed request
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiProfile is the body of POST /api/profile
+type apiProfile struct {
+	Name string `json:"name"`
+}
+
+// apiSaved is the reply to POST /api/save
+type apiSaved struct {
+	Path string `json:"path"`
+}
+
+// apiToken returns the token API requests must send: the contents of
+// -api-token-file, else $TRACKBALL_SCROLL_API_TOKEN, else -api-token, which
+// other users can read on the command line
+func (o *Options) apiToken() (string, error) {
+	if o.APITokenFile != "" {
+		data, err := os.ReadFile(o.APITokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read -api-token-file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("-api-token-file %s is empty", o.APITokenFile)
+		}
+		return token, nil
+	}
+	if token := os.Getenv(API_TOKEN_ENV); token != "" {
+		return token, nil
+	}
+	return o.APIToken, nil
+}
+
+// validateAPIAddr checks that addr only listens on the loopback interface,
+// since the token travels in the clear
+func validateAPIAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -api-addr %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("invalid -api-addr %q: must be a loopback address such as 127.0.0.1:9102", addr)
+	}
+	return nil
+}
+
+// handler routes the API's endpoints, and serves the web UI at / to anyone,
+// since it can't do anything without the token
+func (a *apiServer) handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/settings", a.getSettings)
+	api.HandleFunc("PATCH /api/settings", a.patchSettings)
+	api.HandleFunc("POST /api/save", a.postSave)
+	api.HandleFunc("GET /api/devices", a.getDevices)
+	api.HandleFunc("POST /api/profile", a.postProfile)
+	api.HandleFunc("GET /api/stats", a.getStats)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", a.authorize(api))
+	mux.HandleFunc("GET /{$}", serveWebUI)
+	return mux
+}
+
+// authorize rejects requests without the token
+func (a *apiServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "missing or wrong token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve answers requests on addr until ctx is done or the listener fails
+func (a *apiServer) serve(ctx context.Context, addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           a.handler(),
+		ReadHeaderTimeout: API_READ_TIMEOUT,
+		ReadTimeout:       API_READ_TIMEOUT,
+	}
+	context.AfterFunc(ctx, func() { server.Close() })
+
+	slog.Info("Serving HTTP API", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP API stopped", "error", err)
+	}
+}
+
+// getSettings returns every option by name with its current value
+func (a *apiServer) getSettings(w http.ResponseWriter, r *http.Request) {
+	values, err := a.settings.values()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, values)
+}
+
+// patchSettings applies a JSON object of option names and values, such as
+// {"sensitivity": 0.5}, like trackball-scroll ctl set. A list sets an option
+// that can be repeated once per item
+func (a *apiServer) patchSettings(w http.ResponseWriter, r *http.Request) {
+	// Numbers are kept as written, so 1000000 isn't formatted as 1e+06 for an
+	// integer option
+	var changes map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&changes); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid settings: %v", err)})
+		return
+	}
+	if len(changes) == 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "nothing to set"})
+		return
+	}
+
+	// In a fixed order, so that of two options for the same setting the same
+	// one always wins
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, 0, len(changes))
+	for _, name := range names {
+		if list, ok := changes[name].([]interface{}); ok {
+			for _, item := range list {
+				values = append(values, fmt.Sprintf("%s=%v", name, item))
+			}
+			continue
+		}
+		values = append(values, fmt.Sprintf("%s=%v", name, changes[name]))
+	}
+
+	if err := a.settings.set(values); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	a.getSettings(w, r)
+}
+
+// postSave writes the current value of each option named in the body, a
+// JSON list, to the config file
+func (a *apiServer) postSave(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid option names: %v", err)})
+		return
+	}
+	if len(names) == 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "nothing to save"})
+		return
+	}
+
+	path, err := a.settings.save(names)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSaved{Path: path})
+}
+
+// getDevices returns the status of every grabbed device
+func (a *apiServer) getDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, describeDevices(a.scrollers))
+}
+
+// postProfile switches to the profile named in the body
+func (a *apiServer) postProfile(w http.ResponseWriter, r *http.Request) {
+	var profile apiProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid profile: %v", err)})
+		return
+	}
+	if err := a.settings.loadProfile(profile.Name); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	a.getSettings(w, r)
+}
+
+// getStats returns the counters also exported by -metrics-addr
+func (a *apiServer) getStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.metrics.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("Failed to write HTTP API response", "error", err)
+	}
+}
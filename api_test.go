@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "file first", opts: Options{APITokenFile: file, APIToken: "from-flag"}, env: "from-env", want: "from-file"},
+		{name: "environment", opts: Options{APIToken: "from-flag"}, env: "from-env", want: "from-env"},
+		{name: "flag", opts: Options{APIToken: "from-flag"}, want: "from-flag"},
+		{name: "missing file", opts: Options{APITokenFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "empty file", opts: Options{APITokenFile: empty}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(API_TOKEN_ENV, test.env)
+			got, err := test.opts.apiToken()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("apiToken() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("apiToken() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
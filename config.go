@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	CONFIG_DIR_NAME    = "trackball-scroll"
+	CONFIG_FILE_NAME   = "config.toml"
+	SYSTEM_CONFIG_PATH = "/etc/trackball-scroll/config.toml"
+	APP_TABLE          = "app"      // per-application settings, [app.<WM_CLASS>]
+	DEVICE_TABLE       = "devices"  // per-device settings, [devices."<name, vendor:product or path>"]
+	PROFILE_TABLE      = "profiles" // named profiles, [profiles.<name>]
+)
+
+// tomlErrorPrefix is the position toml.ParseError puts before its message,
+// which loadConfig reports its own way
+var tomlErrorPrefix = regexp.MustCompile(`^toml: line \d+( \(last key ".*?"\))?: `)
+
+// settingTables holds the tables of one kind in a config file by name, e.g.
+// each application's settings
+type settingTables map[string]map[string]interface{}
+
+// defaultConfigPath returns the user config file if it exists, else the
+// system-wide one if that exists, else ""
+func defaultConfigPath() string {
+	var candidates []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, CONFIG_DIR_NAME, CONFIG_FILE_NAME))
+	}
+	candidates = append(candidates, SYSTEM_CONFIG_PATH)
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// profilePath returns the config file of a named profile, kept next to the
+// user config file, e.g. ~/.config/trackball-scroll/reading.toml
+func profilePath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+
+	path := filepath.Join(dir, CONFIG_DIR_NAME, name+".toml")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("profile %q: %w", name, err)
+	}
+	return path, nil
+}
+
+// listProfiles returns the names of the profiles next to the user config
+// file, in order
+func listProfiles() ([]string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find config directory: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, CONFIG_DIR_NAME, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		if name := filepath.Base(path); name != CONFIG_FILE_NAME && !strings.HasPrefix(name, ".") {
+			names = append(names, strings.TrimSuffix(name, ".toml"))
+		}
+	}
+	return names, nil
+}
+
+// saveSetting sets key = value in a config file, replacing the line that
+// already sets the key if there is one, and creating the file if needed. The
+// key is kept above the first table, such as [app.firefox], so it isn't read
+// as part of that table
+func saveSetting(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	setting := key + " = " + value
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	end := len(lines) // where the top-level keys end
+	replaced := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			end = i
+			break
+		}
+		name, _, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(name) == key {
+			lines[i] = setting
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		for end > 0 && strings.TrimSpace(lines[end-1]) == "" && end < len(lines) {
+			end--
+		}
+		lines = append(lines[:end], append([]string{setting}, lines[end:]...)...)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// configFile reports problems in a config file by line and key. When
+// lenient, each is logged and the entry skipped instead
+type configFile struct {
+	path    string
+	lines   map[string]int // line of each key, see keyLines
+	lenient bool
+}
+
+// problem returns err prefixed with the file and the line key is on, or
+// logs it and returns nil if the file is read leniently
+func (c configFile) problem(err error, key ...string) error {
+	position := c.path
+	if line, ok := c.lines[toml.Key(key).String()]; ok {
+		position = fmt.Sprintf("%s:%d", c.path, line)
+	}
+	err = fmt.Errorf("%s: %w", position, err)
+	if !c.lenient {
+		return err
+	}
+	slog.Warn("Ignoring config setting", "error", err)
+	return nil
+}
+
+// keyLines finds the line each key and table of a config file is on, by its
+// dotted name such as app.firefox.sensitivity
+func keyLines(data string) map[string]int {
+	lines := make(map[string]int)
+	var table toml.Key
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			var header map[string]interface{}
+			if meta, err := toml.Decode(line, &header); err == nil && len(meta.Keys()) > 0 {
+				table = meta.Keys()[len(meta.Keys())-1]
+				lines[table.String()] = i + 1
+			}
+			continue
+		}
+
+		name, _, found := strings.Cut(line, "=")
+		if !found || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key := append(table[:len(table):len(table)], strings.Trim(strings.TrimSpace(name), `"'`))
+		if _, seen := lines[key.String()]; !seen {
+			lines[key.String()] = i + 1
+		}
+	}
+	return lines
+}
+
+// loadConfig reads a TOML config file whose keys are flag names, e.g.
+// sensitivity = 0.5 or device-config = ["/dev/input/event5:deadzone=3"], and
+// applies each value to its flag unless that flag was given on the command
+// line. The [app.<WM_CLASS>], [devices.<...>] and [profiles.<name>] tables
+// are checked and returned by kind. Errors give the line and key at fault;
+// when lenient they are logged and the rest of the file still applies, or
+// none of it if it can't be parsed
+func loadConfig(path string, flags *flag.FlagSet, lenient bool) (map[string]settingTables, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var values map[string]interface{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			// A newline where a value should be is counted on the next line
+			line := parseErr.Position.Line
+			if start := parseErr.Position.Start; start < len(data) && data[start] == '\n' {
+				line--
+			}
+			err = fmt.Errorf("%s:%d: %s", path, line, describeParseError(parseErr))
+		} else {
+			err = fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if !lenient {
+			return nil, err
+		}
+		slog.Warn("Ignoring config file that can't be parsed", "error", err)
+		return make(map[string]settingTables), nil
+	}
+	config := configFile{path: path, lines: keyLines(string(data)), lenient: lenient}
+
+	tables := make(map[string]settingTables)
+	for _, kind := range []string{APP_TABLE, DEVICE_TABLE, PROFILE_TABLE} {
+		found, err := config.tables(kind, values[kind], flags)
+		if err != nil {
+			return nil, err
+		}
+		tables[kind] = found
+		delete(values, kind)
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !configurable(flags, key) {
+			if err := config.problem(fmt.Errorf("unknown setting %q", key), key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if setOnCommandLine[key] {
+			continue
+		}
+
+		// Checked first so a bad element of an array doesn't leave the
+		// ones before it set
+		err := checkFlagValue(flags, key, values[key])
+		if err == nil {
+			err = setFlagFromConfig(flags, key, values[key])
+		}
+		if err != nil {
+			if err := config.problem(fmt.Errorf("invalid value for %q: %w", key, err), key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+// describeParseError phrases a TOML syntax error, naming the last key read
+// before it if there is one
+func describeParseError(err toml.ParseError) string {
+	message := err.Message
+	if message == "" {
+		message = tomlErrorPrefix.ReplaceAllString(err.Error(), "")
+	}
+	if err.LastKey == "" {
+		return message
+	}
+	return fmt.Sprintf("%s (after key %q)", message, err.LastKey)
+}
+
+// configurable reports whether key can be set in a config file: any flag but
+// the ones that say how to read it
+func configurable(flags *flag.FlagSet, key string) bool {
+	return key != "config" && key != "config-lenient" && flags.Lookup(key) != nil
+}
+
+// tables checks the tables under name, such as the [app.<WM_CLASS>] tables
+// of a config file, whose keys are flag names like the top level
+func (c configFile) tables(name string, value interface{}, flags *flag.FlagSet) (settingTables, error) {
+	if value == nil {
+		return nil, nil
+	}
+	tables, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, c.problem(fmt.Errorf("%q must be a table of tables", name), name)
+	}
+
+	found := make(settingTables, len(tables))
+	for key, table := range tables {
+		settings, ok := table.(map[string]interface{})
+		if !ok {
+			if err := c.problem(fmt.Errorf("%s.%s must be a table", name, key), name, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for setting, value := range settings {
+			var err error
+			if !configurable(flags, setting) {
+				err = fmt.Errorf("%s.%s: unknown setting %q", name, key, setting)
+			} else if valueErr := checkFlagValue(flags, setting, value); valueErr != nil {
+				err = fmt.Errorf("%s.%s: invalid value for %q: %w", name, key, setting, valueErr)
+			}
+			if err == nil {
+				continue
+			}
+			if err := c.problem(err, name, key, setting); err != nil {
+				return nil, err
+			}
+			delete(settings, setting)
+		}
+		found[key] = settings
+	}
+	return found, nil
+}
+
+// checkFlagValue reports whether a decoded TOML value would be accepted by a
+// flag, by setting a fresh value of the flag's type rather than the flag
+func checkFlagValue(flags *flag.FlagSet, key string, value interface{}) error {
+	valueType := reflect.TypeOf(flags.Lookup(key).Value)
+	if valueType.Kind() != reflect.Pointer {
+		return nil
+	}
+	scratch, ok := reflect.New(valueType.Elem()).Interface().(flag.Value)
+	if !ok {
+		return nil
+	}
+	return setFromConfig(scratch.Set, value)
+}
+
+// applyTable sets the flags in one table, such as an application's,
+// overriding both the command line and the top level of the config file
+func applyTable(flags *flag.FlagSet, name string, table string, settings map[string]interface{}) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := setFlagFromConfig(flags, key, settings[key]); err != nil {
+			return fmt.Errorf("%s.%s: invalid value for %q: %w", name, table, key, err)
+		}
+	}
+	return nil
+}
+
+// setFlagFromConfig sets a flag from a decoded TOML value. Arrays set the
+// flag once per element, for repeatable flags
+func setFlagFromConfig(flags *flag.FlagSet, key string, value interface{}) error {
+	return setFromConfig(func(text string) error { return flags.Set(key, text) }, value)
+}
+
+// setFromConfig passes a decoded TOML value to set as text, once per element
+// of an array
+func setFromConfig(set func(string) error, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			if err := setFromConfig(set, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		return errors.New("expected a value, got a table")
+	default:
+		return set(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testFlags defines a few flags of each kind for loadConfig to set
+func testFlags() (*flag.FlagSet, *float64, *int, *stringList) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	sensitivity := flags.Float64("sensitivity", 1, "")
+	deadZone := flags.Int("deadzone", 0, "")
+	var match stringList
+	flags.Var(&match, "match", "")
+	flags.String("config", "", "")
+	flags.Bool("config-lenient", false, "")
+	return flags, sensitivity, deadZone, &match
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            string
+		lenient         bool
+		wantErr         string // substring of the error, empty for none
+		wantSensitivity float64
+		wantDeadZone    int
+		wantMatch       []string
+		wantProfiles    []string
+	}{
+		{
+			name:            "empty file",
+			data:            "",
+			wantSensitivity: 1,
+		},
+		{
+			name:            "comments only",
+			data:            "# nothing yet\n\n",
+			wantSensitivity: 1,
+		},
+		{
+			name:            "valid",
+			data:            "sensitivity = 0.5\ndeadzone = 3\nmatch = [\"orbit\", \"slimblade\"]\n\n[profiles.reading]\ndeadzone = 5\n",
+			wantSensitivity: 0.5,
+			wantDeadZone:    3,
+			wantMatch:       []string{"orbit", "slimblade"},
+			wantProfiles:    []string{"reading"},
+		},
+		{
+			name:    "syntax error",
+			data:    "sensitivity = 0.5\ndeadzone = \n",
+			wantErr: `config.toml:2: expected value but found '\n' instead (after key "deadzone")`,
+		},
+		{
+			name:    "syntax error mid-line",
+			data:    "sensitivity = 0.5\ndeadzone = 3 3\n",
+			wantErr: "config.toml:2: expected a top-level item to end with a newline",
+		},
+		{
+			name:            "syntax error, lenient",
+			data:            "sensitivity = 0.5\ndeadzone = \n",
+			lenient:         true,
+			wantSensitivity: 1,
+		},
+		{
+			name:    "unknown key",
+			data:    "deadzone = 3\nsensitivty = 0.5\n",
+			wantErr: `config.toml:2: unknown setting "sensitivty"`,
+		},
+		{
+			name:            "unknown key, lenient",
+			data:            "deadzone = 3\nsensitivty = 0.5\n",
+			lenient:         true,
+			wantSensitivity: 1,
+			wantDeadZone:    3,
+		},
+		{
+			name:    "config can't set itself",
+			data:    "config = \"/tmp/other.toml\"\n",
+			wantErr: `config.toml:1: unknown setting "config"`,
+		},
+		{
+			name:    "bad value",
+			data:    "sensitivity = 0.5\ndeadzone = \"three\"\n",
+			wantErr: `config.toml:2: invalid value for "deadzone"`,
+		},
+		{
+			name:            "bad value, lenient",
+			data:            "sensitivity = 0.5\ndeadzone = \"three\"\n",
+			lenient:         true,
+			wantSensitivity: 0.5,
+		},
+		{
+			name:    "bad array element",
+			data:    "match = [\"orbit\", \"\"]\n",
+			wantErr: `config.toml:1: invalid value for "match"`,
+		},
+		{
+			name:            "bad array element, lenient",
+			data:            "match = [\"orbit\", \"\"]\n",
+			lenient:         true,
+			wantSensitivity: 1,
+		},
+		{
+			name:    "unknown key in a table",
+			data:    "deadzone = 3\n\n[profiles.reading]\nsensitivity = 0.5\ndedzone = 5\n",
+			wantErr: `config.toml:5: profiles.reading: unknown setting "dedzone"`,
+		},
+		{
+			name:    "bad value in a quoted table",
+			data:    "[devices.\"Kensington Orbit\"]\ndeadzone = \"x\"\n",
+			wantErr: `config.toml:2: devices.Kensington Orbit: invalid value for "deadzone"`,
+		},
+		{
+			name:            "bad table, lenient",
+			data:            "[profiles.reading]\ndedzone = 5\n\n[profiles.coding]\ndeadzone = 1\n",
+			lenient:         true,
+			wantSensitivity: 1,
+			wantProfiles:    []string{"coding", "reading"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			flags, sensitivity, deadZone, match := testFlags()
+
+			tables, err := loadConfig(path, flags, test.lenient)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+
+			if *sensitivity != test.wantSensitivity || *deadZone != test.wantDeadZone {
+				t.Errorf("sensitivity %v, deadzone %v, want %v and %v", *sensitivity, *deadZone, test.wantSensitivity, test.wantDeadZone)
+			}
+			if strings.Join(*match, ",") != strings.Join(test.wantMatch, ",") {
+				t.Errorf("match %q, want %q", *match, test.wantMatch)
+			}
+			var profiles []string
+			for name := range tables[PROFILE_TABLE] {
+				profiles = append(profiles, name)
+			}
+			sort.Strings(profiles)
+			if strings.Join(profiles, ",") != strings.Join(test.wantProfiles, ",") {
+				t.Errorf("profiles %q, want %q", profiles, test.wantProfiles)
+			}
+		})
+	}
+}
+
+func TestLoadConfigLenientDropsBadTableSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[app.firefox]\nsensitivity = 0.5\ndeadzone = \"x\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags, _, _, _ := testFlags()
+
+	tables, err := loadConfig(path, flags, true)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	settings := tables[APP_TABLE]["firefox"]
+	if _, ok := settings["deadzone"]; ok || settings["sensitivity"] != 0.5 {
+		t.Errorf("firefox settings %v, want only sensitivity", settings)
+	}
+}
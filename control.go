@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	CONTROL_SOCKET_NAME = "trackball-scroll.sock"
+	CONTROL_TIMEOUT     = 5 * time.Second // per connection, so a stuck client can't pile up
+)
+
+// Commands accepted on the control socket
+const (
+	CONTROL_PAUSE   = "pause"
+	CONTROL_RESUME  = "resume"
+	CONTROL_SET     = "set"
+	CONTROL_STATUS  = "status"
+	CONTROL_PROFILE = "profile" // switch to the profile named, if any, and list them
+	CONTROL_WATCH   = "watch"   // stream monitorEvents until the client hangs up
+)
+
+// controlRequest is one line of JSON sent to the control socket, e.g.
+// {"command":"set","settings":["sensitivity=0.5"]}
+type controlRequest struct {
+	Command  string   `json:"command"`
+	Settings []string `json:"settings,omitempty"` // option=value, for CONTROL_SET
+	Profile  *string  `json:"profile,omitempty"`  // for CONTROL_PROFILE, "" for none
+}
+
+// controlResponse is the line of JSON sent back for each request
+type controlResponse struct {
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+	Devices  []controlDevice `json:"devices,omitempty"`  // for CONTROL_STATUS
+	Profile  string          `json:"profile,omitempty"`  // for CONTROL_PROFILE, the one in use
+	Profiles []string        `json:"profiles,omitempty"` // for CONTROL_PROFILE
+}
+
+// controlDevice describes a grabbed device in a status reply
+type controlDevice struct {
+	Path         string  `json:"path"`
+	Name         string  `json:"name"`
+	Mode         string  `json:"mode"`
+	Paused       bool    `json:"paused"`
+	SensitivityX float64 `json:"sensitivity_x"`
+	SensitivityY float64 `json:"sensitivity_y"`
+	DeadZoneX    int32   `json:"deadzone_x"`
+	DeadZoneY    int32   `json:"deadzone_y"`
+
+	// Motion events the dead zone has suppressed and let through
+	DeadZoneStatsX trackballscroll.DeadZoneStats `json:"deadzone_stats_x"`
+	DeadZoneStatsY trackballscroll.DeadZoneStats `json:"deadzone_stats_y"`
+}
+
+// controlServer accepts control requests on a unix socket, for scripts and
+// keybindings that can't or don't want to use D-Bus
+type controlServer struct {
+	listener  net.Listener
+	path      string
+	scrollers []*trackballscroll.Scroller
+	settings  *settings
+	monitor   *monitor
+}
+
+// defaultControlSocketPath returns the control socket in the user's runtime
+// directory, or a system or temporary location when there is none, like the
+// pidfile
+func defaultControlSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, CONTROL_SOCKET_NAME)
+	}
+	if os.Geteuid() == 0 {
+		return filepath.Join("/run", CONTROL_SOCKET_NAME)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("trackball-scroll-%d.sock", os.Geteuid()))
+}
+
+// listenControl creates the control socket at path, readable and writable
+// only by this user. The pidfile guarantees no other instance is using it, so
+// a leftover socket from a crash is removed first
+func listenControl(path string) (*controlServer, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove old control socket: %w", err)
+	}
+
+	// Bind the socket in a directory only this user can enter and make it
+	// 0600 there before moving it into place, so other users can never
+	// connect while it is still open to them. The umask would do, but it is
+	// shared by every thread of the process
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".trackball-scroll-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	staging := filepath.Join(dir, CONTROL_SOCKET_NAME)
+	listener, err := net.Listen("unix", staging)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	// close removes the socket from where it ends up
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(staging, 0600)
+	if err == nil {
+		err = os.Rename(staging, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to create control socket: %w", err)
+	}
+	return &controlServer{listener: listener, path: path}, nil
+}
+
+// serve handles connections for scrollers, whose settings are changed
+// through current and whose events are watched through monitor, until ctx
+// is done
+func (c *controlServer) serve(ctx context.Context, scrollers []*trackballscroll.Scroller, current *settings, monitor *monitor) {
+	c.scrollers = scrollers
+	c.settings = current
+	c.monitor = monitor
+	context.AfterFunc(ctx, func() { c.listener.Close() })
+
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Control socket failed", "error", err)
+			}
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+// close stops accepting connections and removes the socket
+func (c *controlServer) close() {
+	c.listener.Close()
+	os.Remove(c.path)
+}
+
+// handle answers each line of JSON on conn until the client hangs up
+func (c *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var request controlRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if request.Command == CONTROL_WATCH {
+			c.watch(conn, encoder)
+			return
+		}
+
+		response := controlResponse{OK: true}
+		if err := c.execute(request, &response); err != nil {
+			response = controlResponse{Error: err.Error()}
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// watch streams what the scrollers do to conn, one monitorEvent per line
+// after an ok reply, until the client hangs up
+func (c *controlServer) watch(conn net.Conn, encoder *json.Encoder) {
+	conn.SetDeadline(time.Time{})
+	events := c.monitor.watch()
+	defer c.monitor.unwatch(events)
+	if err := encoder.Encode(controlResponse{OK: true}); err != nil {
+		return
+	}
+
+	// The client sends nothing more, so a read only returns once it hangs up
+	gone := make(chan struct{})
+	go func() {
+		conn.Read(make([]byte, 1))
+		close(gone)
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case event := <-events:
+			conn.SetWriteDeadline(time.Now().Add(CONTROL_TIMEOUT))
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute carries out a request, filling in what it asks for in response
+func (c *controlServer) execute(request controlRequest, response *controlResponse) error {
+	switch request.Command {
+	case CONTROL_PAUSE:
+		for _, scroller := range c.scrollers {
+			if err := scroller.Pause(); err != nil {
+				return err
+			}
+		}
+	case CONTROL_RESUME:
+		for _, scroller := range c.scrollers {
+			if err := scroller.Resume(); err != nil {
+				return err
+			}
+		}
+	case CONTROL_SET:
+		if len(request.Settings) == 0 {
+			return fmt.Errorf("nothing to set")
+		}
+		return c.settings.set(request.Settings)
+	case CONTROL_STATUS:
+		response.Devices = describeDevices(c.scrollers)
+	case CONTROL_PROFILE:
+		if request.Profile != nil {
+			if err := c.settings.loadProfile(*request.Profile); err != nil {
+				return err
+			}
+		}
+		response.Profile = c.settings.currentProfile()
+		response.Profiles = c.settings.profiles()
+	default:
+		return fmt.Errorf("unknown command %q", request.Command)
+	}
+	return nil
+}
+
+// describeDevices returns the status of each scroller's device
+func describeDevices(scrollers []*trackballscroll.Scroller) []controlDevice {
+	devices := make([]controlDevice, 0, len(scrollers))
+	for _, scroller := range scrollers {
+		cfg := scroller.Config()
+		device := scroller.Device()
+		statsX, statsY := scroller.DeadZoneStats()
+		devices = append(devices, controlDevice{
+			Path:         device.Fn,
+			Name:         device.Name,
+			Mode:         scroller.Mode(),
+			Paused:       scroller.Paused(),
+			SensitivityX: cfg.SensitivityX,
+			SensitivityY: cfg.SensitivityY,
+			DeadZoneX:    cfg.DeadZoneX,
+			DeadZoneY:    cfg.DeadZoneY,
+
+			DeadZoneStatsX: statsX,
+			DeadZoneStatsY: statsY,
+		})
+	}
+	return devices
+}
+
+// describeDeadZone shows an axis's dead zone with how many motion events it
+// has suppressed, e.g. "2 (12 of 80 suppressed)"
+func describeDeadZone(deadZone int32, stats trackballscroll.DeadZoneStats) string {
+	return fmt.Sprintf("%d (%d of %d suppressed)", deadZone, stats.Suppressed, stats.Suppressed+stats.Passed)
+}
+
+// ctl is the client side of the control socket: trackball-scroll ctl
+// pause|resume|status|watch|profile [name]|set option=value...
+func ctl(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socket := flags.String("socket", defaultControlSocketPath(), "Control socket of the running instance")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: trackball-scroll ctl [-socket path] pause|resume|status|watch|profile [name]|set option=value...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	request := controlRequest{Command: flags.Arg(0)}
+	if request.Command == CONTROL_SET {
+		request.Settings = flags.Args()[1:]
+	} else if request.Command == CONTROL_PROFILE && flags.NArg() == 2 {
+		name := flags.Arg(1)
+		request.Profile = &name
+	} else if flags.NArg() > 1 {
+		return fmt.Errorf("%s takes no arguments", request.Command)
+	}
+
+	if request.Command == CONTROL_WATCH {
+		return watchControl(*socket, func(event monitorEvent) {
+			switch event.Kind {
+			case MONITOR_MODE:
+				fmt.Printf("%s\t%s\t%s\n", event.Device, event.Kind, event.Mode)
+			default:
+				fmt.Printf("%s\t%s\t%s\t%g\n", event.Device, event.Kind, event.Axis, event.Value)
+			}
+		})
+	}
+
+	response, err := callControl(*socket, request)
+	if err != nil {
+		return err
+	}
+
+	if request.Command == CONTROL_STATUS {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tNAME\tMODE\tPAUSED\tSENSITIVITY\tDEAD ZONE X\tDEAD ZONE Y")
+		for _, device := range response.Devices {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%g,%g\t%s\t%s\n", device.Path, device.Name, device.Mode,
+				device.Paused, device.SensitivityX, device.SensitivityY,
+				describeDeadZone(device.DeadZoneX, device.DeadZoneStatsX), describeDeadZone(device.DeadZoneY, device.DeadZoneStatsY))
+		}
+		return w.Flush()
+	}
+	if request.Command == CONTROL_PROFILE {
+		for _, name := range response.Profiles {
+			marker := " "
+			if name == response.Profile {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, name)
+		}
+	}
+	return nil
+}
+
+// dialControl connects to the control socket, with CONTROL_TIMEOUT for
+// everything that follows
+func dialControl(socket string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", socket, CONTROL_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the running instance: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+	return conn, nil
+}
+
+// callControl sends one request to the control socket and returns the reply,
+// or its error
+func callControl(socket string, request controlRequest) (controlResponse, error) {
+	conn, err := dialControl(socket)
+	if err != nil {
+		return controlResponse{}, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	var response controlResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !response.OK {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// watchControl passes everything the running instance does to handle until
+// the connection fails
+func watchControl(socket string, handle func(monitorEvent)) error {
+	conn, err := dialControl(socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: CONTROL_WATCH}); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	decoder := json.NewDecoder(conn)
+	var response controlResponse
+	if err := decoder.Decode(&response); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+
+	// Events come whenever the ball moves, however long that takes
+	conn.SetDeadline(time.Time{})
+	for {
+		var event monitorEvent
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("lost the running instance: %w", err)
+		}
+		handle(event)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, CONTROL_SOCKET_NAME)
+	server, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want a 0600 socket", info.Mode())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("left %d entries beside the socket", len(entries)-1)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial moved socket: %v", err)
+	}
+	conn.Close()
+}
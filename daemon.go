@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DAEMON_ENV          = "TRACKBALL_SCROLL_DAEMONIZED" // set in the background child
+	PIDFILE_NAME        = "trackball-scroll.pid"
+	REPLACE_TIMEOUT     = 3 * time.Second
+	REPLACE_POLL_PERIOD = 50 * time.Millisecond
+)
+
+// PidFile is a locked pidfile marking the running instance
+type PidFile struct {
+	file *os.File
+}
+
+// defaultPidFilePath returns the pidfile in the user's runtime directory, or
+// a system or temporary location when there is none
+func defaultPidFilePath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, PIDFILE_NAME)
+	}
+	if os.Geteuid() == 0 {
+		return filepath.Join("/run", PIDFILE_NAME)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("trackball-scroll-%d.pid", os.Geteuid()))
+}
+
+// daemonize starts this program again in a new session, detached from the
+// terminal, and reports whether the caller is the parent and should exit
+func daemonize() (bool, error) {
+	if os.Getenv(DAEMON_ENV) != "" {
+		return false, nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return false, fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), DAEMON_ENV+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("failed to start background process: %w", err)
+	}
+
+	fmt.Printf("Started in the background as pid %d\n", cmd.Process.Pid)
+	return true, nil
+}
+
+// acquirePidFile locks path and writes this process's pid to it. If another
+// instance holds the lock it is an error, unless replace is set, in which
+// case that instance is stopped and its lock taken over
+func acquirePidFile(path string, replace bool) (*PidFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pidfile: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		pid := readPid(file)
+		if !replace {
+			file.Close()
+			return nil, fmt.Errorf("already running as pid %d (see %s); use -replace to take over", pid, path)
+		}
+		err = replaceInstance(file, pid)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock pidfile: %w", err)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write pidfile: %w", err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write pidfile: %w", err)
+	}
+
+	return &PidFile{file: file}, nil
+}
+
+// replaceInstance stops the instance holding file's lock, first with SIGTERM
+// and then SIGKILL, and takes the lock once it has exited
+func replaceInstance(file *os.File, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("pidfile is locked but holds no pid")
+	}
+
+	slog.Info("Replacing running instance", "pid", pid)
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to stop pid %d: %w", pid, err)
+		}
+
+		deadline := time.Now().Add(REPLACE_TIMEOUT)
+		for time.Now().Before(deadline) {
+			err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, syscall.EWOULDBLOCK) {
+				return err
+			}
+			time.Sleep(REPLACE_POLL_PERIOD)
+		}
+	}
+
+	return fmt.Errorf("pid %d did not exit", pid)
+}
+
+// readPid returns the pid recorded in a pidfile, or 0 if there is none
+func readPid(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
+
+// release removes the pidfile and drops its lock
+func (p *PidFile) release() {
+	os.Remove(p.file.Name())
+	p.file.Close()
+}
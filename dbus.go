@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	DBUS_NAME      = "org.trackballscroll.Daemon"
+	DBUS_PATH      = dbus.ObjectPath("/org/trackballscroll/Daemon")
+	DBUS_INTERFACE = "org.trackballscroll.Daemon"
+)
+
+// DBusService exposes runtime control of the scrollers on the session bus,
+// and observes them to signal device changes
+type DBusService struct {
+	trackballscroll.NopObserver
+
+	conn      *dbus.Conn
+	scrollers []*trackballscroll.Scroller
+	settings  *settings
+}
+
+// DBusDevice describes a grabbed device in replies to GetDevices
+type DBusDevice struct {
+	Path string
+	Name string
+}
+
+// dbusObject holds the methods exported on DBUS_INTERFACE. It is kept apart
+// from DBusService so that only these methods are callable over the bus
+type dbusObject struct {
+	service *DBusService
+}
+
+// newDBusService claims DBUS_NAME on the session bus. Nothing is callable
+// until serve exports the control interface
+func newDBusService() (*DBusService, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+
+	reply, err := conn.RequestName(DBUS_NAME, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request %s: %w", DBUS_NAME, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("%s is already owned by another process", DBUS_NAME)
+	}
+
+	return &DBusService{conn: conn}, nil
+}
+
+// serve exports the control interface for scrollers, whose settings are
+// reloaded through current
+func (s *DBusService) serve(scrollers []*trackballscroll.Scroller, current *settings) error {
+	s.scrollers = scrollers
+	s.settings = current
+	object := &dbusObject{service: s}
+	if err := s.conn.Export(object, DBUS_PATH, DBUS_INTERFACE); err != nil {
+		return fmt.Errorf("failed to export %s: %w", DBUS_PATH, err)
+	}
+
+	node := &introspect.Node{
+		Name: string(DBUS_PATH),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    DBUS_INTERFACE,
+				Methods: introspect.Methods(object),
+				Signals: []introspect.Signal{
+					{Name: "DeviceConnected", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "name", Type: "s"}}},
+					{Name: "DeviceDisconnected", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "name", Type: "s"}}},
+					{Name: "ModeChanged", Args: []introspect.Arg{{Name: "path", Type: "s"}, {Name: "mode", Type: "s"}}},
+				},
+			},
+		},
+	}
+	if err := s.conn.Export(introspect.NewIntrospectable(node), DBUS_PATH, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return fmt.Errorf("failed to export introspection data: %w", err)
+	}
+
+	return nil
+}
+
+// close releases the bus name and connection
+func (s *DBusService) close() {
+	s.conn.Close()
+}
+
+// DeviceConnected emits DeviceConnected
+func (s *DBusService) DeviceConnected(device *evdev.InputDevice) {
+	s.emit("DeviceConnected", device.Fn, device.Name)
+}
+
+// DeviceDisconnected emits DeviceDisconnected
+func (s *DBusService) DeviceDisconnected(device *evdev.InputDevice) {
+	s.emit("DeviceDisconnected", device.Fn, device.Name)
+}
+
+// ModeChanged emits ModeChanged
+func (s *DBusService) ModeChanged(device *evdev.InputDevice, mode string) {
+	s.emit("ModeChanged", device.Fn, mode)
+}
+
+func (s *DBusService) emit(signal string, values ...interface{}) {
+	if err := s.conn.Emit(DBUS_PATH, DBUS_INTERFACE+"."+signal, values...); err != nil {
+		slog.Warn("Failed to emit D-Bus signal", "signal", signal, "error", err)
+	}
+}
+
+// Pause releases every device so the ball moves the pointer normally
+func (o *dbusObject) Pause() *dbus.Error {
+	for _, scroller := range o.service.scrollers {
+		if err := scroller.Pause(); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	return nil
+}
+
+// Resume grabs every device again and resumes scrolling
+func (o *dbusObject) Resume() *dbus.Error {
+	for _, scroller := range o.service.scrollers {
+		if err := scroller.Resume(); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	return nil
+}
+
+// GetSensitivity returns the horizontal and vertical sensitivity of the first
+// device
+func (o *dbusObject) GetSensitivity() (float64, float64, *dbus.Error) {
+	cfg := o.service.scrollers[0].Config()
+	return cfg.SensitivityX, cfg.SensitivityY, nil
+}
+
+// SetSensitivity sets the horizontal and vertical sensitivity of every device
+// until the next reload
+func (o *dbusObject) SetSensitivity(x, y float64) *dbus.Error {
+	if x <= 0 || y <= 0 {
+		return dbus.MakeFailedError(fmt.Errorf("sensitivity must be positive"))
+	}
+
+	for _, scroller := range o.service.scrollers {
+		cfg := *scroller.Config()
+		cfg.SensitivityX, cfg.SensitivityY = x, y
+		scroller.SetConfig(cfg)
+	}
+	return nil
+}
+
+// SwitchProfile reloads settings from the named profile's config file
+func (o *dbusObject) SwitchProfile(name string) *dbus.Error {
+	if err := o.service.settings.loadProfile(name); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// GetMediaMode reports whether the first device is in media mode
+func (o *dbusObject) GetMediaMode() (bool, *dbus.Error) {
+	return o.service.scrollers[0].Media(), nil
+}
+
+// SetMediaMode switches media mode on or off for every device
+func (o *dbusObject) SetMediaMode(on bool) *dbus.Error {
+	for _, scroller := range o.service.scrollers {
+		if err := scroller.SetMedia(on); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	return nil
+}
+
+// GetMode returns the mode of the first device
+func (o *dbusObject) GetMode() (string, *dbus.Error) {
+	return o.service.scrollers[0].Mode(), nil
+}
+
+// SetMode switches every device to a mode
+func (o *dbusObject) SetMode(mode string) *dbus.Error {
+	for _, scroller := range o.service.scrollers {
+		if err := scroller.SetMode(mode); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	return nil
+}
+
+// CycleMode switches every device to its next mode, as the mode button does
+func (o *dbusObject) CycleMode() *dbus.Error {
+	for _, scroller := range o.service.scrollers {
+		if err := scroller.CycleMode(); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	return nil
+}
+
+// GetDevices returns the path and name of every grabbed device
+func (o *dbusObject) GetDevices() ([]DBusDevice, *dbus.Error) {
+	devices := make([]DBusDevice, 0, len(o.service.scrollers))
+	for _, scroller := range o.service.scrollers {
+		device := scroller.Device()
+		devices = append(devices, DBusDevice{Path: device.Fn, Name: device.Name})
+	}
+	return devices, nil
+}
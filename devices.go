@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// listDevices prints every input device with the details used to detect
+// trackballs, to help pick a -device, -detect-mode or -match. Detection
+// options in args and the config file are taken into account
+func listDevices(args []string) error {
+	opts, err := parseOptions(args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+
+	infos := trackballscroll.ListDevices(opts.detection())
+	if len(infos) == 0 {
+		return fmt.Errorf("no input devices could be opened, you may need root privileges")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tNAME\tPHYS\tID\tEVENTS\tSEAT\tTRACKBALL")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%04x:%04x\t%s\t%s\t%s\n",
+			info.Path, info.Name, info.Phys, info.Vendor, info.Product,
+			strings.Join(info.EventTypes, ","), info.Seat, matchDescription(info))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// Stable names survive reboots and re-enumeration, so suggest them
+	first := true
+	for _, info := range infos {
+		for _, link := range info.Links {
+			if first {
+				fmt.Println("\nStable paths for -device:")
+				first = false
+			}
+			fmt.Printf("  %s -> %s\n", link, info.Path)
+		}
+	}
+	return nil
+}
+
+// matchDescription names the detect modes that would pick up a device
+func matchDescription(info trackballscroll.DeviceInfo) string {
+	switch {
+	case info.Excluded:
+		return "no (excluded)"
+	case info.OtherSeat && (info.MatchUdev || info.MatchName || info.MatchProps):
+		return "no (other seat)"
+	case info.MatchUdev:
+		return "yes (udev)"
+	case info.MatchName && info.MatchProps:
+		return "yes (name, props)"
+	case info.MatchName:
+		return "yes (name)"
+	case info.MatchProps:
+		return "yes (props)"
+	default:
+		return "no"
+	}
+}
+
+// warnStaleVirtualDevices reports virtual devices left by other instances. The
+// kernel removes one as soon as the process that created it exits, so one
+// still present means that process is alive, perhaps hung
+func warnStaleVirtualDevices() {
+	for _, device := range trackballscroll.FindVirtualDevices() {
+		if device.Owner.PID != 0 {
+			slog.Warn("Virtual device of another instance is still present", "path", device.Path, "name", device.Name, "owner", device.Owner.String())
+			continue
+		}
+		slog.Warn("Virtual device of another instance is still present", "path", device.Path, "name", device.Name,
+			"uinput_holders", trackballscroll.DeviceHolders(trackballscroll.UINPUT_PATH))
+	}
+}
@@ -2,4 +2,11 @@ module github.com/yourusername/trackball-scroll
 
 go 1.22.2
 
-require github.com/gvalkov/golang-evdev v0.0.0-20220815104727-7e27d6ce89b6
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gvalkov/golang-evdev v0.0.0-20220815104727-7e27d6ce89b6
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+)
+
+require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
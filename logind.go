@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	LOGIND_NAME    = "org.freedesktop.login1"
+	LOGIND_PATH    = dbus.ObjectPath("/org/freedesktop/login1")
+	LOGIND_MANAGER = "org.freedesktop.login1.Manager"
+	LOGIND_SESSION = "org.freedesktop.login1.Session"
+)
+
+// Special values of -seat
+const (
+	SEAT_AUTO = "auto" // the seat of the session we run in
+	SEAT_ANY  = "any"
+)
+
+// seatName matches the names logind gives seats
+var seatName = regexp.MustCompile(`^seat[A-Za-z0-9_-]*$`)
+
+// resolveSeat turns a -seat value into the seat to limit detection to, or ""
+// for any. pam_systemd sets XDG_SEAT in a session on a seat; anything else,
+// such as a system service, counts as on the default seat
+func resolveSeat(seat string) string {
+	switch seat {
+	case SEAT_ANY:
+		return ""
+	case SEAT_AUTO:
+		if seat := os.Getenv("XDG_SEAT"); seat != "" {
+			return seat
+		}
+		return trackballscroll.DEFAULT_SEAT
+	default:
+		return seat
+	}
+}
+
+// Reasons the scrollers are released, as flags since the session can be
+// locked and asleep at once
+const (
+	AWAY_LOCKED = 1 << iota
+	AWAY_SLEEPING
+)
+
+// sessionWatcher releases the trackballs while the session is locked or the
+// system is asleep, so the lock screen gets the plain pointer, and grabs them
+// again once the user is back. After sleep it also has each scroller check its
+// device is still there, since one re-enumerated during resume can leave the
+// old fd silent rather than failing
+type sessionWatcher struct {
+	conn      *dbus.Conn
+	session   dbus.ObjectPath // ours, "" when not running in a session
+	scrollers []*trackballscroll.Scroller
+	inhibitor *os.File                    // delays sleep until the trackballs are released
+	away      int                         // AWAY_* flags
+	released  []*trackballscroll.Scroller // paused here, to resume on return
+}
+
+// newSessionWatcher subscribes to logind's signals on the system bus. Outside
+// a session, e.g. as a system service, only sleep is followed
+func newSessionWatcher(scrollers []*trackballscroll.Scroller) (*sessionWatcher, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	w := &sessionWatcher{conn: conn, scrollers: scrollers}
+
+	err = conn.Object(LOGIND_NAME, LOGIND_PATH).Call(LOGIND_MANAGER+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&w.session)
+	if err != nil {
+		slog.Debug("Not in a logind session, following sleep only", "error", err)
+	}
+
+	err = conn.AddMatchSignal(dbus.WithMatchObjectPath(LOGIND_PATH), dbus.WithMatchInterface(LOGIND_MANAGER),
+		dbus.WithMatchMember("PrepareForSleep"))
+	if err == nil && w.session != "" {
+		// Lock and Unlock, and LockedHint for desktops that lock without them
+		err = conn.AddMatchSignal(dbus.WithMatchObjectPath(w.session))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to logind: %w", err)
+	}
+
+	w.inhibit()
+	return w, nil
+}
+
+// run follows the session until ctx is done
+func (w *sessionWatcher) run(ctx context.Context) {
+	signals := make(chan *dbus.Signal, 16)
+	w.conn.Signal(signals)
+	defer w.conn.RemoveSignal(signals)
+
+	for {
+		var signal *dbus.Signal
+		select {
+		case <-ctx.Done():
+			return
+		case signal = <-signals:
+		}
+
+		switch {
+		case signal.Name == LOGIND_MANAGER+".PrepareForSleep" && len(signal.Body) == 1:
+			if start, _ := signal.Body[0].(bool); start {
+				w.leave(AWAY_SLEEPING)
+				w.uninhibit()
+			} else {
+				w.inhibit()
+				w.back(AWAY_SLEEPING)
+				for _, scroller := range w.scrollers {
+					scroller.CheckDevice()
+				}
+			}
+		case signal.Path != w.session:
+			// Another session's lock doesn't concern us
+		case signal.Name == LOGIND_SESSION+".Lock":
+			w.leave(AWAY_LOCKED)
+		case signal.Name == LOGIND_SESSION+".Unlock":
+			w.back(AWAY_LOCKED)
+		case signal.Name == "org.freedesktop.DBus.Properties.PropertiesChanged" && len(signal.Body) >= 2:
+			changed, _ := signal.Body[1].(map[string]dbus.Variant)
+			if hint, ok := changed["LockedHint"]; ok {
+				if locked, _ := hint.Value().(bool); locked {
+					w.leave(AWAY_LOCKED)
+				} else {
+					w.back(AWAY_LOCKED)
+				}
+			}
+		}
+	}
+}
+
+// close unsubscribes and lets the system sleep without waiting on us
+func (w *sessionWatcher) close() {
+	w.uninhibit()
+	w.conn.Close()
+}
+
+// leave releases the trackballs the first time the user goes away for any
+// reason. Ones already paused are left for whoever paused them
+func (w *sessionWatcher) leave(reason int) {
+	if w.away&reason != 0 {
+		return
+	}
+	w.away |= reason
+	if w.away != reason {
+		return
+	}
+
+	slog.Info("Session away, releasing trackballs", "locked", w.away&AWAY_LOCKED != 0, "sleeping", w.away&AWAY_SLEEPING != 0)
+	for _, scroller := range w.scrollers {
+		if scroller.Paused() {
+			continue
+		}
+		if err := scroller.Pause(); err != nil {
+			slog.Warn("Failed to release trackball", "error", err)
+			continue
+		}
+		w.released = append(w.released, scroller)
+	}
+}
+
+// back grabs the trackballs released by leave again once the user is back
+// for every reason they went away
+func (w *sessionWatcher) back(reason int) {
+	if w.away&reason == 0 {
+		return
+	}
+	w.away &^= reason
+	if w.away != 0 {
+		return
+	}
+
+	slog.Info("Session back, grabbing trackballs")
+	for _, scroller := range w.released {
+		if err := scroller.Resume(); err != nil {
+			slog.Warn("Failed to grab trackball again", "error", err)
+		}
+	}
+	w.released = nil
+}
+
+// inhibit takes a delay lock, so logind waits for the trackballs to be
+// released before sleeping
+func (w *sessionWatcher) inhibit() {
+	if w.inhibitor != nil {
+		return
+	}
+	var fd dbus.UnixFD
+	err := w.conn.Object(LOGIND_NAME, LOGIND_PATH).Call(LOGIND_MANAGER+".Inhibit", 0,
+		"sleep", "trackball-scroll", "Release the trackball before sleeping", "delay").Store(&fd)
+	if err != nil {
+		slog.Debug("Failed to delay sleep, trackballs may be released late", "error", err)
+		return
+	}
+	w.inhibitor = os.NewFile(uintptr(fd), "inhibitor")
+}
+
+// uninhibit lets a pending sleep go ahead
+func (w *sessionWatcher) uninhibit() {
+	if w.inhibitor != nil {
+		w.inhibitor.Close()
+		w.inhibitor = nil
+	}
+}
@@ -1,379 +1,396 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
 	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
 )
 
-var trackballKeywords = []string{
-	"trackball",
-	"expert mouse",
-	"orbit",
-	"slimblade",
-}
-
-const (
-	DEFAULT_SENSITIVITY = 0.3
-	DEFAULT_DEAD_ZONE   = 2
-	MAX_EVENT_DEVICES   = 32
-	DEVICE_SETUP_DELAY  = 100 * time.Millisecond
-)
-
-// Linux uinput constants for virtual input device creation
-const (
-	UINPUT_MAX_NAME_SIZE = 80
-	UI_SET_EVBIT         = 0x40045564
-	UI_SET_RELBIT        = 0x40045566
-	UI_DEV_SETUP         = 0x405c5503
-	UI_DEV_CREATE        = 0x5501
-	UI_DEV_DESTROY       = 0x5502
-	EV_REL               = 0x02
-	REL_WHEEL            = 0x08
-	REL_HWHEEL           = 0x06
-	EV_SYN               = 0x00
-	SYN_REPORT           = 0x00
-)
-
-// UinputSetup defines the virtual device configuration for uinput interface
-type UinputSetup struct {
-	ID   InputID
-	Name [UINPUT_MAX_NAME_SIZE]byte
-	_    uint32 // ff_effects_max (unused)
-}
+func setupReloadHandling(reload func()) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
-// InputID contains device identification information
-type InputID struct {
-	Bustype uint16
-	Vendor  uint16
-	Product uint16
-	Version uint16
+	go func() {
+		for range hupChan {
+			reload()
+		}
+	}()
 }
 
-// InputEvent represents a Linux input event structure
-type InputEvent struct {
-	Time  syscall.Timeval
-	Type  uint16
-	Code  uint16
-	Value int32
-}
+// setupPauseToggle pauses the scrollers on SIGUSR1, and resumes them on the
+// next one, for window manager keybindings
+func setupPauseToggle(scrollers []*trackballscroll.Scroller) {
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
 
-// TrackballScroller manages trackball input conversion to scroll events
-type TrackballScroller struct {
-	device      *evdev.InputDevice
-	virtualFd   int
-	sensitivity float64
-	deadZone    int32
+	go func() {
+		for range usr1Chan {
+			togglePause(scrollers)
+		}
+	}()
 }
 
-// findTrackballDevices searches for connected trackball devices
-func findTrackballDevices() ([]string, error) {
-	var trackballPaths []string
-
-	for i := 0; i < MAX_EVENT_DEVICES; i++ {
-		devicePath := fmt.Sprintf("/dev/input/event%d", i)
+// togglePause resumes the scrollers if they are all paused and pauses them
+// otherwise, so a toggle always ends with them all in the same state
+func togglePause(scrollers []*trackballscroll.Scroller) {
+	paused := true
+	for _, scroller := range scrollers {
+		paused = paused && scroller.Paused()
+	}
 
-		device, err := evdev.Open(devicePath)
-		if err != nil {
-			continue
+	for _, scroller := range scrollers {
+		var err error
+		if paused {
+			err = scroller.Resume()
+		} else {
+			err = scroller.Pause()
 		}
-
-		if isTrackballDevice(device.Name) {
-			trackballPaths = append(trackballPaths, devicePath)
-			fmt.Printf("Found trackball: %s (%s)\n", device.Name, devicePath)
+		if err != nil {
+			slog.Error("Failed to toggle pause", "device", scroller.Device().Name, "error", err)
 		}
-
-		device.File.Close()
 	}
-
-	return trackballPaths, nil
 }
 
-// isTrackballDevice checks if a device name matches known trackball patterns
-func isTrackballDevice(deviceName string) bool {
-	name := strings.ToLower(deviceName)
-	for _, keyword := range trackballKeywords {
-		if strings.Contains(name, keyword) {
-			return true
-		}
-	}
-	return false
+// setupSignalHandling returns a context that is done on Ctrl+C, SIGTERM or
+// SIGABRT, so even an abort from outside releases the trackball and removes
+// the virtual device on the way out
+func setupSignalHandling() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGABRT)
+	return ctx
 }
 
-// openTrackballDevice grabs the specified input device
-func openTrackballDevice(devicePath string) (*evdev.InputDevice, error) {
-	device, err := evdev.Open(devicePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
-	}
+var subcommands = map[string]func(args []string) error{
+	"install-service": installService,
+	"list-devices":    listDevices,
+	"gen-udev-rules":  genUdevRules,
+	"ctl":             ctl,
+	"tui":             tui,
+}
 
-	if err := device.Grab(); err != nil {
-		return nil, fmt.Errorf("failed to grab device %s: %w", devicePath, err)
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fatal(err.Error())
+			}
+			return
+		}
 	}
 
-	return device, nil
-}
-
-// createScrollOnlyDevice creates a virtual uinput device for scroll events
-func createScrollOnlyDevice() (int, error) {
-	fd, err := syscall.Open("/dev/uinput", syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	// Parse command line arguments and config file
+	opts, err := parseOptions(os.Args[1:], flag.ExitOnError)
 	if err != nil {
-		return -1, fmt.Errorf("failed to open /dev/uinput: %w", err)
+		fatal(err.Error())
 	}
-
-	if err := configureDevice(fd); err != nil {
-		syscall.Close(fd)
-		return -1, err
+	if err := setupLogging(opts.LogLevel, opts.LogFormat); err != nil {
+		fatal(err.Error())
 	}
-
-	if err := setupDevice(fd); err != nil {
-		syscall.Close(fd)
-		return -1, err
+	baseCfg, err := opts.scrollerConfig()
+	if err != nil {
+		fatal(err.Error())
 	}
 
-	if err := createDevice(fd); err != nil {
-		syscall.Close(fd)
-		return -1, err
+	if opts.Daemon {
+		parent, err := daemonize()
+		if err != nil {
+			fatal(err.Error())
+		}
+		if parent {
+			return
+		}
 	}
 
-	time.Sleep(DEVICE_SETUP_DELAY)
-	return fd, nil
-}
+	slog.Info("Trackball Scroll - Converting trackball movement to scroll events")
 
-func configureDevice(fd int) error {
-	capabilities := []struct {
-		cmd   uintptr
-		value uintptr
-		name  string
-	}{
-		{UI_SET_EVBIT, EV_REL, "EV_REL"},
-		{UI_SET_RELBIT, REL_WHEEL, "REL_WHEEL"},
-		{UI_SET_RELBIT, REL_HWHEEL, "REL_HWHEEL"},
-		{UI_SET_EVBIT, EV_SYN, "EV_SYN"},
-	}
-
-	for _, cap := range capabilities {
-		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cap.cmd, cap.value); errno != 0 {
-			return fmt.Errorf("failed to set %s: %v", cap.name, errno)
+	// Make sure only one instance grabs the trackball
+	if !baseCfg.DryRun {
+		pidFile, err := acquirePidFile(opts.PidFile, opts.Replace)
+		if err != nil {
+			fatal(err.Error())
 		}
+		defer pidFile.release()
+		warnStaleVirtualDevices()
 	}
 
-	return nil
-}
+	// Setup graceful shutdown
+	ctx := setupSignalHandling()
 
-func setupDevice(fd int) error {
-	var setup UinputSetup
-	copy(setup.Name[:], "Trackball Scroll Device")
-	setup.ID.Bustype = 0x03 // USB
-	setup.ID.Vendor = 0x1234
-	setup.ID.Product = 0x5678
-	setup.ID.Version = 1
+	// Keep systemd's watchdog fed, including while waiting for a device
+	go runSystemdWatchdog(ctx)
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_DEV_SETUP, uintptr(unsafe.Pointer(&setup))); errno != 0 {
-		return fmt.Errorf("failed to setup device: %v", errno)
+	// Determine target devices
+	var devices []*evdev.InputDevice
+	paths, err := trackballscroll.SelectDevices(opts.Device, opts.detection())
+	if err != nil && !opts.Wait {
+		fatal(err.Error())
+	}
+	if len(paths) > 1 && !opts.AllDevices {
+		path, err := chooseDevice(paths, opts)
+		if err != nil {
+			fatal(err.Error())
+		}
+		paths = []string{path}
 	}
 
-	return nil
-}
+	// Open and grab trackball devices
+	grabTimeout := time.Duration(opts.GrabTimeoutMs) * time.Millisecond
+	for _, path := range paths {
+		var device *evdev.InputDevice
+		if baseCfg.DryRun || baseCfg.Overlay {
+			device, err = trackballscroll.OpenDevice(path, false)
+		} else {
+			device, err = trackballscroll.OpenDeviceRetry(ctx, path, grabTimeout)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if opts.Wait {
+				continue
+			}
+			explainAccessError(path, err)
+			fatal("Failed to open device", "error", err)
+		}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		slog.Info("Waiting for a trackball to be connected")
+		sdNotify("STATUS=Waiting for a trackball to be connected")
+		stopExtending := extendStartup()
+		device, err := trackballscroll.WaitForTrackball(ctx, opts.Device, opts.detection())
+		stopExtending()
+		if err != nil {
+			fatal("Failed to wait for device", "error", err)
+		}
+		if device == nil {
+			return
+		}
+		if baseCfg.DryRun || baseCfg.Overlay {
+			device.Release()
+		}
+		devices = append(devices, device)
+	}
 
-func createDevice(fd int) error {
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_DEV_CREATE, 0); errno != 0 {
-		return fmt.Errorf("failed to create device: %v", errno)
+	// Watchers and observers shared by every scroller
+	var options []trackballscroll.Option
+	if opts.PalmCheckDevice != "" {
+		keyboard, err := trackballscroll.NewKeyboardWatcher(opts.PalmCheckDevice)
+		if err != nil {
+			fatal("Failed to watch keyboard", "error", err)
+		}
+		defer keyboard.Close()
+		go keyboard.Run(ctx)
+		options = append(options, trackballscroll.WithKeyboard(keyboard))
+		if opts.modifierDevice() == opts.PalmCheckDevice {
+			options = append(options, trackballscroll.WithModifierKeyboard(keyboard))
+		}
+	}
+	if opts.modifierDevice() != "" && opts.modifierDevice() != opts.PalmCheckDevice {
+		modifiers, err := trackballscroll.NewKeyboardWatcher(opts.modifierDevice())
+		if err != nil {
+			fatal("Failed to watch keyboard", "error", err)
+		}
+		defer modifiers.Close()
+		go modifiers.Run(ctx)
+		options = append(options, trackballscroll.WithModifierKeyboard(modifiers))
 	}
-	return nil
-}
 
-func newTrackballScroller(device *evdev.InputDevice, sensitivity float64, deadZone int32) (*TrackballScroller, error) {
-	virtualFd, err := createScrollOnlyDevice()
-	if err != nil {
-		return nil, fmt.Errorf("cannot create virtual device: %w", err)
+	if opts.DPIScale {
+		display := trackballscroll.NewDPIWatcher()
+		go display.Run(ctx)
+		options = append(options, trackballscroll.WithDisplay(display))
 	}
 
-	return &TrackballScroller{
-		device:      device,
-		virtualFd:   virtualFd,
-		sensitivity: sensitivity,
-		deadZone:    deadZone,
-	}, nil
-}
+	var bus *DBusService
+	if opts.DBus {
+		bus, err = newDBusService()
+		if err != nil {
+			fatal("Failed to start D-Bus service", "error", err)
+		}
+		defer bus.close()
+		options = append(options, trackballscroll.WithObserver(bus))
+	}
 
-func (ts *TrackballScroller) sendScrollEvent(isHorizontal bool, value int32) error {
-	code := uint16(REL_WHEEL)
-	if isHorizontal {
-		code = uint16(REL_HWHEEL)
-	}
-
-	now := time.Now()
-	events := []InputEvent{
-		{
-			Time:  syscall.Timeval{Sec: now.Unix(), Usec: 0},
-			Type:  uint16(EV_REL),
-			Code:  code,
-			Value: value,
-		},
-		{
-			Time:  syscall.Timeval{Sec: now.Unix(), Usec: 0},
-			Type:  uint16(EV_SYN),
-			Code:  uint16(SYN_REPORT),
-			Value: 0,
-		},
-	}
-
-	for _, event := range events {
-		eventBytes := (*(*[unsafe.Sizeof(event)]byte)(unsafe.Pointer(&event)))[:]
-		if _, err := syscall.Write(ts.virtualFd, eventBytes); err != nil {
-			return fmt.Errorf("failed to write event: %w", err)
+	var notifications *notifier
+	if opts.Notify {
+		notifications, err = newNotifier()
+		if err != nil {
+			slog.Warn("Failed to set up desktop notifications", "error", err)
+		} else {
+			defer notifications.close()
+			options = append(options, trackballscroll.WithObserver(notifications))
 		}
 	}
 
-	return nil
-}
+	// Profiles switched by -chord
+	actions := &chordActions{}
+	options = append(options, trackballscroll.WithObserver(actions))
 
-func (ts *TrackballScroller) close() {
-	if ts.virtualFd >= 0 {
-		syscall.Syscall(syscall.SYS_IOCTL, uintptr(ts.virtualFd), UI_DEV_DESTROY, 0)
-		syscall.Close(ts.virtualFd)
+	// Watched through the control socket
+	events := newMonitor()
+	if opts.ControlSocket != "" && !baseCfg.DryRun {
+		options = append(options, trackballscroll.WithObserver(events))
 	}
 
-	if ts.device != nil {
-		ts.device.Release()
+	var metrics *Metrics
+	if opts.MetricsAddr != "" || opts.APIAddr != "" {
+		metrics = newMetrics()
+		options = append(options, trackballscroll.WithObserver(metrics))
+	}
+	if opts.MetricsAddr != "" {
+		go metrics.serve(opts.MetricsAddr)
 	}
-}
 
-func (ts *TrackballScroller) processEvents(stopChan <-chan struct{}) error {
-	for {
-		select {
-		case <-stopChan:
-			return nil
-		default:
+	// Create a scroller per device, each with its own virtual device
+	var scrollers []*trackballscroll.Scroller
+	for _, device := range devices {
+		cfg, err := opts.deviceConfig(baseCfg, os.Args[1:], "", device)
+		if err != nil {
+			fatal("Invalid device settings", "error", err)
 		}
+		slog.Info("Device", "path", device.Fn,
+			"sensitivity_x", cfg.SensitivityX, "sensitivity_y", cfg.SensitivityY,
+			"deadzone_x", cfg.DeadZoneX, "deadzone_y", cfg.DeadZoneY)
 
-		events, err := ts.device.Read()
+		scroller, err := trackballscroll.NewScroller(device, cfg, options...)
 		if err != nil {
-			return fmt.Errorf("error reading events: %w", err)
+			explainAccessError(trackballscroll.UINPUT_PATH, err)
+			fatal("Failed to create scroller", "error", err)
 		}
+		defer scroller.Close()
 
-		ts.handleEvents(events)
+		scrollers = append(scrollers, scroller)
+		slog.Info("Ready, press Ctrl+C to exit", "device", device.Name)
 	}
-}
 
-func (ts *TrackballScroller) handleEvents(events []evdev.InputEvent) {
-	for _, event := range events {
-		if event.Type != evdev.EV_REL {
-			continue
+	// Re-read the config file on SIGHUP
+	current := newSettings(scrollers, os.Args[1:], opts.apps)
+	current.profile = opts.Profile
+	actions.settings = current
+	if notifications != nil {
+		current.onProfile = notifications.profileLoaded
+	}
+	setupReloadHandling(func() {
+		if err := current.reload(); err != nil {
+			slog.Error("Reload failed, keeping current settings", "error", err)
 		}
+	})
 
-		var isHorizontal bool
-		var scrollValue int32
-
-		switch event.Code {
-		case evdev.REL_X:
-			isHorizontal = true
-			scrollValue = int32(float64(event.Value) * ts.sensitivity)
-		case evdev.REL_Y:
-			isHorizontal = false
-			scrollValue = -int32(float64(event.Value) * ts.sensitivity) // Inverted for natural scrolling
-		default:
-			continue
-		}
+	// Pause and resume on SIGUSR1
+	setupPauseToggle(scrollers)
 
-		if abs(event.Value) > ts.deadZone && scrollValue != 0 {
-			ts.sendScrollEvent(isHorizontal, scrollValue)
-		}
+	// Follow the focused window for per-application settings
+	if len(opts.apps) > 0 {
+		go trackballscroll.NewWindowWatcher(current.focus).Run(ctx)
 	}
-}
 
-func abs(x int32) int32 {
-	if x < 0 {
-		return -x
+	// Accept control over D-Bus
+	if bus != nil {
+		if err := bus.serve(scrollers, current); err != nil {
+			fatal("Failed to start D-Bus service", "error", err)
+		}
 	}
-	return x
-}
 
-func selectDevice(devicePath string) (string, error) {
-	if devicePath != "auto" {
-		return devicePath, nil
+	// Show the state in the desktop panel
+	if opts.Tray {
+		tray, err := newTray(scrollers, current)
+		if err != nil {
+			slog.Warn("Failed to show tray icon", "error", err)
+		} else {
+			defer tray.close()
+			go tray.run(ctx)
+		}
 	}
 
-	fmt.Println("Detecting trackball devices...")
-	trackballs, err := findTrackballDevices()
-	if err != nil {
-		return "", fmt.Errorf("failed to scan for devices: %w", err)
+	// Let go of the trackballs while the user is away
+	if opts.Logind {
+		session, err := newSessionWatcher(scrollers)
+		if err != nil {
+			slog.Warn("Not following session lock and sleep", "error", err)
+		} else {
+			defer session.close()
+			go session.run(ctx)
+		}
 	}
 
-	if len(trackballs) == 0 {
-		return "", fmt.Errorf("no trackball devices found. Try to manually add a device with -device")
+	// Accept control over the unix socket, which is only safe to take over
+	// while holding the pidfile
+	if opts.ControlSocket != "" && !baseCfg.DryRun {
+		control, err := listenControl(opts.ControlSocket)
+		if err != nil {
+			slog.Warn("Failed to start control socket", "error", err)
+		} else {
+			defer control.close()
+			go control.serve(ctx, scrollers, current, events)
+		}
 	}
 
-	if len(trackballs) > 1 {
-		fmt.Println("Multiple trackballs found:")
-		for i, path := range trackballs {
-			fmt.Printf("  %d: %s\n", i+1, path)
+	// Accept control over HTTP
+	if opts.APIAddr != "" {
+		if token, err := opts.apiToken(); err != nil {
+			slog.Warn("Failed to start HTTP API", "error", err)
+		} else {
+			api := &apiServer{token: token, scrollers: scrollers, settings: current, metrics: metrics}
+			go api.serve(ctx, opts.APIAddr)
 		}
-		fmt.Printf("Using first one: %s\n", trackballs[0])
 	}
 
-	return trackballs[0], nil
-}
-
-func setupSignalHandling() <-chan struct{} {
-	stopChan := make(chan struct{})
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-signalChan
-		close(stopChan)
-	}()
-
-	return stopChan
-}
-
-func main() {
-	// Parse command line arguments
-	sensitivity := flag.Float64("sensitivity", DEFAULT_SENSITIVITY, "Scroll sensitivity")
-	deadZone := flag.Int("deadzone", DEFAULT_DEAD_ZONE, "Dead zone for ignoring small movements")
-	devicePath := flag.String("device", "auto", "Path to find trackball device")
-	flag.Parse()
-
-	fmt.Println("Trackball Scroll - Converting trackball movement to scroll events")
-
-	// Determine target device
-	finalDevicePath, err := selectDevice(*devicePath)
-	if err != nil {
-		log.Fatal(err)
+	// Everything that needs root is done
+	if opts.User != "" {
+		if err := dropPrivileges(opts.User, opts.Group); err != nil {
+			fatal("Failed to drop privileges", "error", err)
+		}
 	}
 
-	fmt.Printf("Device: %s | Sensitivity: %.2f | Dead zone: %d\n", finalDevicePath, *sensitivity, *deadZone)
-
-	// Open and configure trackball device
-	device, err := openTrackballDevice(finalDevicePath)
-	if err != nil {
-		log.Fatalf("Failed to open device: %v", err)
+	// Tell systemd the devices are grabbed and the virtual devices exist
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
 	}
 
-	// Create scroller instance
-	scroller, err := newTrackballScroller(device, *sensitivity, int32(*deadZone))
-	if err != nil {
-		log.Fatalf("Failed to create scroller: %v", err)
+	// Process every device concurrently
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(scrollers))
+	for _, scroller := range scrollers {
+		wg.Add(1)
+		go func(scroller *trackballscroll.Scroller) {
+			defer wg.Done()
+			if err := scroller.Run(ctx); err != nil {
+				errChan <- fmt.Errorf("%s: %w", scroller.Device().Name, err)
+			}
+		}(scroller)
+	}
+	wg.Wait()
+	close(errChan)
+	sdNotify("STOPPING=1")
+
+	var failed error
+	for err := range errChan {
+		slog.Error("Error processing events", "error", err)
+		failed = err
 	}
-	defer scroller.close()
 
-	fmt.Printf("Ready: %s | Press Ctrl+C to exit\n", device.Name)
+	if opts.Verbose {
+		for _, scroller := range scrollers {
+			scroller.LogStats()
+		}
+	}
 
-	// Setup graceful shutdown and start processing
-	stopChan := setupSignalHandling()
-	if err := scroller.processEvents(stopChan); err != nil {
-		log.Fatalf("Error processing events: %v", err)
+	if failed != nil {
+		// os.Exit skips the deferred cleanup
+		for _, scroller := range scrollers {
+			scroller.Close()
+		}
+		os.Exit(1)
 	}
 
-	fmt.Println("Trackball scroller stopped.")
+	slog.Info("Trackball scroller stopped")
 }
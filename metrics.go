@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// latencyBounds are the upper bounds, in seconds, of the latency histogram
+var latencyBounds = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1}
+
+// Metrics observes what the scrollers do, for export in the Prometheus text
+// format
+type Metrics struct {
+	trackballscroll.NopObserver
+
+	eventsRead    atomic.Uint64
+	scrollEmitted atomic.Uint64
+	dropped       atomic.Uint64
+	droppedInput  atomic.Uint64
+	reconnects    atomic.Uint64
+
+	// Motion events the dead zone suppressed or let through, by axis
+	deadZoneSuppressedX atomic.Uint64
+	deadZoneSuppressedY atomic.Uint64
+	deadZonePassedX     atomic.Uint64
+	deadZonePassedY     atomic.Uint64
+
+	latencyBuckets []atomic.Uint64 // cumulative counts per latencyBounds bound
+	latencyCount   atomic.Uint64
+	latencySumNs   atomic.Uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		latencyBuckets: make([]atomic.Uint64, len(latencyBounds)),
+	}
+}
+
+func (m *Metrics) EventsRead(n int) {
+	m.eventsRead.Add(uint64(n))
+}
+
+func (m *Metrics) ScrollEmitted() {
+	m.scrollEmitted.Add(1)
+}
+
+func (m *Metrics) EventDropped() {
+	m.dropped.Add(1)
+}
+
+func (m *Metrics) InputDropped(n int) {
+	m.droppedInput.Add(uint64(n))
+}
+
+// DeviceConnected counts a reconnect, the only time a scroller reports one
+func (m *Metrics) DeviceConnected(*evdev.InputDevice) {
+	m.reconnects.Add(1)
+}
+
+func (m *Metrics) DeadZoneChecked(_ *evdev.InputDevice, isHorizontal bool, suppressed bool) {
+	switch {
+	case isHorizontal && suppressed:
+		m.deadZoneSuppressedX.Add(1)
+	case isHorizontal:
+		m.deadZonePassedX.Add(1)
+	case suppressed:
+		m.deadZoneSuppressedY.Add(1)
+	default:
+		m.deadZonePassedY.Add(1)
+	}
+}
+
+func (m *Metrics) ScrollLatency(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	for i, bound := range latencyBounds {
+		if latency.Seconds() <= bound {
+			m.latencyBuckets[i].Add(1)
+		}
+	}
+	m.latencyCount.Add(1)
+	m.latencySumNs.Add(uint64(latency.Nanoseconds()))
+}
+
+// metricsSnapshot is the counters of Metrics at one moment, as JSON
+type metricsSnapshot struct {
+	EventsRead         uint64  `json:"events_read"`
+	ScrollEvents       uint64  `json:"scroll_events"`
+	DroppedEvents      uint64  `json:"dropped_events"`
+	DroppedInputEvents uint64  `json:"dropped_input_events"`
+	Reconnects         uint64  `json:"reconnects"`
+	LatencyCount       uint64  `json:"latency_count"`
+	LatencyAvgSeconds  float64 `json:"latency_avg_seconds"`
+
+	DeadZoneSuppressedX uint64 `json:"deadzone_suppressed_x"`
+	DeadZoneSuppressedY uint64 `json:"deadzone_suppressed_y"`
+	DeadZonePassedX     uint64 `json:"deadzone_passed_x"`
+	DeadZonePassedY     uint64 `json:"deadzone_passed_y"`
+}
+
+func (m *Metrics) snapshot() metricsSnapshot {
+	snapshot := metricsSnapshot{
+		EventsRead:         m.eventsRead.Load(),
+		ScrollEvents:       m.scrollEmitted.Load(),
+		DroppedEvents:      m.dropped.Load(),
+		DroppedInputEvents: m.droppedInput.Load(),
+		Reconnects:         m.reconnects.Load(),
+		LatencyCount:       m.latencyCount.Load(),
+
+		DeadZoneSuppressedX: m.deadZoneSuppressedX.Load(),
+		DeadZoneSuppressedY: m.deadZoneSuppressedY.Load(),
+		DeadZonePassedX:     m.deadZonePassedX.Load(),
+		DeadZonePassedY:     m.deadZonePassedY.Load(),
+	}
+	if snapshot.LatencyCount > 0 {
+		snapshot.LatencyAvgSeconds = time.Duration(m.latencySumNs.Load()).Seconds() / float64(snapshot.LatencyCount)
+	}
+	return snapshot
+}
+
+// serve exposes /metrics on addr until the listener fails
+func (m *Metrics) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+
+	slog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Metrics server stopped", "error", err)
+	}
+}
+
+// write prints every metric in the Prometheus text exposition format
+func (m *Metrics) write(w io.Writer) {
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("trackball_scroll_events_read_total", "Input events read from the trackball.", m.eventsRead.Load())
+	counter("trackball_scroll_scroll_events_total", "Scroll events written to the virtual device.", m.scrollEmitted.Load())
+	counter("trackball_scroll_dropped_events_total", "Scroll events dropped because the virtual device was full.", m.dropped.Load())
+	counter("trackball_scroll_dropped_input_events_total", "Input events dropped because the queue to the writer was full.", m.droppedInput.Load())
+	counter("trackball_scroll_reconnects_total", "Times an unplugged trackball was reconnected.", m.reconnects.Load())
+
+	const deadZone = "trackball_scroll_deadzone_events_total"
+	fmt.Fprintf(w, "# HELP %s Motion events the dead zone suppressed or let through.\n# TYPE %s counter\n", deadZone, deadZone)
+	fmt.Fprintf(w, "%s{axis=\"x\",result=\"suppressed\"} %d\n", deadZone, m.deadZoneSuppressedX.Load())
+	fmt.Fprintf(w, "%s{axis=\"x\",result=\"passed\"} %d\n", deadZone, m.deadZonePassedX.Load())
+	fmt.Fprintf(w, "%s{axis=\"y\",result=\"suppressed\"} %d\n", deadZone, m.deadZoneSuppressedY.Load())
+	fmt.Fprintf(w, "%s{axis=\"y\",result=\"passed\"} %d\n", deadZone, m.deadZonePassedY.Load())
+
+	const name = "trackball_scroll_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Delay from input event timestamp to scroll output.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range latencyBounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, m.latencyBuckets[i].Load())
+	}
+	count := m.latencyCount.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(m.latencySumNs.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
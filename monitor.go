@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const MONITOR_BUFFER = 256 // events a slow watcher can fall behind by before missing some
+
+// Kinds of monitorEvent
+const (
+	MONITOR_MOTION = "motion"
+	MONITOR_SCROLL = "scroll"
+	MONITOR_MODE   = "mode"
+)
+
+// monitorEvent is one thing a scroller did, streamed to watchers of the
+// control socket
+type monitorEvent struct {
+	Kind   string  `json:"kind"`
+	Device string  `json:"device"`
+	Axis   string  `json:"axis,omitempty"`  // "x" or "y", for motion and scroll
+	Value  float64 `json:"value,omitempty"` // device counts for motion, clicks for scroll
+	Mode   string  `json:"mode,omitempty"`
+}
+
+// monitor observes the scrollers and hands what they do to whoever is
+// watching. With nobody watching it costs a lock per event
+type monitor struct {
+	trackballscroll.NopObserver
+
+	mu       sync.Mutex
+	watchers map[chan monitorEvent]struct{}
+}
+
+func newMonitor() *monitor {
+	return &monitor{watchers: make(map[chan monitorEvent]struct{})}
+}
+
+// watch returns a channel of everything the scrollers do from now on, until
+// unwatch is called with it
+func (m *monitor) watch() chan monitorEvent {
+	events := make(chan monitorEvent, MONITOR_BUFFER)
+	m.mu.Lock()
+	m.watchers[events] = struct{}{}
+	m.mu.Unlock()
+	return events
+}
+
+func (m *monitor) unwatch(events chan monitorEvent) {
+	m.mu.Lock()
+	delete(m.watchers, events)
+	m.mu.Unlock()
+}
+
+// publish hands event to every watcher that has room for it, since
+// observers must not block
+func (m *monitor) publish(event monitorEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for events := range m.watchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (m *monitor) MotionRead(device *evdev.InputDevice, isHorizontal bool, delta int32) {
+	m.publish(monitorEvent{Kind: MONITOR_MOTION, Device: device.Fn, Axis: axisName(isHorizontal), Value: float64(delta)})
+}
+
+func (m *monitor) ScrollSent(device *evdev.InputDevice, isHorizontal bool, clicks float64) {
+	m.publish(monitorEvent{Kind: MONITOR_SCROLL, Device: device.Fn, Axis: axisName(isHorizontal), Value: clicks})
+}
+
+func (m *monitor) ModeChanged(device *evdev.InputDevice, mode string) {
+	m.publish(monitorEvent{Kind: MONITOR_MODE, Device: device.Fn, Mode: mode})
+}
+
+func axisName(isHorizontal bool) string {
+	if isHorizontal {
+		return "x"
+	}
+	return "y"
+}
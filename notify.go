@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/godbus/dbus/v5"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	NOTIFICATIONS_NAME      = "org.freedesktop.Notifications"
+	NOTIFICATIONS_PATH      = dbus.ObjectPath("/org/freedesktop/Notifications")
+	NOTIFICATIONS_INTERFACE = "org.freedesktop.Notifications"
+
+	NOTIFY_ICON    = "input-mouse"
+	NOTIFY_TIMEOUT = 3000 // milliseconds each notification is shown for
+	NOTIFY_QUEUE   = 16   // notifications waiting to be sent before more are dropped
+)
+
+// notification is a desktop notification waiting to be sent
+type notification struct {
+	summary string
+	body    string
+}
+
+// notifier shows desktop notifications when trackballs come and go, the
+// mode changes or another profile is loaded, so a daemon's state changes are
+// visible. Each replaces the last, so toggling back and forth doesn't pile
+// them up
+type notifier struct {
+	trackballscroll.NopObserver
+
+	conn    *dbus.Conn
+	pending chan notification
+	done    chan struct{}
+}
+
+// newNotifier connects to the session bus, where the notification server is
+func newNotifier() (*notifier, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	n := &notifier{conn: conn, pending: make(chan notification, NOTIFY_QUEUE), done: make(chan struct{})}
+	go n.run()
+	return n, nil
+}
+
+// run sends notifications one at a time, since observers must not block on
+// the bus
+func (n *notifier) run() {
+	server := n.conn.Object(NOTIFICATIONS_NAME, NOTIFICATIONS_PATH)
+	var id uint32 // of the notification shown last, to replace
+	for {
+		var note notification
+		select {
+		case <-n.done:
+			return
+		case note = <-n.pending:
+		}
+		call := server.Call(NOTIFICATIONS_INTERFACE+".Notify", 0, "trackball-scroll", id, NOTIFY_ICON,
+			note.summary, note.body, []string{}, map[string]dbus.Variant{}, int32(NOTIFY_TIMEOUT))
+		if err := call.Store(&id); err != nil {
+			slog.Warn("Failed to show notification", "summary", note.summary, "error", err)
+		}
+	}
+}
+
+// close stops sending notifications. Any still queued are dropped
+func (n *notifier) close() {
+	close(n.done)
+	n.conn.Close()
+}
+
+// notify queues a notification, dropping it if the server is falling behind
+func (n *notifier) notify(summary, body string) {
+	select {
+	case n.pending <- notification{summary: summary, body: body}:
+	default:
+	}
+}
+
+func (n *notifier) DeviceConnected(device *evdev.InputDevice) {
+	n.notify("Trackball connected", device.Name)
+}
+
+func (n *notifier) DeviceDisconnected(device *evdev.InputDevice) {
+	n.notify("Trackball disconnected", device.Name)
+}
+
+func (n *notifier) ModeChanged(device *evdev.InputDevice, mode string) {
+	n.notify("Trackball mode: "+mode, device.Name)
+}
+
+// profileLoaded is called by settings when another profile is loaded, or
+// with "" when going back to no profile
+func (n *notifier) profileLoaded(name string) {
+	if name == "" {
+		name = "default"
+	}
+	n.notify("Trackball profile: "+name, "")
+}
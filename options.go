@@ -0,0 +1,877 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// Options holds every setting given on the command line or in the config file
+type Options struct {
+	ConfigPath       string
+	ConfigLenient    bool
+	Profile          string
+	Sensitivity      float64
+	SensitivityX     float64
+	SensitivityY     float64
+	DeadZone         int
+	DeadZoneX        int
+	DeadZoneY        int
+	InvertX          bool
+	InvertY          bool
+	SwapAxes         bool
+	Device           string
+	DetectMode       string
+	Match            stringList
+	MatchReplace     bool
+	DeviceRegex      string
+	Exclude          stringList
+	Seat             string
+	SmoothEmit       bool
+	ClickCooldownMs  int
+	AntiOvershoot    bool
+	IntentThreshold  int
+	IntentWindow     int
+	PalmCheckDevice  string
+	PalmCheckMs      int
+	ModifierDevice   string
+	ScrollKey        string
+	HScrollKey       string
+	DPIScale         bool
+	AxisXCode        string
+	AxisYCode        string
+	WatchdogMs       int
+	IdleUngrabMs     int
+	ScrollButton     string
+	ZoomButton       string
+	MediaButton      string
+	MediaKeys        bool
+	ModeButton       string
+	Modes            string
+	CustomKeys       string
+	NotchCounts      int
+	WheelSensitivity float64
+	PointerSpeed     float64
+	PointerAccel     string
+	InvertWheel      bool
+	WheelOutput      string
+	ScrollOutput     string
+	KeyThreshold     float64
+	Circular         bool
+	CircularDegrees  float64
+	DragLockButton   string
+	ToggleButton     string
+	DoubleTapMs      int
+	IdleScrollMs     int
+	Remap            stringList
+	Chord            stringList
+	ChordWindowMs    int
+	AllDevices       bool
+	DeviceIndex      int
+	DeviceConfig     deviceOverrides
+	Wait             bool
+	GrabTimeoutMs    int
+	Reconnect        bool
+	WriteFull        string
+	QueueSize        int
+	QueueFull        string
+	Verbose          bool
+	DBus             bool
+	Tray             bool
+	Notify           bool
+	Logind           bool
+	Daemon           bool
+	PidFile          string
+	ControlSocket    string
+	Replace          bool
+	User             string
+	Group            string
+	LogLevel         string
+	LogFormat        string
+	MetricsAddr      string
+	APIAddr          string
+	APIToken         string
+	APITokenFile     string
+	DryRun           bool
+	Overlay          bool
+	VirtualName      string
+	VirtualID        string
+	VirtualBus       string
+	VirtualVersion   int
+	CloneIdentity    bool
+	SplitDevices     bool
+	HiRes            bool
+	Accel            string
+	AccelExponent    float64
+	Curve            string
+	Smoothing        float64
+	Ballistics       bool
+	SlowSpeed        float64
+	FastSpeed        float64
+	SlowGain         float64
+	FastGain         float64
+	MaxScrollRate    int
+	MaxScrollStep    float64
+	Kinetic          bool
+	KineticFriction  float64
+	AxisLock         bool
+	AxisLockTimeout  int
+	SoftStartMs      int
+	AxisSnapRatio    float64
+	Rotation         float64
+	Filter           string
+	FilterTimeoutMs  int
+	Script           string
+
+	deviceRegex *regexp.Regexp              // compiled -device-regex
+	exclusions  []trackballscroll.Exclusion // parsed -exclude
+	apps        settingTables               // [app.<WM_CLASS>] tables of the config file
+	devices     settingTables               // [devices.<name, ID or path>] tables of the config file
+	profiles    settingTables               // [profiles.<name>] tables of the config file
+}
+
+// parseOptions parses command-line arguments, then fills in any setting not
+// given there from the config file
+func parseOptions(args []string, errorHandling flag.ErrorHandling) (*Options, error) {
+	return parseAppOptions(args, errorHandling, "")
+}
+
+// parseAppOptions is parseOptions followed by the settings of one
+// application's table in the config file, if app is set
+func parseAppOptions(args []string, errorHandling flag.ErrorHandling, app string) (*Options, error) {
+	opts, _, err := parseFlags(args, errorHandling, app)
+	return opts, err
+}
+
+// parseFlags is parseAppOptions, also returning the flags with every value
+// filled in
+func parseFlags(args []string, errorHandling flag.ErrorHandling, app string) (*Options, *flag.FlagSet, error) {
+	return parseDeviceFlags(args, errorHandling, app, nil)
+}
+
+// parseDeviceFlags is parseFlags with the config file's tables for device, if
+// set, applied before the application's
+func parseDeviceFlags(args []string, errorHandling flag.ErrorHandling, app string, device *evdev.InputDevice) (*Options, *flag.FlagSet, error) {
+	opts := &Options{}
+	flags := flag.NewFlagSet("trackball-scroll", errorHandling)
+
+	flags.StringVar(&opts.ConfigPath, "config", "", "Config file (default: ~/.config/trackball-scroll/config.toml, then /etc/trackball-scroll/config.toml)")
+	flags.BoolVar(&opts.ConfigLenient, "config-lenient", false, "Log and skip bad settings in the config file instead of refusing to start")
+	flags.StringVar(&opts.Profile, "profile", "", "Profile to apply on top of the config file, from its [profiles.<name>] tables (empty for none)")
+	flags.Float64Var(&opts.Sensitivity, "sensitivity", trackballscroll.DEFAULT_SENSITIVITY, "Scroll sensitivity")
+	flags.Float64Var(&opts.SensitivityX, "sensitivity-x", -1, "Horizontal scroll sensitivity (default: -sensitivity)")
+	flags.Float64Var(&opts.SensitivityY, "sensitivity-y", -1, "Vertical scroll sensitivity (default: -sensitivity)")
+	flags.IntVar(&opts.DeadZone, "deadzone", trackballscroll.DEFAULT_DEAD_ZONE, "Dead zone for ignoring small movements")
+	flags.IntVar(&opts.DeadZoneX, "deadzone-x", -1, "Horizontal dead zone (default: -deadzone)")
+	flags.IntVar(&opts.DeadZoneY, "deadzone-y", -1, "Vertical dead zone (default: -deadzone)")
+	flags.BoolVar(&opts.InvertX, "invert-x", false, "Reverse the horizontal scroll direction")
+	flags.BoolVar(&opts.InvertY, "invert-y", true, "Reverse the vertical scroll direction (natural scrolling)")
+	flags.BoolVar(&opts.SwapAxes, "swap-axes", false, "Scroll vertically by rolling the ball sideways and horizontally by rolling it up and down")
+	flags.StringVar(&opts.Device, "device", "auto", "Device path, USB vendor:product ID such as 047d:2041, or auto")
+	flags.StringVar(&opts.DetectMode, "detect-mode", trackballscroll.DETECT_MODE_NAME, "How to detect trackballs: name, props or both")
+	flags.Var(&opts.Match, "match", "Extra device name keyword that identifies a trackball (repeatable)")
+	flags.BoolVar(&opts.MatchReplace, "match-replace", false, "Use only the -match keywords instead of adding them to the built-in ones")
+	flags.StringVar(&opts.DeviceRegex, "device-regex", "", "Regular expression device names must match, instead of the -match keywords")
+	flags.Var(&opts.Exclude, "exclude", "Device never to detect: a path, has:<capability> or a name pattern (repeatable)")
+	flags.StringVar(&opts.Seat, "seat", SEAT_AUTO, "Only detect devices on this logind seat: a name such as seat1, auto for the session's seat, or any")
+	flags.BoolVar(&opts.SmoothEmit, "smooth-emit", false, "Emit scroll at a fixed rate for smoother motion")
+	flags.IntVar(&opts.ClickCooldownMs, "click-cooldown-ms", 0, "Suppress scroll for this many milliseconds after a button event")
+	flags.BoolVar(&opts.AntiOvershoot, "anti-overshoot", false, "Attenuate the last notches of a sharply decelerating flick")
+	flags.IntVar(&opts.IntentThreshold, "intent-threshold", 0, "Motion needed within the intent window before a gesture scrolls (0 disables)")
+	flags.IntVar(&opts.IntentWindow, "intent-window", 5, "Number of recent motion events summed for -intent-threshold")
+	flags.StringVar(&opts.PalmCheckDevice, "palmcheck-device", "", "Keyboard device to watch for disabling scroll while typing")
+	flags.IntVar(&opts.PalmCheckMs, "palmcheck-ms", 500, "Suppress scroll for this many milliseconds after a keystroke on -palmcheck-device")
+	flags.StringVar(&opts.ModifierDevice, "modifier-device", "", "Keyboard device to watch for -scroll-modifier and -horizontal-modifier, if not -palmcheck-device")
+	flags.StringVar(&opts.ScrollKey, "scroll-modifier", "", "Keyboard key to hold for scrolling; the ball moves the pointer otherwise (e.g. KEY_LEFTMETA)")
+	flags.StringVar(&opts.HScrollKey, "horizontal-modifier", "", "Keyboard key to hold to turn vertical ball motion into horizontal scrolling (e.g. KEY_LEFTSHIFT)")
+	flags.BoolVar(&opts.DPIScale, "dpi-scale", false, "Scale sensitivity by the DPI of the monitor under the pointer (X11 only, using xrandr, xdotool and xev; ignored under Wayland)")
+	flags.StringVar(&opts.Filter, "filter", "", "Shell command to pass every input event through as JSON lines, answering each with a JSON array of events to use instead")
+	flags.IntVar(&opts.FilterTimeoutMs, "filter-timeout-ms", int(trackballscroll.DEFAULT_FILTER_TIMEOUT/time.Millisecond), "Milliseconds -filter has to answer a batch of events before it is restarted")
+	flags.StringVar(&opts.Script, "script", "", "Starlark file whose event(ev, state) function every input event is passed through, returning a list of events to use instead")
+	flags.Float64Var(&opts.Rotation, "rotation", 0, "Degrees to turn ball motion clockwise, for a trackball mounted at an angle")
+	flags.StringVar(&opts.AxisXCode, "axis-x-code", "REL_X", "Relative axis treated as horizontal motion (name or number)")
+	flags.StringVar(&opts.AxisYCode, "axis-y-code", "REL_Y", "Relative axis treated as vertical motion (name or number)")
+	flags.IntVar(&opts.WatchdogMs, "watchdog-ms", 0, "Probe the device after this many milliseconds without events (0 disables)")
+	flags.IntVar(&opts.IdleUngrabMs, "idle-ungrab-ms", 0, "Release the device after this many milliseconds without events, until it is used again (0 disables)")
+	flags.StringVar(&opts.ScrollButton, "scroll-button", "", "Button to hold for scrolling; the ball moves the pointer otherwise (e.g. BTN_SIDE)")
+	flags.Var(&opts.Remap, "remap", "Button remapping such as BTN_SIDE=BTN_MIDDLE or BTN_EXTRA=KEY_LEFTCTRL+KEY_W (repeatable)")
+	flags.Var(&opts.Chord, "chord", "Buttons pressed together that send something else, such as BTN_LEFT+BTN_RIGHT=BTN_MIDDLE (repeatable)")
+	flags.IntVar(&opts.ChordWindowMs, "chord-window-ms", int(trackballscroll.DEFAULT_CHORD_WINDOW/time.Millisecond), "How close together chord buttons must be pressed")
+	flags.StringVar(&opts.ToggleButton, "scroll-toggle-button", "", "Button to double-tap to switch between pointer motion and scrolling (e.g. BTN_SIDE)")
+	flags.IntVar(&opts.DoubleTapMs, "double-tap-ms", trackballscroll.DEFAULT_DOUBLE_TAP_MS, "Longest gap between the taps of a double-tap")
+	flags.IntVar(&opts.IdleScrollMs, "scroll-after-idle-ms", 0, "Move the pointer, but scroll with motion that starts after the ball has been still this long, until the next click (0 disables)")
+	flags.StringVar(&opts.DragLockButton, "drag-lock-button", "", "Button to tap to hold the left button down until the next tap (e.g. BTN_EXTRA)")
+	flags.IntVar(&opts.NotchCounts, "notch-counts", 0, "Emit one scroll click per this many counts of ball travel instead of scaling by sensitivity (0 disables)")
+	flags.Float64Var(&opts.WheelSensitivity, "wheel-sensitivity", trackballscroll.DEFAULT_WHEEL_SENSITIVITY, "Multiplier for the device's own wheel or twist scrolling")
+	flags.BoolVar(&opts.InvertWheel, "invert-wheel", false, "Reverse the direction of the device's own wheel or twist scrolling")
+	flags.StringVar(&opts.ScrollOutput, "scroll-output", trackballscroll.SCROLL_OUTPUT_WHEEL, "What ball scrolling sends: wheel events, page (Page Up/Down), arrows (arrow keys) or media (volume and songs)")
+	flags.Float64Var(&opts.KeyThreshold, "key-threshold", 0, "Scroll clicks of ball travel per key press with key -scroll-output (0 uses 5 for page, 1 for arrows and 2 for media)")
+	flags.StringVar(&opts.WheelOutput, "wheel-output", trackballscroll.WHEEL_OUTPUT_VERTICAL, "What the device's own wheel or scroll ring sends: vertical, horizontal, zoom, or keys as <up key>/<down key>")
+	flags.BoolVar(&opts.Circular, "circular", false, "Scroll by moving the ball in circles: clockwise scrolls down")
+	flags.Float64Var(&opts.CircularDegrees, "circular-degrees", trackballscroll.DEFAULT_CIRCULAR_DEGREES, "Degrees of circular motion per scroll click")
+	flags.StringVar(&opts.ZoomButton, "zoom-button", "", "Button to hold for zooming with Ctrl+wheel (e.g. BTN_EXTRA)")
+	flags.StringVar(&opts.ModeButton, "mode-button", "", "Button to tap to cycle through -modes (e.g. BTN_EXTRA)")
+	flags.StringVar(&opts.Modes, "modes", "", "Comma-separated modes to switch between, the first being the one at startup: pointer, scroll, zoom, media, custom (default pointer,scroll with -mode-button)")
+	flags.StringVar(&opts.CustomKeys, "custom-keys", "", "Keys custom mode sends, as <up key>/<down key>[,<right key>/<left key>]")
+	flags.StringVar(&opts.MediaButton, "media-button", "", "Button to tap to switch media mode, where the ball changes volume and skips songs, on and off")
+	flags.BoolVar(&opts.MediaKeys, "media-keys", false, "Advertise the media keys so media mode can be switched over D-Bus without -media-button")
+	flags.BoolVar(&opts.AllDevices, "all-devices", false, "Use every detected trackball instead of only the first")
+	flags.IntVar(&opts.DeviceIndex, "device-index", -1, "Which detected trackball to use when there are several, counting from 0 (-1 asks)")
+	flags.Var(&opts.DeviceConfig, "device-config", "Per-device settings as \"<path or name>:sensitivity=0.5,deadzone=3\" (repeatable)")
+	flags.BoolVar(&opts.Wait, "wait", false, "Wait for the trackball to be plugged in instead of exiting")
+	flags.BoolVar(&opts.Wait, "hotplug", false, "Same as -wait")
+	flags.IntVar(&opts.GrabTimeoutMs, "grab-timeout-ms", trackballscroll.DEFAULT_GRAB_TIMEOUT_MS, "How long to keep retrying while another process has the device grabbed (0 gives up at once)")
+	flags.BoolVar(&opts.Reconnect, "reconnect", true, "Wait for an unplugged trackball to come back instead of exiting")
+	flags.StringVar(&opts.WriteFull, "write-full", trackballscroll.WRITE_FULL_DROP, "What to do when the virtual device is full: drop, block or retry")
+	flags.IntVar(&opts.QueueSize, "queue-size", trackballscroll.DEFAULT_QUEUE_SIZE, "Input batches buffered between reading and writing (0 writes on the reading goroutine)")
+	flags.StringVar(&opts.QueueFull, "queue-full", trackballscroll.QUEUE_FULL_BLOCK, "What to do when the queue is full: block or drop-oldest")
+	flags.BoolVar(&opts.HiRes, "hi-res", false, "Emit high-resolution wheel events for smooth pixel-level scrolling")
+	flags.StringVar(&opts.Accel, "accel", trackballscroll.ACCEL_LINEAR, "Acceleration profile: linear, quadratic, logarithmic or exponent")
+	flags.Float64Var(&opts.PointerSpeed, "pointer-sensitivity", trackballscroll.DEFAULT_POINTER_SENSITIVITY, "Multiplier for ball motion that moves the pointer")
+	flags.StringVar(&opts.PointerAccel, "pointer-accel", trackballscroll.ACCEL_LINEAR, "Acceleration profile for pointer motion: linear, quadratic, logarithmic or exponent")
+	flags.Float64Var(&opts.AccelExponent, "accel-exponent", 1.5, "Exponent for -accel exponent")
+	flags.StringVar(&opts.Curve, "curve", "", "Custom scroll response curve replacing -accel: an expression in x, such as 0.2*x+0.05*x^2, or table:<delta>:<scroll>,...")
+	flags.BoolVar(&opts.Ballistics, "ballistics", false, "Scale scroll with ball speed, from -ballistics-slow-gain to -ballistics-fast-gain")
+	flags.Float64Var(&opts.SlowSpeed, "ballistics-slow-speed", trackballscroll.DEFAULT_BALLISTICS_SLOW_SPEED, "Ball speed in counts per second up to which -ballistics-slow-gain applies")
+	flags.Float64Var(&opts.FastSpeed, "ballistics-fast-speed", trackballscroll.DEFAULT_BALLISTICS_FAST_SPEED, "Ball speed in counts per second from which -ballistics-fast-gain applies")
+	flags.Float64Var(&opts.SlowGain, "ballistics-slow-gain", trackballscroll.DEFAULT_BALLISTICS_SLOW_GAIN, "Scroll multiplier for slow motion with -ballistics")
+	flags.Float64Var(&opts.FastGain, "ballistics-fast-gain", trackballscroll.DEFAULT_BALLISTICS_FAST_GAIN, "Scroll multiplier for fast motion with -ballistics")
+	flags.Float64Var(&opts.Smoothing, "smoothing", 0, "Weight of past motion when smoothing jittery input (0 disables, below 1)")
+	flags.IntVar(&opts.MaxScrollRate, "max-scroll-rate", 0, "Maximum scroll events per second (0 is unlimited)")
+	flags.Float64Var(&opts.MaxScrollStep, "max-scroll-step", 0, "Maximum scroll clicks from a single movement (0 is unlimited)")
+	flags.BoolVar(&opts.Kinetic, "kinetic", false, "Keep scrolling with decaying speed after the ball is flicked and released")
+	flags.Float64Var(&opts.KineticFriction, "kinetic-friction", 0.05, "Fraction of kinetic scroll speed lost per tick (0-1)")
+	flags.BoolVar(&opts.AxisLock, "axis-lock", false, "Scroll only along the dominant axis of each gesture")
+	flags.IntVar(&opts.AxisLockTimeout, "axis-lock-timeout-ms", 200, "Pause in milliseconds that ends a gesture for -axis-lock")
+	flags.Float64Var(&opts.AxisSnapRatio, "axis-snap-ratio", 0, "Suppress the minor axis of a gesture while the major one has moved this many times as far (0 disables)")
+	flags.IntVar(&opts.SoftStartMs, "soft-start-ms", 0, "Ramp scrolling up over this many milliseconds at the start of each gesture (0 disables)")
+	flags.BoolVar(&opts.DBus, "dbus", false, "Accept control over D-Bus as "+DBUS_NAME+" on the session bus")
+	flags.BoolVar(&opts.Tray, "tray", false, "Show an icon in the desktop panel with a menu to pause, switch profiles and pick a sensitivity")
+	flags.BoolVar(&opts.Notify, "notify", false, "Show desktop notifications when a trackball is connected or lost, the mode changes or a profile is loaded")
+	flags.BoolVar(&opts.Logind, "logind", false, "Release the trackball while the session is locked or the system sleeps, following systemd-logind")
+	flags.BoolVar(&opts.Daemon, "daemon", false, "Detach and run in the background")
+	flags.StringVar(&opts.PidFile, "pidfile", defaultPidFilePath(), "Pidfile that keeps a second instance from starting")
+	flags.StringVar(&opts.ControlSocket, "control-socket", defaultControlSocketPath(), "Unix socket for trackball-scroll ctl (empty disables)")
+	flags.BoolVar(&opts.Replace, "replace", false, "Stop an already running instance and take over from it")
+	flags.StringVar(&opts.LogLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error")
+	flags.StringVar(&opts.LogFormat, "log-format", LOG_FORMAT_TEXT, "Log output format: text or json")
+	flags.StringVar(&opts.User, "user", "", "Unprivileged user to switch to once the devices are set up (empty keeps the current user)")
+	flags.StringVar(&opts.Group, "group", "", "Group to switch to with -user (default: the user's primary group)")
+	flags.StringVar(&opts.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics at this address, e.g. 127.0.0.1:9101 (empty disables)")
+	flags.StringVar(&opts.APIAddr, "api-addr", "", "Serve the HTTP API for settings, devices, profiles and statistics at this loopback address, e.g. 127.0.0.1:9102 (empty disables)")
+	flags.StringVar(&opts.APIToken, "api-token", "", "Token HTTP API requests must send as Authorization: Bearer <token> (visible to other users; prefer -api-token-file or $"+API_TOKEN_ENV+")")
+	flags.StringVar(&opts.APITokenFile, "api-token-file", "", "File holding the token HTTP API requests must send")
+	flags.BoolVar(&opts.Overlay, "overlay", false, "Don't grab the device: its pointer motion and buttons reach the system as usual and scrolling is added on top")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Print scroll events instead of sending them, without grabbing the device")
+	flags.StringVar(&opts.VirtualName, "virtual-name", "", "Name of the virtual device (empty picks \""+trackballscroll.VIRTUAL_DEVICE_NAME+"\", numbered if taken)")
+	flags.StringVar(&opts.VirtualID, "virtual-id", "", "USB vendor:product ID of the virtual device in hex (empty uses 1234:5678)")
+	flags.StringVar(&opts.VirtualBus, "virtual-bus", "", "Bus type of the virtual device: usb, bluetooth, virtual or a number (empty uses usb)")
+	flags.IntVar(&opts.VirtualVersion, "virtual-version", 0, "Version number of the virtual device (0 uses 1)")
+	flags.BoolVar(&opts.CloneIdentity, "clone-identity", false, "Give the virtual device the trackball's name, IDs and properties")
+	flags.BoolVar(&opts.SplitDevices, "split-devices", false, "Create a pointer device for motion and buttons and a separate scroll device for the wheels and keys")
+	flags.BoolVar(&opts.Verbose, "v", false, "Log dead zone and drop statistics on exit")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Fill in flags not given on the command line from the config file
+	if opts.ConfigPath == "" {
+		opts.ConfigPath = defaultConfigPath()
+	}
+	if opts.ConfigPath != "" {
+		tables, err := loadConfig(opts.ConfigPath, flags, opts.ConfigLenient)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.apps, opts.devices, opts.profiles = tables[APP_TABLE], tables[DEVICE_TABLE], tables[PROFILE_TABLE]
+	}
+	if opts.Profile != "" {
+		settings, ok := opts.profiles[opts.Profile]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid -profile %q: no [%s.%s] table in the config file", opts.Profile, PROFILE_TABLE, opts.Profile)
+		}
+		if err := applyTable(flags, PROFILE_TABLE, opts.Profile, settings); err != nil {
+			return nil, nil, err
+		}
+	}
+	if device != nil {
+		for _, key := range deviceTables(opts.devices, device) {
+			if err := applyTable(flags, DEVICE_TABLE, key, opts.devices[key]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if settings, ok := opts.apps[app]; ok && app != "" {
+		if err := applyTable(flags, APP_TABLE, app, settings); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return opts, flags, nil
+}
+
+// validate checks the options that aren't parsed into a trackballscroll.Config
+func (o *Options) validate() error {
+	switch o.DetectMode {
+	case trackballscroll.DETECT_MODE_NAME, trackballscroll.DETECT_MODE_PROPS, trackballscroll.DETECT_MODE_BOTH:
+	default:
+		return fmt.Errorf("invalid -detect-mode %q: must be name, props or both", o.DetectMode)
+	}
+	if o.Seat != SEAT_AUTO && o.Seat != SEAT_ANY && !seatName.MatchString(o.Seat) {
+		return fmt.Errorf("invalid -seat %q: must be a seat name such as seat1, auto or any", o.Seat)
+	}
+
+	if o.Group != "" && o.User == "" {
+		return fmt.Errorf("-group needs -user")
+	}
+
+	if o.APIAddr != "" {
+		if err := validateAPIAddr(o.APIAddr); err != nil {
+			return err
+		}
+		if o.APITokenFile == "" && os.Getenv(API_TOKEN_ENV) == "" && o.APIToken == "" {
+			return fmt.Errorf("-api-addr needs -api-token-file, $%s or -api-token", API_TOKEN_ENV)
+		}
+	}
+
+	if o.MatchReplace && len(o.Match) == 0 {
+		return fmt.Errorf("-match-replace needs at least one -match keyword")
+	}
+
+	if o.DeviceRegex != "" {
+		re, err := regexp.Compile(o.DeviceRegex)
+		if err != nil {
+			return fmt.Errorf("invalid -device-regex: %w", err)
+		}
+		o.deviceRegex = re
+	}
+
+	o.exclusions = nil
+	for _, spec := range o.Exclude {
+		exclusion, err := trackballscroll.ParseExclusion(spec)
+		if err != nil {
+			return fmt.Errorf("invalid -exclude: %w", err)
+		}
+		o.exclusions = append(o.exclusions, exclusion)
+	}
+
+	if o.DeviceIndex < -1 {
+		return fmt.Errorf("invalid -device-index %d: must not be negative", o.DeviceIndex)
+	}
+
+	return nil
+}
+
+// scrollerConfig validates the scroll settings and converts them to a
+// trackballscroll.Config
+func (o *Options) scrollerConfig() (trackballscroll.Config, error) {
+	if o.IntentWindow < 1 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -intent-window %d: must be at least 1", o.IntentWindow)
+	}
+
+	xCode, err := trackballscroll.ParseRelCode(o.AxisXCode)
+	if err != nil {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -axis-x-code: %w", err)
+	}
+	yCode, err := trackballscroll.ParseRelCode(o.AxisYCode)
+	if err != nil {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -axis-y-code: %w", err)
+	}
+	if xCode == yCode {
+		return trackballscroll.Config{}, fmt.Errorf("-axis-x-code and -axis-y-code must differ")
+	}
+
+	identity, err := o.identity()
+	if err != nil {
+		return trackballscroll.Config{}, err
+	}
+
+	var scrollButton uint16
+	if o.ScrollButton != "" {
+		scrollButton, err = trackballscroll.ParseButtonCode(o.ScrollButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -scroll-button: %w", err)
+		}
+	}
+
+	var toggleButton uint16
+	if o.ToggleButton != "" {
+		toggleButton, err = trackballscroll.ParseButtonCode(o.ToggleButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -scroll-toggle-button: %w", err)
+		}
+	}
+	var scrollModifier, horizontalModifier uint16
+	if o.ScrollKey != "" {
+		scrollModifier, err = trackballscroll.ParseKeyCode(o.ScrollKey)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -scroll-modifier: %w", err)
+		}
+	}
+	if o.HScrollKey != "" {
+		horizontalModifier, err = trackballscroll.ParseKeyCode(o.HScrollKey)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -horizontal-modifier: %w", err)
+		}
+	}
+	if (scrollModifier != 0 || horizontalModifier != 0) && o.modifierDevice() == "" {
+		return trackballscroll.Config{}, fmt.Errorf("-scroll-modifier and -horizontal-modifier need -modifier-device or -palmcheck-device")
+	}
+	if scrollModifier != 0 && scrollModifier == horizontalModifier {
+		return trackballscroll.Config{}, fmt.Errorf("-scroll-modifier and -horizontal-modifier must differ")
+	}
+
+	if o.IdleUngrabMs < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -idle-ungrab-ms %d: must not be negative", o.IdleUngrabMs)
+	}
+	if o.GrabTimeoutMs < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -grab-timeout-ms %d: must not be negative", o.GrabTimeoutMs)
+	}
+
+	if o.DoubleTapMs <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -double-tap-ms %d: must be positive", o.DoubleTapMs)
+	}
+	if o.IdleScrollMs < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -scroll-after-idle-ms %d: must not be negative", o.IdleScrollMs)
+	}
+
+	var dragLockButton uint16
+	if o.DragLockButton != "" {
+		dragLockButton, err = trackballscroll.ParseButtonCode(o.DragLockButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -drag-lock-button: %w", err)
+		}
+		if dragLockButton == scrollButton || dragLockButton == toggleButton {
+			return trackballscroll.Config{}, fmt.Errorf("-drag-lock-button must differ from -scroll-button and -scroll-toggle-button")
+		}
+	}
+
+	var zoomButton uint16
+	if o.ZoomButton != "" {
+		zoomButton, err = trackballscroll.ParseButtonCode(o.ZoomButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -zoom-button: %w", err)
+		}
+		if zoomButton == scrollButton || zoomButton == toggleButton || zoomButton == dragLockButton {
+			return trackballscroll.Config{}, fmt.Errorf("-zoom-button must differ from -scroll-button, -scroll-toggle-button and -drag-lock-button")
+		}
+	}
+
+	var mediaButton uint16
+	if o.MediaButton != "" {
+		mediaButton, err = trackballscroll.ParseButtonCode(o.MediaButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -media-button: %w", err)
+		}
+		if mediaButton == scrollButton || mediaButton == toggleButton || mediaButton == dragLockButton || mediaButton == zoomButton {
+			return trackballscroll.Config{}, fmt.Errorf("-media-button must differ from -scroll-button, -scroll-toggle-button, -drag-lock-button and -zoom-button")
+		}
+	}
+
+	var modeButton uint16
+	if o.ModeButton != "" {
+		modeButton, err = trackballscroll.ParseButtonCode(o.ModeButton)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -mode-button: %w", err)
+		}
+		if modeButton == scrollButton || modeButton == toggleButton || modeButton == dragLockButton || modeButton == zoomButton || modeButton == mediaButton {
+			return trackballscroll.Config{}, fmt.Errorf("-mode-button must differ from the other buttons")
+		}
+	}
+
+	var modes []string
+	if o.Modes != "" {
+		modes, err = trackballscroll.ParseModes(o.Modes)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -modes: %w", err)
+		}
+	}
+
+	var customKeys [2][2]uint16
+	if o.CustomKeys != "" {
+		customKeys, err = trackballscroll.ParseCustomKeys(o.CustomKeys)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -custom-keys: %w", err)
+		}
+	} else if strings.Contains(o.Modes, trackballscroll.MODE_CUSTOM) {
+		return trackballscroll.Config{}, fmt.Errorf("-modes custom needs -custom-keys")
+	}
+
+	var buttonMap map[uint16][]uint16
+	for _, mapping := range o.Remap {
+		button, keys, err := trackballscroll.ParseButtonMapping(mapping)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -remap: %w", err)
+		}
+		if buttonMap == nil {
+			buttonMap = make(map[uint16][]uint16)
+		}
+		buttonMap[button] = keys
+	}
+
+	var chords []trackballscroll.Chord
+	for _, spec := range o.Chord {
+		chord, err := trackballscroll.ParseChord(spec)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -chord: %w", err)
+		}
+		if chord.Action != "" && !validChordAction(chord.Action) {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -chord %q: unknown action @%s", spec, chord.Action)
+		}
+		chords = append(chords, chord)
+	}
+	if o.ChordWindowMs <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -chord-window-ms %d: must be positive", o.ChordWindowMs)
+	}
+
+	if o.NotchCounts < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -notch-counts %d: must not be negative", o.NotchCounts)
+	}
+
+	if o.WheelSensitivity < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -wheel-sensitivity %g: must not be negative", o.WheelSensitivity)
+	}
+
+	switch o.ScrollOutput {
+	case trackballscroll.SCROLL_OUTPUT_WHEEL, trackballscroll.SCROLL_OUTPUT_PAGE, trackballscroll.SCROLL_OUTPUT_ARROWS, trackballscroll.SCROLL_OUTPUT_MEDIA:
+	default:
+		return trackballscroll.Config{}, fmt.Errorf("invalid -scroll-output %q: must be wheel, page, arrows or media", o.ScrollOutput)
+	}
+	if o.KeyThreshold < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -key-threshold %g: must not be negative", o.KeyThreshold)
+	}
+
+	wheelOutput, wheelKeys := o.WheelOutput, [2]uint16{}
+	switch wheelOutput {
+	case trackballscroll.WHEEL_OUTPUT_VERTICAL, trackballscroll.WHEEL_OUTPUT_HORIZONTAL, trackballscroll.WHEEL_OUTPUT_ZOOM:
+	default:
+		wheelKeys, err = trackballscroll.ParseWheelKeys(wheelOutput)
+		if err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -wheel-output %q: must be vertical, horizontal, zoom or <up key>/<down key>: %w", wheelOutput, err)
+		}
+		wheelOutput = trackballscroll.WHEEL_OUTPUT_KEYS
+	}
+
+	if o.CircularDegrees <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -circular-degrees %g: must be positive", o.CircularDegrees)
+	}
+
+	if o.PointerSpeed <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -pointer-sensitivity %g: must be positive", o.PointerSpeed)
+	}
+	if err := validateAccel("-pointer-accel", o.PointerAccel, o.AccelExponent); err != nil {
+		return trackballscroll.Config{}, err
+	}
+
+	if err := validateAccel("-accel", o.Accel, o.AccelExponent); err != nil {
+		return trackballscroll.Config{}, err
+	}
+	var curve *trackballscroll.Curve
+	if o.Curve != "" {
+		if curve, err = trackballscroll.ParseCurve(o.Curve); err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -curve: %w", err)
+		}
+	}
+
+	if err := validateSmoothing(o.Smoothing); err != nil {
+		return trackballscroll.Config{}, err
+	}
+
+	if o.SlowSpeed < 0 || o.FastSpeed <= o.SlowSpeed {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -ballistics-slow-speed %g and -ballistics-fast-speed %g: must be non-negative and increasing", o.SlowSpeed, o.FastSpeed)
+	}
+	if o.SlowGain <= 0 || o.FastGain <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -ballistics-slow-gain %g or -ballistics-fast-gain %g: must be positive", o.SlowGain, o.FastGain)
+	}
+
+	if o.AxisSnapRatio != 0 && o.AxisSnapRatio < 1 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -axis-snap-ratio %g: must be at least 1, or 0 to disable", o.AxisSnapRatio)
+	}
+	if o.SoftStartMs < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -soft-start-ms %d: must not be negative", o.SoftStartMs)
+	}
+	if o.FilterTimeoutMs <= 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -filter-timeout-ms %d: must be positive", o.FilterTimeoutMs)
+	}
+	if o.Script != "" {
+		if err := trackballscroll.CheckScript(o.Script); err != nil {
+			return trackballscroll.Config{}, fmt.Errorf("invalid -script: %w", err)
+		}
+	}
+
+	if o.MaxScrollRate < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -max-scroll-rate %d: must not be negative", o.MaxScrollRate)
+	}
+	if o.MaxScrollStep < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -max-scroll-step %g: must not be negative", o.MaxScrollStep)
+	}
+
+	if o.KineticFriction <= 0 || o.KineticFriction >= 1 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -kinetic-friction %g: must be between 0 and 1", o.KineticFriction)
+	}
+
+	switch o.WriteFull {
+	case trackballscroll.WRITE_FULL_DROP, trackballscroll.WRITE_FULL_BLOCK, trackballscroll.WRITE_FULL_RETRY:
+	default:
+		return trackballscroll.Config{}, fmt.Errorf("invalid -write-full %q: must be drop, block or retry", o.WriteFull)
+	}
+
+	if o.QueueSize < 0 {
+		return trackballscroll.Config{}, fmt.Errorf("invalid -queue-size %d: must not be negative", o.QueueSize)
+	}
+	switch o.QueueFull {
+	case trackballscroll.QUEUE_FULL_BLOCK, trackballscroll.QUEUE_FULL_DROP_OLDEST:
+	default:
+		return trackballscroll.Config{}, fmt.Errorf("invalid -queue-full %q: must be block or drop-oldest", o.QueueFull)
+	}
+
+	// Per-axis values fall back to the shared ones when not given
+	sensitivityX, sensitivityY := o.SensitivityX, o.SensitivityY
+	if sensitivityX < 0 {
+		sensitivityX = o.Sensitivity
+	}
+	if sensitivityY < 0 {
+		sensitivityY = o.Sensitivity
+	}
+	deadZoneX, deadZoneY := o.DeadZoneX, o.DeadZoneY
+	if deadZoneX < 0 {
+		deadZoneX = o.DeadZone
+	}
+	if deadZoneY < 0 {
+		deadZoneY = o.DeadZone
+	}
+
+	return trackballscroll.Config{
+		SensitivityX:  sensitivityX,
+		SensitivityY:  sensitivityY,
+		DeadZoneX:     int32(deadZoneX),
+		DeadZoneY:     int32(deadZoneY),
+		InvertX:       o.InvertX,
+		InvertY:       o.InvertY,
+		SwapAxes:      o.SwapAxes,
+		SmoothEmit:    o.SmoothEmit,
+		ClickCooldown: time.Duration(o.ClickCooldownMs) * time.Millisecond,
+		AntiOvershoot: o.AntiOvershoot,
+		WriteFull:     o.WriteFull,
+		QueueSize:     o.QueueSize,
+		QueueFull:     o.QueueFull,
+
+		IntentThreshold: int32(o.IntentThreshold),
+		IntentWindow:    o.IntentWindow,
+
+		PalmCheck: time.Duration(o.PalmCheckMs) * time.Millisecond,
+
+		Filter:        o.Filter,
+		FilterTimeout: time.Duration(o.FilterTimeoutMs) * time.Millisecond,
+		Script:        o.Script,
+
+		Rotation: o.Rotation,
+
+		AxisXCode: xCode,
+		AxisYCode: yCode,
+
+		Watchdog:   time.Duration(o.WatchdogMs) * time.Millisecond,
+		IdleUngrab: time.Duration(o.IdleUngrabMs) * time.Millisecond,
+
+		ScrollButton:   scrollButton,
+		ZoomButton:     zoomButton,
+		MediaButton:    mediaButton,
+		MediaKeys:      o.MediaKeys,
+		Modes:          modes,
+		ModeButton:     modeButton,
+		CustomKeys:     customKeys,
+		ToggleButton:   toggleButton,
+		DragLockButton: dragLockButton,
+
+		ScrollModifier:     scrollModifier,
+		HorizontalModifier: horizontalModifier,
+
+		NotchCounts: o.NotchCounts,
+
+		WheelSensitivity: o.WheelSensitivity,
+
+		PointerSensitivity: o.PointerSpeed,
+		PointerAccel:       o.PointerAccel,
+		InvertWheel:        o.InvertWheel,
+		WheelOutput:        wheelOutput,
+		WheelKeys:          wheelKeys,
+		ScrollOutput:       o.ScrollOutput,
+		KeyThreshold:       o.KeyThreshold,
+
+		Circular:        o.Circular,
+		CircularDegrees: o.CircularDegrees,
+		DoubleTap:       time.Duration(o.DoubleTapMs) * time.Millisecond,
+		ScrollAfterIdle: time.Duration(o.IdleScrollMs) * time.Millisecond,
+		ButtonMap:       buttonMap,
+
+		Chords:      chords,
+		ChordWindow: time.Duration(o.ChordWindowMs) * time.Millisecond,
+
+		HiRes: o.HiRes,
+
+		Accel:         o.Accel,
+		AccelExponent: o.AccelExponent,
+		Curve:         curve,
+
+		Smoothing: o.Smoothing,
+
+		Ballistics:          o.Ballistics,
+		BallisticsSlowSpeed: o.SlowSpeed,
+		BallisticsFastSpeed: o.FastSpeed,
+		BallisticsSlowGain:  o.SlowGain,
+		BallisticsFastGain:  o.FastGain,
+
+		MaxScrollRate: o.MaxScrollRate,
+		MaxScrollStep: o.MaxScrollStep,
+
+		Kinetic:         o.Kinetic,
+		KineticFriction: o.KineticFriction,
+
+		AxisLock:        o.AxisLock,
+		AxisLockTimeout: time.Duration(o.AxisLockTimeout) * time.Millisecond,
+
+		AxisSnapRatio: o.AxisSnapRatio,
+
+		SoftStart: time.Duration(o.SoftStartMs) * time.Millisecond,
+
+		DryRun:  o.DryRun,
+		Overlay: o.Overlay,
+
+		Identity:      identity,
+		CloneIdentity: o.CloneIdentity,
+		SplitDevices:  o.SplitDevices,
+
+		DevicePath: o.Device,
+		Detect:     o.detection(),
+		Reconnect:  o.Reconnect || o.Wait,
+	}, nil
+}
+
+// modifierDevice returns the keyboard to watch for modifier keys, which
+// defaults to the palm check one
+func (o *Options) modifierDevice() string {
+	if o.ModifierDevice != "" {
+		return o.ModifierDevice
+	}
+	return o.PalmCheckDevice
+}
+
+// identity returns the name and IDs the virtual device should present
+func (o *Options) identity() (trackballscroll.DeviceIdentity, error) {
+	id := trackballscroll.DeviceIdentity{Name: o.VirtualName}
+
+	if o.VirtualID != "" {
+		vendor, product, ok := trackballscroll.ParseDeviceID(o.VirtualID)
+		if !ok {
+			return id, fmt.Errorf("invalid -virtual-id %q: expected vendor:product in hex, e.g. 047d:2041", o.VirtualID)
+		}
+		id.Vendor, id.Product = vendor, product
+	}
+
+	if o.VirtualBus != "" {
+		bus, err := trackballscroll.ParseBusType(o.VirtualBus)
+		if err != nil {
+			return id, fmt.Errorf("invalid -virtual-bus: %w", err)
+		}
+		id.Bustype = bus
+	}
+
+	if o.VirtualVersion < 0 || o.VirtualVersion > 0xffff {
+		return id, fmt.Errorf("invalid -virtual-version %d: must be between 0 and 65535", o.VirtualVersion)
+	}
+	id.Version = uint16(o.VirtualVersion)
+
+	if len(o.VirtualName) >= trackballscroll.UINPUT_MAX_NAME_SIZE {
+		return id, fmt.Errorf("invalid -virtual-name: longer than %d bytes", trackballscroll.UINPUT_MAX_NAME_SIZE-1)
+	}
+	return id, nil
+}
+
+// deviceConfig returns the scroller settings for device: cfg, from the options
+// parsed from args and app, or when the config file has [devices.<...>]
+// tables for the device, the options parsed again with those applied. Either
+// way -device-config goes on top
+func (o *Options) deviceConfig(cfg trackballscroll.Config, args []string, app string, device *evdev.InputDevice) (trackballscroll.Config, error) {
+	if len(deviceTables(o.devices, device)) == 0 {
+		return o.DeviceConfig.apply(cfg, device), nil
+	}
+
+	opts, _, err := parseDeviceFlags(args, flag.ContinueOnError, app, device)
+	if err != nil {
+		return trackballscroll.Config{}, err
+	}
+	cfg, err = opts.scrollerConfig()
+	if err != nil {
+		return trackballscroll.Config{}, fmt.Errorf("settings for %s: %w", device.Name, err)
+	}
+	return opts.DeviceConfig.apply(cfg, device), nil
+}
+
+// detection returns how auto-detection should recognize trackballs
+func (o *Options) detection() trackballscroll.Detection {
+	keywords := trackballscroll.DefaultKeywords()
+	var products []trackballscroll.ProductID
+	if o.MatchReplace {
+		// Also skip the built-in product IDs
+		keywords = nil
+		products = []trackballscroll.ProductID{}
+	}
+	return trackballscroll.Detection{
+		Mode:     o.DetectMode,
+		Keywords: append(keywords, o.Match...),
+		Products: products,
+
+		NameRegex: o.deviceRegex,
+		Exclude:   o.exclusions,
+		Seat:      resolveSeat(o.Seat),
+	}
+}
+
+// validateAccel checks the acceleration profile given to the flag name and its exponent
+func validateAccel(name string, profile string, exponent float64) error {
+	switch profile {
+	case trackballscroll.ACCEL_LINEAR, trackballscroll.ACCEL_QUADRATIC, trackballscroll.ACCEL_LOGARITHMIC:
+		return nil
+	case trackballscroll.ACCEL_EXPONENT:
+		if exponent <= 0 {
+			return fmt.Errorf("invalid -accel-exponent %g: must be positive", exponent)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid %s %q: must be linear, quadratic, logarithmic or exponent", name, profile)
+	}
+}
+
+// validateSmoothing checks a -smoothing weight
+func validateSmoothing(weight float64) error {
+	if weight < 0 || weight >= 1 {
+		return fmt.Errorf("invalid -smoothing %g: must be at least 0 and below 1", weight)
+	}
+	return nil
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("empty value")
+	}
+	*l = append(*l, value)
+	return nil
+}
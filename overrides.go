@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// deviceOverride holds the settings given for one device by -device-config
+type deviceOverride struct {
+	match        string // device path, or device name compared case-insensitively
+	sensitivityX *float64
+	sensitivityY *float64
+	deadZoneX    *int32
+	deadZoneY    *int32
+}
+
+// deviceOverrides collects repeated -device-config flags of the form
+// "<path or name>:sensitivity=0.5,deadzone=3"
+type deviceOverrides []deviceOverride
+
+func (d *deviceOverrides) String() string {
+	matches := make([]string, len(*d))
+	for i, override := range *d {
+		matches[i] = override.match
+	}
+	return strings.Join(matches, ", ")
+}
+
+func (d *deviceOverrides) Set(value string) error {
+	sep := strings.LastIndex(value, ":")
+	if sep <= 0 {
+		return fmt.Errorf("expected <path or name>:<settings>, got %q", value)
+	}
+
+	override := deviceOverride{match: value[:sep]}
+	for _, setting := range strings.Split(value[sep+1:], ",") {
+		key, val, ok := strings.Cut(setting, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", setting)
+		}
+
+		key = strings.TrimSpace(key)
+		switch key {
+		case "sensitivity", "sensitivity-x", "sensitivity-y":
+			sensitivity, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, val)
+			}
+			if key != "sensitivity-y" {
+				override.sensitivityX = &sensitivity
+			}
+			if key != "sensitivity-x" {
+				override.sensitivityY = &sensitivity
+			}
+		case "deadzone", "deadzone-x", "deadzone-y":
+			parsed, err := strconv.ParseInt(strings.TrimSpace(val), 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, val)
+			}
+			deadZone := int32(parsed)
+			if key != "deadzone-y" {
+				override.deadZoneX = &deadZone
+			}
+			if key != "deadzone-x" {
+				override.deadZoneY = &deadZone
+			}
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+
+	*d = append(*d, override)
+	return nil
+}
+
+// apply returns cfg with the overrides that match device applied in order
+func (d deviceOverrides) apply(cfg trackballscroll.Config, device *evdev.InputDevice) trackballscroll.Config {
+	for _, override := range d {
+		if override.match != device.Fn && !strings.EqualFold(override.match, device.Name) {
+			continue
+		}
+
+		if override.sensitivityX != nil {
+			cfg.SensitivityX = *override.sensitivityX
+		}
+		if override.sensitivityY != nil {
+			cfg.SensitivityY = *override.sensitivityY
+		}
+		if override.deadZoneX != nil {
+			cfg.DeadZoneX = *override.deadZoneX
+		}
+		if override.deadZoneY != nil {
+			cfg.DeadZoneY = *override.deadZoneY
+		}
+	}
+	return cfg
+}
+
+// deviceTables returns the keys of the config file's [devices.<...>] tables
+// that apply to device, least specific first: those naming it, then its
+// vendor:product ID, then its path or a link to it
+func deviceTables(tables map[string]map[string]interface{}, device *evdev.InputDevice) []string {
+	keys := make([]string, 0, len(tables))
+	for key := range tables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var byName, byID, byPath []string
+	for _, key := range keys {
+		if vendor, product, ok := trackballscroll.ParseDeviceID(key); ok {
+			if vendor == device.Vendor && product == device.Product {
+				byID = append(byID, key)
+			}
+		} else if strings.HasPrefix(key, "/") {
+			if resolved, err := filepath.EvalSymlinks(key); key == device.Fn || err == nil && resolved == device.Fn {
+				byPath = append(byPath, key)
+			}
+		} else if strings.EqualFold(key, device.Name) {
+			byName = append(byName, key)
+		}
+	}
+	return append(append(byName, byID...), byPath...)
+}
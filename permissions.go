@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+const (
+	UDEV_GROUP      = "trackball-scroll"
+	UDEV_RULES_PATH = "/etc/udev/rules.d/70-trackball-scroll.rules"
+	UINPUT_MODULE   = "/sys/module/uinput"
+)
+
+// explainAccessError logs what to do about a device or /dev/uinput that
+// couldn't be opened, if the cause is a missing module, permission or another
+// process holding the grab
+func explainAccessError(path string, err error) {
+	switch {
+	case errors.Is(err, syscall.EBUSY):
+		holders := trackballscroll.DeviceHolders(path)
+		if len(holders) == 0 {
+			slog.Error(fmt.Sprintf("%s is grabbed by another process. Run as root to see which", path))
+			break
+		}
+		for _, holder := range holders {
+			slog.Error(fmt.Sprintf("%s has %s open and may be holding the grab. Stop it, or use -replace if it is another trackball-scroll", holder, path))
+		}
+	case errors.Is(err, os.ErrNotExist) && path == trackballscroll.UINPUT_PATH:
+		if _, statErr := os.Stat(UINPUT_MODULE); statErr != nil {
+			slog.Error("The uinput kernel module isn't loaded. Load it with 'sudo modprobe uinput', and add 'uinput' to /etc/modules-load.d/uinput.conf to load it at boot")
+		}
+	case errors.Is(err, os.ErrPermission):
+		slog.Error(permissionHint(path))
+	}
+}
+
+// permissionHint explains why path can't be opened by the current user, based
+// on the group owning it and the groups the user and this process are in
+func permissionHint(path string) string {
+	rules := fmt.Sprintf("or give the %s group access with 'trackball-scroll gen-udev-rules'", UDEV_GROUP)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("No permission to open %s. Run as root, %s", path, rules)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Sprintf("No permission to open %s. Run as root, %s", path, rules)
+	}
+
+	gid := int(stat.Gid)
+	groupName := strconv.Itoa(gid)
+	if group, err := user.LookupGroupId(groupName); err == nil {
+		groupName = group.Name
+	}
+
+	if stat.Gid == 0 || info.Mode().Perm()&0060 != 0060 {
+		return fmt.Sprintf("No permission to open %s: it is only accessible to root (mode %s, group %s). Run as root, %s",
+			path, info.Mode().Perm(), groupName, rules)
+	}
+
+	if processGroups, err := os.Getgroups(); err == nil && inGroup(processGroups, gid) {
+		return fmt.Sprintf("No permission to open %s even though this process is in group %s. Check for ACLs or security modules, %s",
+			path, groupName, rules)
+	}
+
+	if current, err := user.Current(); err == nil {
+		if accountGroups, err := userGroups(current); err == nil && inGroup(accountGroups, gid) {
+			return fmt.Sprintf("No permission to open %s: you were added to group %s but haven't logged in again since. Log out and back in, or run 'newgrp %s'",
+				path, groupName, groupName)
+		}
+	}
+
+	return fmt.Sprintf("No permission to open %s: you aren't in group %s. Add yourself with 'sudo usermod -aG %s $USER' and log in again, %s",
+		path, groupName, groupName, rules)
+}
+
+// userGroups returns the group IDs the account database lists for a user
+func userGroups(u *user.User) ([]int, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var gids []int
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil {
+			gids = append(gids, gid)
+		}
+	}
+	return gids, nil
+}
+
+func inGroup(gids []int, gid int) bool {
+	for _, g := range gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// genUdevRules prints udev rules giving a dedicated group access to
+// /dev/uinput and to pointer devices, so the program can run without root
+func genUdevRules(args []string) error {
+	flags := flag.NewFlagSet("gen-udev-rules", flag.ContinueOnError)
+	group := flags.String("group", UDEV_GROUP, "Group to give access to the devices")
+	seat := flags.String("seat", "", "Also assign the virtual devices made from trackballs on this seat to it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if *seat != "" && !seatName.MatchString(*seat) {
+		return fmt.Errorf("invalid -seat %q: must be a seat name such as seat1", *seat)
+	}
+
+	fmt.Printf(`# udev rules letting members of the %[1]s group run trackball-scroll
+# without root. To install:
+#
+#   trackball-scroll gen-udev-rules | sudo tee %[2]s
+#   sudo groupadd --system %[1]s
+#   sudo usermod -aG %[1]s $USER
+#   echo uinput | sudo tee /etc/modules-load.d/uinput.conf
+#   sudo modprobe uinput
+#   sudo udevadm control --reload && sudo udevadm trigger
+#
+# then log out and back in. -palmcheck-device also needs read access to the
+# keyboard, e.g. through the input group.
+
+KERNEL=="uinput", SUBSYSTEM=="misc", GROUP="%[1]s", MODE="0660", OPTIONS+="static_node=uinput"
+SUBSYSTEM=="input", KERNEL=="event*", ENV{ID_INPUT_MOUSE}=="1", GROUP="%[1]s", MODE="0660"
+`, *group, UDEV_RULES_PATH)
+
+	// A virtual device has no parent for the seat to be inherited from, so
+	// match the seat its phys ends with
+	if *seat != "" {
+		fmt.Printf(`
+# Virtual devices made from trackballs on %[1]s belong to it as well
+SUBSYSTEM=="input", ATTRS{phys}=="%[2]s*/%[1]s", ENV{ID_SEAT}="%[1]s"
+`, *seat, trackballscroll.VIRTUAL_PHYS_PREFIX)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// chooseDevice picks one of several detected trackballs: the one at
+// -device-index, or one picked from a menu when stdin is a terminal, which is
+// then remembered in the config file. Otherwise the first one is used
+func chooseDevice(paths []string, opts *Options) (string, error) {
+	if opts.DeviceIndex >= 0 {
+		if opts.DeviceIndex < len(paths) {
+			return paths[opts.DeviceIndex], nil
+		}
+		slog.Warn("-device-index is out of range, using the first trackball",
+			"device_index", opts.DeviceIndex, "found", paths)
+		return paths[0], nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		slog.Info("Multiple trackballs found, using the first one (use -device-index or -all-devices to choose)",
+			"found", paths, "using", paths[0])
+		return paths[0], nil
+	}
+
+	index, err := promptDevice(paths)
+	if err != nil {
+		return "", err
+	}
+
+	configPath := opts.ConfigPath
+	if configPath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			slog.Warn("Failed to remember device choice", "error", err)
+			return paths[index], nil
+		}
+		configPath = filepath.Join(dir, CONFIG_DIR_NAME, CONFIG_FILE_NAME)
+	}
+	if err := saveSetting(configPath, "device-index", strconv.Itoa(index)); err != nil {
+		slog.Warn("Failed to remember device choice", "error", err)
+	} else {
+		slog.Info("Remembered device choice", "device_index", index, "config", configPath)
+	}
+
+	return paths[index], nil
+}
+
+// promptDevice shows a numbered menu of trackballs on stdout and reads the
+// chosen number from stdin
+func promptDevice(paths []string) (int, error) {
+	fmt.Println("Multiple trackballs found:")
+	for i, path := range paths {
+		name := "unknown"
+		if device, err := evdev.Open(path); err == nil {
+			name = device.Name
+			device.File.Close()
+		}
+		fmt.Printf("  %d) %s (%s)\n", i, name, path)
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("Use which one? [0-%d]: ", len(paths)-1)
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				return 0, fmt.Errorf("failed to read choice: %w", err)
+			}
+			return 0, fmt.Errorf("no trackball chosen")
+		}
+
+		index, err := strconv.Atoi(strings.TrimSpace(input.Text()))
+		if err == nil && index >= 0 && index < len(paths) {
+			return index, nil
+		}
+	}
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
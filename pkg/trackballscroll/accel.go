@@ -0,0 +1,41 @@
+package trackballscroll
+
+import "math"
+
+// Acceleration profiles for Config.Accel
+const (
+	ACCEL_LINEAR      = "linear"
+	ACCEL_QUADRATIC   = "quadratic"
+	ACCEL_LOGARITHMIC = "logarithmic"
+	ACCEL_EXPONENT    = "exponent"
+)
+
+// accelerate shapes a raw motion delta with the configured scroll profile,
+// or the custom curve if there is one
+func accelerate(cfg *Config, value int32) float64 {
+	if cfg.Curve != nil {
+		return cfg.Curve.apply(value)
+	}
+	return shapeDelta(cfg.Accel, cfg.AccelExponent, value)
+}
+
+// shapeDelta applies an ACCEL_* profile to a raw motion delta. Every profile
+// maps a delta of 1 to 1, so slow motion keeps its resolution and only larger
+// deltas are stretched or compressed
+func shapeDelta(profile string, exponent float64, value int32) float64 {
+	magnitude := float64(abs(value))
+
+	switch profile {
+	case ACCEL_QUADRATIC:
+		magnitude = magnitude * magnitude
+	case ACCEL_LOGARITHMIC:
+		magnitude = math.Log2(1 + magnitude)
+	case ACCEL_EXPONENT:
+		magnitude = math.Pow(magnitude, exponent)
+	}
+
+	if value < 0 {
+		return -magnitude
+	}
+	return magnitude
+}
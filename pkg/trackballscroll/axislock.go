@@ -0,0 +1,40 @@
+package trackballscroll
+
+import "time"
+
+// AXIS_LOCK_DECISION_DISTANCE is how far the ball must travel at the start of
+// a gesture before the dominant axis is chosen
+const AXIS_LOCK_DECISION_DISTANCE = 4
+
+// axisLock picks the dominant axis at the start of a gesture and suppresses
+// the other one until motion stops for the configured timeout
+type axisLock struct {
+	locked     bool
+	horizontal bool
+	sumX, sumY int32
+	lastAt     time.Time
+}
+
+// allow records motion at t and reports whether this axis may scroll
+func (l *axisLock) allow(isHorizontal bool, value int32, t time.Time, timeout time.Duration) bool {
+	if !l.lastAt.IsZero() && t.Sub(l.lastAt) > timeout {
+		*l = axisLock{}
+	}
+	l.lastAt = t
+
+	if !l.locked {
+		if isHorizontal {
+			l.sumX += abs(value)
+		} else {
+			l.sumY += abs(value)
+		}
+
+		if l.sumX < AXIS_LOCK_DECISION_DISTANCE && l.sumY < AXIS_LOCK_DECISION_DISTANCE {
+			return false
+		}
+		l.locked = true
+		l.horizontal = l.sumX > l.sumY
+	}
+
+	return isHorizontal == l.horizontal
+}
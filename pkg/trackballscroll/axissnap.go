@@ -0,0 +1,32 @@
+package trackballscroll
+
+import "time"
+
+// axisSnap suppresses the minor axis of a gesture while the major axis
+// outweighs it by more than a ratio. Unlike axisLock nothing is latched: a
+// gesture that turns truly diagonal scrolls on both axes
+type axisSnap struct {
+	sumX, sumY int32
+	lastAt     time.Time
+}
+
+// allow records motion at t and reports whether this axis may scroll. A
+// pause longer than VELOCITY_RESET_GAP starts a new gesture, and nothing is
+// suppressed until it has travelled AXIS_LOCK_DECISION_DISTANCE
+func (s *axisSnap) allow(isHorizontal bool, value int32, t time.Time, ratio float64) bool {
+	if s.lastAt.IsZero() || t.Sub(s.lastAt) > VELOCITY_RESET_GAP {
+		*s = axisSnap{}
+	}
+	s.lastAt = t
+
+	this, other := &s.sumY, &s.sumX
+	if isHorizontal {
+		this, other = &s.sumX, &s.sumY
+	}
+	*this += abs(value)
+
+	if *other < AXIS_LOCK_DECISION_DISTANCE {
+		return true
+	}
+	return float64(*other) <= ratio*float64(*this)
+}
@@ -0,0 +1,52 @@
+package trackballscroll
+
+import "time"
+
+const (
+	BALLISTICS_WINDOW  = 50 * time.Millisecond // motion averaged into the speed
+	BALLISTICS_SAMPLES = 32                    // most events kept within the window
+
+	DEFAULT_BALLISTICS_SLOW_SPEED = 100.0  // counts per second
+	DEFAULT_BALLISTICS_FAST_SPEED = 1000.0 // counts per second
+	DEFAULT_BALLISTICS_SLOW_GAIN  = 1.0
+	DEFAULT_BALLISTICS_FAST_GAIN  = 4.0
+)
+
+// ballistics estimates ball speed on one axis over the last
+// BALLISTICS_WINDOW, which is steadier than the gap between two events
+type ballistics struct {
+	at     [BALLISTICS_SAMPLES]time.Time
+	counts [BALLISTICS_SAMPLES]int32
+	next   int
+}
+
+// speed records motion at t and returns the counts per second over the
+// window ending at t
+func (b *ballistics) speed(t time.Time, value int32) float64 {
+	b.at[b.next] = t
+	b.counts[b.next] = abs(value)
+	b.next = (b.next + 1) % BALLISTICS_SAMPLES
+
+	var total int32
+	for i := range b.at {
+		if !b.at[i].IsZero() && t.Sub(b.at[i]) < BALLISTICS_WINDOW {
+			total += b.counts[i]
+		}
+	}
+	return float64(total) / BALLISTICS_WINDOW.Seconds()
+}
+
+// ballisticGain maps ball speed to a scroll multiplier: BallisticsSlowGain up
+// to BallisticsSlowSpeed, BallisticsFastGain from BallisticsFastSpeed, and a
+// straight line in between, like libinput's pointer acceleration
+func ballisticGain(cfg *Config, speed float64) float64 {
+	switch {
+	case speed <= cfg.BallisticsSlowSpeed:
+		return cfg.BallisticsSlowGain
+	case speed >= cfg.BallisticsFastSpeed:
+		return cfg.BallisticsFastGain
+	}
+
+	fraction := (speed - cfg.BallisticsSlowSpeed) / (cfg.BallisticsFastSpeed - cfg.BallisticsSlowSpeed)
+	return cfg.BallisticsSlowGain + fraction*(cfg.BallisticsFastGain-cfg.BallisticsSlowGain)
+}
@@ -0,0 +1,158 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CHORD_WINDOW = 50 * time.Millisecond
+
+// Chord is a pair of buttons pressed together that send other keys instead,
+// or trigger an action the program using the Scroller carries out
+type Chord struct {
+	Buttons [2]uint16
+	Keys    []uint16 // pressed together, like a ButtonMap entry
+	Action  string   // reported to ChordObserver.ChordAction instead of sending keys
+}
+
+// ParseChord parses a chord such as BTN_LEFT+BTN_RIGHT=BTN_MIDDLE, with the
+// same right-hand side as ParseButtonMapping, or an action after "@" as in
+// BTN_SIDE+BTN_EXTRA=@profile
+func ParseChord(value string) (Chord, error) {
+	buttons, keys, ok := strings.Cut(value, "=")
+	if !ok {
+		return Chord{}, fmt.Errorf("expected <button>+<button>=<keys or @action>, got %q", value)
+	}
+
+	names := strings.Split(buttons, "+")
+	if len(names) != 2 {
+		return Chord{}, fmt.Errorf("a chord needs two buttons, got %q", buttons)
+	}
+
+	var chord Chord
+	for i, name := range names {
+		button, err := ParseKeyCode(strings.TrimSpace(name))
+		if err != nil {
+			return Chord{}, err
+		}
+		chord.Buttons[i] = button
+	}
+	if chord.Buttons[0] == chord.Buttons[1] {
+		return Chord{}, fmt.Errorf("a chord needs two different buttons, got %q", buttons)
+	}
+
+	if action, ok := strings.CutPrefix(strings.TrimSpace(keys), "@"); ok {
+		if action == "" {
+			return Chord{}, fmt.Errorf("missing action after @ in %q", value)
+		}
+		chord.Action = action
+		return chord, nil
+	}
+
+	var err error
+	chord.Keys, err = parseKeys(keys)
+	if err != nil {
+		return Chord{}, err
+	}
+	return chord, nil
+}
+
+// has reports whether button is part of the chord
+func (c *Chord) has(button uint16) bool {
+	return c.Buttons[0] == button || c.Buttons[1] == button
+}
+
+// chorder holds back the press of a chord button for the chord window, to
+// see whether its partner follows, and forwards it as usual if not
+type chorder struct {
+	mu      sync.Mutex
+	pending uint16 // button press held back, 0 for none
+	timer   *time.Timer
+	gen     int             // bumped per held-back press, so a stale timer does nothing
+	active  *Chord          // chord currently pressed
+	down    map[uint16]bool // buttons of the active chord still pressed
+}
+
+// handle processes a button event and reports whether it was consumed as
+// part of a chord
+func (c *chorder) handle(ts *Scroller, chords []Chord, window time.Duration, code uint16, value int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch value {
+	case 1:
+		if c.pending != 0 {
+			if chord := findChord(chords, c.pending, code); chord != nil {
+				c.timer.Stop()
+				c.pending = 0
+				c.active = chord
+				c.down = map[uint16]bool{chord.Buttons[0]: true, chord.Buttons[1]: true}
+				if chord.Action != "" {
+					ts.observers.ChordAction(ts.Device(), chord.Action)
+				} else {
+					ts.sendMappedButton(chord.Keys, 1)
+				}
+				return true
+			}
+			c.flush(ts)
+		}
+
+		if c.active == nil && findChord(chords, code, 0) != nil {
+			c.pending = code
+			c.gen++
+			gen := c.gen
+			c.timer = time.AfterFunc(window, func() {
+				defer ts.cleanupOnPanic()
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				if c.gen == gen {
+					c.flush(ts)
+				}
+			})
+			return true
+		}
+		return false
+	case 0:
+		if c.pending == code {
+			// Tapped too quickly for a chord: press now, release as usual
+			c.flush(ts)
+			return false
+		}
+		if c.active != nil && c.down[code] {
+			if len(c.down) == 2 && c.active.Action == "" {
+				ts.sendMappedButton(c.active.Keys, 0)
+			}
+			delete(c.down, code)
+			if len(c.down) == 0 {
+				c.active = nil
+			}
+			return true
+		}
+		return false
+	default:
+		return c.pending == code || (c.active != nil && c.down[code])
+	}
+}
+
+// flush forwards a held-back press, with c.mu held
+func (c *chorder) flush(ts *Scroller) {
+	if c.pending == 0 {
+		return
+	}
+	c.timer.Stop()
+	ts.forwardButton(c.pending, 1)
+	c.pending = 0
+}
+
+// findChord returns the chord made of a and b, or any chord with a when b is 0
+func findChord(chords []Chord, a, b uint16) *Chord {
+	for i := range chords {
+		chord := &chords[i]
+		if chord.has(a) && (b == 0 || (b != a && chord.has(b))) {
+			return chord
+		}
+	}
+	return nil
+}
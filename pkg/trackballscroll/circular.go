@@ -0,0 +1,70 @@
+package trackballscroll
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	DEFAULT_CIRCULAR_DEGREES = 30.0 // rotation per scroll click
+	CIRCULAR_MIN_STEP        = 4.0  // motion between heading samples, in device units
+)
+
+// circularScroll turns the rotation of the ball's direction of motion into
+// scroll clicks, so moving it in circles scrolls continuously while straight
+// motion doesn't scroll at all
+type circularScroll struct {
+	dx, dy     int32   // motion since the last heading sample
+	heading    float64 // direction of the last sample in radians
+	hasHeading bool
+	rotation   float64 // degrees not yet turned into clicks, clockwise positive
+	lastAt     time.Time
+}
+
+// add records motion on one axis
+func (c *circularScroll) add(isHorizontal bool, value int32) {
+	if isHorizontal {
+		c.dx += value
+	} else {
+		c.dy += value
+	}
+}
+
+// frame ends an input frame at t and returns the whole clicks turned,
+// clockwise positive
+func (c *circularScroll) frame(t time.Time, degreesPerClick float64) int32 {
+	if c.dx == 0 && c.dy == 0 {
+		return 0
+	}
+
+	// A pause starts a new gesture
+	if !c.lastAt.IsZero() && t.Sub(c.lastAt) > VELOCITY_RESET_GAP {
+		c.hasHeading = false
+		c.rotation = 0
+	}
+	c.lastAt = t
+
+	// Short steps give too coarse a direction
+	if math.Hypot(float64(c.dx), float64(c.dy)) < CIRCULAR_MIN_STEP {
+		return 0
+	}
+
+	// Y grows downward, so the angle grows clockwise
+	heading := math.Atan2(float64(c.dy), float64(c.dx))
+	c.dx, c.dy = 0, 0
+
+	if c.hasHeading {
+		turn := heading - c.heading
+		if turn > math.Pi {
+			turn -= 2 * math.Pi
+		} else if turn <= -math.Pi {
+			turn += 2 * math.Pi
+		}
+		c.rotation += turn * 180 / math.Pi
+	}
+	c.heading, c.hasHeading = heading, true
+
+	clicks := math.Trunc(c.rotation / degreesPerClick)
+	c.rotation -= clicks * degreesPerClick
+	return int32(clicks)
+}
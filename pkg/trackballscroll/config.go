@@ -0,0 +1,425 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// Config holds the user-tunable settings of a Scroller
+type Config struct {
+	SensitivityX  float64
+	SensitivityY  float64
+	DeadZoneX     int32
+	DeadZoneY     int32
+	InvertX       bool // reverse horizontal scroll direction
+	InvertY       bool // reverse vertical scroll direction, giving natural scrolling
+	SwapAxes      bool // scroll vertically with the ball's horizontal motion and vice versa
+	SmoothEmit    bool
+	ClickCooldown time.Duration // suppress scroll for this long after a button event
+	AntiOvershoot bool          // attenuate the tail end of a sharply decelerating flick
+	WriteFull     string        // WRITE_FULL_* policy for a would-block uinput write
+
+	// Input batches are queued for a separate writer goroutine, up to
+	// QueueSize of them; 0 handles each batch on the reading goroutine.
+	// QueueFull is the QUEUE_FULL_* policy once the queue is full;
+	// QUEUE_FULL_DROP_OLDEST coalesces the queued motion but keeps every
+	// button change
+	QueueSize int
+	QueueFull string
+
+	// Motion summed over the last IntentWindow events must reach
+	// IntentThreshold before a gesture scrolls; 0 disables the gate
+	IntentThreshold int32
+	IntentWindow    int
+
+	PalmCheck time.Duration // suppress scroll for this long after a keystroke
+
+	// Filter is a shell command every input event is passed through before
+	// anything else, as JSON lines, so behaviour can be customised in any
+	// language. FilterTimeout is how long it has to answer each batch
+	Filter        string
+	FilterTimeout time.Duration
+
+	// Script is a Starlark file whose event function every input event is
+	// passed through after Filter, without starting another program
+	Script string
+
+	// Rotation turns ball motion clockwise by this many degrees before it is
+	// split into axes, for a trackball mounted at an angle
+	Rotation float64
+
+	AxisXCode uint16 // relative code treated as horizontal motion, normally REL_X
+	AxisYCode uint16 // relative code treated as vertical motion, normally REL_Y
+
+	Watchdog time.Duration // silence after which the device is probed; 0 disables
+
+	// IdleUngrab is the silence after which the grab is released until the
+	// ball is used again, so other programs can have the device; 0 disables
+	IdleUngrab time.Duration
+
+	// While ScrollButton is held the ball scrolls; otherwise its motion is
+	// passed through as pointer motion. 0 scrolls all the time
+	ScrollButton uint16
+
+	// Double-tapping ToggleButton within DoubleTap switches between pointer
+	// motion and scrolling until it is double-tapped again. It can be the
+	// same as ScrollButton. 0 disables the toggle
+	ToggleButton uint16
+	DoubleTap    time.Duration
+
+	// With ScrollAfterIdle the ball moves the pointer, but motion that starts
+	// after it has been still for this long scrolls instead, until the next
+	// button click. 0 disables it
+	ScrollAfterIdle time.Duration
+
+	// Keys on the keyboard given with WithModifierKeyboard: while
+	// ScrollModifier is held the ball scrolls instead of moving the pointer,
+	// and while HorizontalModifier is held vertical motion scrolls
+	// sideways. 0 disables either
+	ScrollModifier     uint16
+	HorizontalModifier uint16
+
+	// NotchCounts, if set, replaces sensitivity with one scroll click per
+	// this many counts of ball travel, like a ratcheted wheel. It turns off
+	// everything that would scale the travel: acceleration, smoothing,
+	// ballistics, the dead zone, soft-start, anti-overshoot, MaxScrollStep
+	// and hi-res output. What decides whether motion scrolls at all still
+	// applies: click cooldown, palm check, intent threshold, axis lock and
+	// snapping, and MaxScrollRate
+	NotchCounts int
+
+	// Ball motion passed through as pointer motion is shaped by the
+	// PointerAccel profile, using AccelExponent, then scaled by
+	// PointerSensitivity
+	PointerSensitivity float64
+	PointerAccel       string
+
+	// The source device's own wheels, like the SlimBlade's twist, are
+	// passed through scaled by WheelSensitivity
+	WheelSensitivity float64
+	InvertWheel      bool
+
+	// WheelOutput is a WHEEL_OUTPUT_* saying what the vertical wheel sends,
+	// "" for WHEEL_OUTPUT_VERTICAL. WheelKeys are the keys sent per click up
+	// and down for WHEEL_OUTPUT_KEYS
+	WheelOutput string
+	WheelKeys   [2]uint16
+
+	// ScrollOutput is a SCROLL_OUTPUT_* saying what ball scrolling sends, ""
+	// for SCROLL_OUTPUT_WHEEL. With key output, one key is pressed per
+	// KeyThreshold scroll clicks of travel, 0 for the output's default
+	ScrollOutput string
+	KeyThreshold float64
+
+	// Tapping MediaButton switches media mode, in which the ball sends
+	// SCROLL_OUTPUT_MEDIA keys, on and off. MediaKeys advertises the media
+	// keys without a button, so Scroller.SetMedia can switch it instead
+	MediaButton uint16
+	MediaKeys   bool
+
+	// Modes are the MODE_* the ball can be switched between, the first being
+	// the one it starts in, and tapping ModeButton cycles through them
+	// (DEFAULT_MODES if empty). CustomKeys are the keys custom mode sends for
+	// up and down, then right and left, once per scroll click of travel
+	Modes      []string
+	ModeButton uint16
+	CustomKeys [2][2]uint16
+
+	// Circular scrolls by moving the ball in circles, one click per
+	// CircularDegrees of rotation: clockwise scrolls down
+	Circular        bool
+	CircularDegrees float64
+
+	// Tapping DragLockButton holds BTN_LEFT down until it is tapped again.
+	// 0 disables drag lock
+	DragLockButton uint16
+
+	// While ZoomButton is held vertical motion zooms, sending the wheel with
+	// Ctrl held down. 0 disables zooming
+	ZoomButton uint16
+
+	// ButtonMap replaces a physical button with the keys or buttons it maps
+	// to, pressed together. An empty list swallows the button
+	ButtonMap map[uint16][]uint16
+
+	// Chords send other keys when both their buttons are pressed within
+	// ChordWindow of each other
+	Chords      []Chord
+	ChordWindow time.Duration
+
+	HiRes bool // emit REL_WHEEL_HI_RES with discrete clicks derived from it
+
+	Accel         string  // ACCEL_* profile applied to each delta before sensitivity
+	AccelExponent float64 // exponent for ACCEL_EXPONENT
+	Curve         *Curve  // replaces Accel with a custom response curve if set
+
+	Smoothing float64 // weight of past motion in the smoothing filter; 0 disables
+
+	// Ballistics multiplies scroll by a gain that follows ball speed, in
+	// counts per second: slow motion stays precise and flicks go far
+	Ballistics          bool
+	BallisticsSlowSpeed float64
+	BallisticsFastSpeed float64
+	BallisticsSlowGain  float64
+	BallisticsFastGain  float64
+
+	MaxScrollRate int     // scroll events per second; 0 is unlimited
+	MaxScrollStep float64 // clicks per event; 0 is unlimited
+
+	Kinetic         bool    // keep scrolling after a flick until touched again
+	KineticFriction float64 // fraction of coasting velocity lost per tick
+
+	AxisLock        bool          // scroll only the dominant axis of each gesture
+	AxisLockTimeout time.Duration // pause that ends a gesture for AxisLock
+
+	// AxisSnapRatio suppresses the minor axis of a gesture while the major
+	// axis has travelled more than this many times as far; 0 disables
+	AxisSnapRatio float64
+
+	SoftStart time.Duration // ramp-up of scroll at the start of each gesture; 0 disables
+
+	DryRun bool // print scroll events instead of creating a virtual device
+
+	// Overlay leaves the device ungrabbed, so its pointer motion, buttons
+	// and wheel reach the system as usual, and only adds the scrolling on top
+	Overlay bool
+
+	Identity DeviceIdentity // name and IDs of the virtual device
+
+	// CloneIdentity gives the virtual device the source device's name, IDs
+	// and properties, so desktop settings for the trackball apply to it.
+	// Non-zero fields of Identity still take precedence
+	CloneIdentity bool
+
+	// SplitDevices creates two virtual devices instead of one: a pointer
+	// device with REL_X, REL_Y and the mouse buttons, and a scroll device
+	// with the wheels and any keys, so libinput tags each for what it is
+	SplitDevices bool
+
+	// Where Run looks for a replacement when the device is unplugged, if
+	// Reconnect is set: a device path, vendor:product ID or "auto", and how
+	// "auto" detects trackballs
+	DevicePath string
+	Detect     Detection
+	Reconnect  bool
+}
+
+// sendsCtrl reports whether zooming needs KEY_LEFTCTRL on the virtual device
+func (cfg *Config) sendsCtrl() bool {
+	return cfg.ZoomButton != 0 || cfg.WheelOutput == WHEEL_OUTPUT_ZOOM || hasMode(cfg.modes(), MODE_ZOOM)
+}
+
+// grabs reports whether the device is grabbed for exclusive use
+func (cfg *Config) grabs() bool {
+	return !cfg.DryRun && !cfg.Overlay
+}
+
+// movesPointer reports whether ball motion can pass through as pointer motion,
+// which the virtual device then has to advertise
+func (cfg *Config) movesPointer() bool {
+	return cfg.ScrollButton != 0 || cfg.ToggleButton != 0 || cfg.ScrollModifier != 0 || cfg.ScrollAfterIdle != 0 ||
+		hasMode(cfg.modes(), MODE_POINTER)
+}
+
+// ParseRelCode accepts a relative axis code by evdev name (REL_RX) or number
+// (3 or 0x03) and rejects anything that isn't a known EV_REL code
+func ParseRelCode(value string) (uint16, error) {
+	for code, name := range evdev.REL {
+		if strings.EqualFold(name, value) {
+			return uint16(code), nil
+		}
+	}
+
+	code, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown relative axis %q", value)
+	}
+	if _, ok := evdev.REL[int(code)]; !ok {
+		return 0, fmt.Errorf("%s is not a relative axis code", value)
+	}
+	return uint16(code), nil
+}
+
+// keyAliases lists key and button names that share a code with another name.
+// evdev's code-to-name maps keep only one of them, chosen at random on start
+var keyAliases = map[string]int{
+	"BTN_0":                 evdev.BTN_0,
+	"BTN_MISC":              evdev.BTN_MISC,
+	"BTN_LEFT":              evdev.BTN_LEFT,
+	"BTN_MOUSE":             evdev.BTN_MOUSE,
+	"BTN_TRIGGER":           evdev.BTN_TRIGGER,
+	"BTN_JOYSTICK":          evdev.BTN_JOYSTICK,
+	"BTN_SOUTH":             evdev.BTN_SOUTH,
+	"BTN_GAMEPAD":           evdev.BTN_GAMEPAD,
+	"BTN_A":                 evdev.BTN_A,
+	"BTN_EAST":              evdev.BTN_EAST,
+	"BTN_B":                 evdev.BTN_B,
+	"BTN_NORTH":             evdev.BTN_NORTH,
+	"BTN_X":                 evdev.BTN_X,
+	"BTN_WEST":              evdev.BTN_WEST,
+	"BTN_Y":                 evdev.BTN_Y,
+	"BTN_TOOL_PEN":          evdev.BTN_TOOL_PEN,
+	"BTN_DIGI":              evdev.BTN_DIGI,
+	"BTN_GEAR_DOWN":         evdev.BTN_GEAR_DOWN,
+	"BTN_WHEEL":             evdev.BTN_WHEEL,
+	"BTN_TRIGGER_HAPPY":     evdev.BTN_TRIGGER_HAPPY,
+	"BTN_TRIGGER_HAPPY1":    evdev.BTN_TRIGGER_HAPPY1,
+	"KEY_HANGEUL":           evdev.KEY_HANGEUL,
+	"KEY_HANGUEL":           evdev.KEY_HANGUEL,
+	"KEY_COFFEE":            evdev.KEY_COFFEE,
+	"KEY_SCREENLOCK":        evdev.KEY_SCREENLOCK,
+	"KEY_ROTATE_DISPLAY":    evdev.KEY_ROTATE_DISPLAY,
+	"KEY_DIRECTION":         evdev.KEY_DIRECTION,
+	"KEY_BRIGHTNESS_AUTO":   evdev.KEY_BRIGHTNESS_AUTO,
+	"KEY_BRIGHTNESS_ZERO":   evdev.KEY_BRIGHTNESS_ZERO,
+	"KEY_WWAN":              evdev.KEY_WWAN,
+	"KEY_WIMAX":             evdev.KEY_WIMAX,
+	"KEY_DISPLAYTOGGLE":     evdev.KEY_DISPLAYTOGGLE,
+	"KEY_BRIGHTNESS_TOGGLE": evdev.KEY_BRIGHTNESS_TOGGLE,
+	"KEY_MUTE":              evdev.KEY_MUTE,
+	"KEY_MIN_INTERESTING":   evdev.KEY_MIN_INTERESTING,
+	"KEY_FASTREVERSE":       evdev.KEY_FASTREVERSE,
+	"KEY_DATA":              evdev.KEY_DATA,
+}
+
+// lookupKeyAlias finds a key or button code by one of its aliased names
+func lookupKeyAlias(name string) (int, bool) {
+	code, ok := keyAliases[strings.ToUpper(name)]
+	return code, ok
+}
+
+// ParseButtonCode accepts a button by evdev name (BTN_SIDE) or number
+func ParseButtonCode(value string) (uint16, error) {
+	if code, ok := lookupKeyAlias(value); ok {
+		if _, isButton := evdev.BTN[code]; isButton {
+			return uint16(code), nil
+		}
+	}
+	for code, name := range evdev.BTN {
+		if strings.EqualFold(name, value) {
+			return uint16(code), nil
+		}
+	}
+
+	code, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown button %q", value)
+	}
+	if _, ok := evdev.BTN[int(code)]; !ok {
+		return 0, fmt.Errorf("%s is not a button code", value)
+	}
+	return uint16(code), nil
+}
+
+// ParseKeyCode accepts a key or button by evdev name (KEY_W, BTN_MIDDLE) or
+// number
+func ParseKeyCode(value string) (uint16, error) {
+	if code, ok := lookupKeyAlias(value); ok {
+		return uint16(code), nil
+	}
+	for _, names := range []map[int]string{evdev.KEY, evdev.BTN} {
+		for code, name := range names {
+			if strings.EqualFold(name, value) {
+				return uint16(code), nil
+			}
+		}
+	}
+
+	code, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown key %q", value)
+	}
+	_, isKey := evdev.KEY[int(code)]
+	_, isButton := evdev.BTN[int(code)]
+	if !isKey && !isButton {
+		return 0, fmt.Errorf("%s is not a key or button code", value)
+	}
+	return uint16(code), nil
+}
+
+// ParseButtonMapping parses a remapping such as BTN_SIDE=BTN_MIDDLE or
+// BTN_EXTRA=KEY_LEFTCTRL+KEY_W. The keys of a combination are pressed in
+// order and released in reverse; "none" swallows the button
+func ParseButtonMapping(value string) (uint16, []uint16, error) {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok {
+		return 0, nil, fmt.Errorf("expected <button>=<keys>, got %q", value)
+	}
+
+	button, err := ParseKeyCode(strings.TrimSpace(from))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	keys, err := parseKeys(to)
+	if err != nil {
+		return 0, nil, err
+	}
+	return button, keys, nil
+}
+
+// parseKeys parses a key combination such as KEY_LEFTCTRL+KEY_W, or "none"
+func parseKeys(value string) ([]uint16, error) {
+	keys := []uint16{}
+	if strings.TrimSpace(value) == "none" {
+		return keys, nil
+	}
+	for _, name := range strings.Split(value, "+") {
+		key, err := ParseKeyCode(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// extraKeys returns the key codes ButtonMap, Chords, WheelKeys, ScrollOutput,
+// media mode and custom mode send beyond the mouse buttons, which the virtual device has to
+// advertise
+func (cfg *Config) extraKeys() []uint16 {
+	outputs := make([][]uint16, 0, len(cfg.ButtonMap)+len(cfg.Chords))
+	for _, mapped := range cfg.ButtonMap {
+		outputs = append(outputs, mapped)
+	}
+	for _, chord := range cfg.Chords {
+		outputs = append(outputs, chord.Keys)
+	}
+	if cfg.WheelOutput == WHEEL_OUTPUT_KEYS {
+		outputs = append(outputs, cfg.WheelKeys[:])
+	}
+	for _, isHorizontal := range []bool{false, true} {
+		if keys, ok := outputKeys(cfg.ScrollOutput, isHorizontal); ok {
+			outputs = append(outputs, keys[:])
+		}
+		if keys, _ := outputKeys(SCROLL_OUTPUT_MEDIA, isHorizontal); cfg.switchesMedia() {
+			outputs = append(outputs, keys[:])
+		}
+	}
+	if hasMode(cfg.modes(), MODE_CUSTOM) {
+		outputs = append(outputs, cfg.CustomKeys[0][:], cfg.CustomKeys[1][:])
+	}
+
+	var keys []uint16
+	for _, output := range outputs {
+		for _, key := range output {
+			if key != 0 && (key < BTN_LEFT || key > BTN_TASK) && !hasKey(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func hasKey(keys []uint16, key uint16) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
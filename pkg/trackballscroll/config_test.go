@@ -0,0 +1,57 @@
+package trackballscroll
+
+import (
+	"testing"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+func TestParseAliasedCodes(t *testing.T) {
+	for _, name := range []string{"BTN_LEFT", "BTN_MOUSE", "btn_left"} {
+		if code, err := ParseButtonCode(name); err != nil || code != evdev.BTN_LEFT {
+			t.Errorf("ParseButtonCode(%q) = %#x, %v", name, code, err)
+		}
+	}
+	for _, name := range []string{"KEY_SCREENLOCK", "KEY_COFFEE", "BTN_MOUSE"} {
+		code, err := ParseKeyCode(name)
+		if want, _ := lookupKeyAlias(name); err != nil || int(code) != want {
+			t.Errorf("ParseKeyCode(%q) = %#x, %v", name, code, err)
+		}
+	}
+
+	if _, err := ParseButtonCode("KEY_SCREENLOCK"); err == nil {
+		t.Error("ParseButtonCode accepted a key")
+	}
+}
+
+func TestParseRelCode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint16
+		wantErr bool
+	}{
+		{value: "REL_RX", want: evdev.REL_RX},
+		{value: "rel_ry", want: evdev.REL_RY},
+		{value: "REL_DIAL", want: evdev.REL_DIAL},
+		{value: "3", want: evdev.REL_RX},
+		{value: "0x04", want: evdev.REL_RY},
+		{value: "REL_BOGUS", wantErr: true},
+		{value: "ABS_X", wantErr: true},
+		{value: "0x7f", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseRelCode(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseRelCode(%q) = %#x, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseRelCode(%q) = %#x, %v, want %#x", test.value, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const CURVE_TABLE_PREFIX = "table:" // a Curve given as a lookup table rather than an expression
+
+// Curve maps the size of a motion delta to a scroll amount, replacing the
+// Config.Accel profile for users who want to shape the response exactly. It
+// is either a lookup table, linearly interpolated, or an expression in x
+type Curve struct {
+	source string
+	eval   func(x float64) float64
+}
+
+// curvePoint is one row of a lookup table
+type curvePoint struct {
+	in, out float64
+}
+
+// ParseCurve parses a response curve: "table:" followed by comma-separated
+// delta:scroll pairs, e.g. table:1:1,4:6,10:30, or an expression in x using
+// numbers, + - * / ^, parentheses and the functions sqrt, log, exp and abs,
+// e.g. 0.2*x + 0.05*x^2
+func ParseCurve(value string) (*Curve, error) {
+	var eval func(float64) float64
+	if table, ok := strings.CutPrefix(value, CURVE_TABLE_PREFIX); ok {
+		points, err := parseCurveTable(table)
+		if err != nil {
+			return nil, err
+		}
+		eval = func(x float64) float64 { return interpolate(points, x) }
+	} else {
+		p := &exprParser{input: value}
+		expr, err := p.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid curve expression %q: %w", value, err)
+		}
+		eval = expr
+	}
+
+	// Deltas are small whole numbers, so checking a range of them catches
+	// division by zero, logs of zero and the like up front
+	for x := 1; x <= 100; x++ {
+		if y := eval(float64(x)); math.IsNaN(y) || math.IsInf(y, 0) {
+			return nil, fmt.Errorf("curve %q is undefined for a delta of %d", value, x)
+		}
+	}
+	return &Curve{source: value, eval: eval}, nil
+}
+
+func (c *Curve) String() string {
+	return c.source
+}
+
+// apply maps a raw motion delta through the curve, keeping its sign. ParseCurve
+// only checks deltas up to 100, so a result that is undefined for a larger one,
+// as with log(150-x), scrolls nothing rather than poisoning the remainder
+func (c *Curve) apply(value int32) float64 {
+	magnitude := c.eval(float64(abs(value)))
+	if math.IsNaN(magnitude) || math.IsInf(magnitude, 0) {
+		return 0
+	}
+	if value < 0 {
+		return -magnitude
+	}
+	return magnitude
+}
+
+// parseCurveTable parses comma-separated in:out pairs, which must have
+// increasing inputs
+func parseCurveTable(table string) ([]curvePoint, error) {
+	var points []curvePoint
+	for _, pair := range strings.Split(table, ",") {
+		in, out, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid curve table entry %q: expected <delta>:<scroll>", pair)
+		}
+		x, err := strconv.ParseFloat(in, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid curve table delta %q: %w", in, err)
+		}
+		y, err := strconv.ParseFloat(out, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid curve table scroll %q: %w", out, err)
+		}
+		if len(points) > 0 && x <= points[len(points)-1].in {
+			return nil, fmt.Errorf("curve table deltas must increase, got %g after %g", x, points[len(points)-1].in)
+		}
+		points = append(points, curvePoint{in: x, out: y})
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("curve table needs at least two entries")
+	}
+	return points, nil
+}
+
+// interpolate looks x up in a table, joining the points with straight lines
+// and extending the first and last segments beyond the ends
+func interpolate(points []curvePoint, x float64) float64 {
+	i := sort.Search(len(points), func(i int) bool { return points[i].in >= x })
+	i = min(max(i, 1), len(points)-1)
+
+	a, b := points[i-1], points[i]
+	return a.out + (x-a.in)*(b.out-a.out)/(b.in-a.in)
+}
+
+// exprParser is a recursive descent parser for curve expressions:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | "x" | name "(" expr ")" | "(" expr ")"
+type exprParser struct {
+	input string
+	pos   int
+}
+
+// curveFunctions are the functions a curve expression can call
+var curveFunctions = map[string]func(float64) float64{
+	"sqrt": math.Sqrt,
+	"log":  math.Log,
+	"exp":  math.Exp,
+	"abs":  math.Abs,
+}
+
+func (p *exprParser) parse() (func(float64) float64, error) {
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.input[p.pos:], p.pos)
+	}
+	return expr, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept consumes op if it comes next
+func (p *exprParser) accept(op byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expr() (func(float64) float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			right, err := p.term()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(x float64) float64 { return l(x) + right(x) }
+		case p.accept('-'):
+			right, err := p.term()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(x float64) float64 { return l(x) - right(x) }
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *exprParser) term() (func(float64) float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept('*'):
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(x float64) float64 { return l(x) * right(x) }
+		case p.accept('/'):
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(x float64) float64 { return l(x) / right(x) }
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *exprParser) unary() (func(float64) float64, error) {
+	if p.accept('-') {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(x float64) float64 { return -operand(x) }, nil
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (func(float64) float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept('^') {
+		return base, nil
+	}
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(x float64) float64 { return math.Pow(base(x), exponent(x)) }, nil
+}
+
+func (p *exprParser) primary() (func(float64) float64, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+
+	if p.accept('(') {
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		return inner, nil
+	}
+
+	start := p.pos
+	c := rune(p.input[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.input) && (unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return func(float64) float64 { return n }, nil
+	case unicode.IsLetter(c):
+		for p.pos < len(p.input) && unicode.IsLetter(rune(p.input[p.pos])) {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if name == "x" {
+			return func(x float64) float64 { return x }, nil
+		}
+		fn, ok := curveFunctions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown name %q", name)
+		}
+		if !p.accept('(') {
+			return nil, fmt.Errorf("expected ( after %s", name)
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		return func(x float64) float64 { return fn(arg(x)) }, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+	}
+}
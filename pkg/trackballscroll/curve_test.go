@@ -0,0 +1,109 @@
+package trackballscroll
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCurveExpression(t *testing.T) {
+	tests := []struct {
+		expr string
+		x    float64
+		want float64
+	}{
+		{"1 + 2*x", 3, 7},
+		{"(1 + 2)*x", 3, 9},
+		{"10/2/5", 1, 1},
+		{"x - 1 - 1", 3, 1},
+		{"2^3^2", 1, 512},
+		{"-x^2", 3, -9},
+		{"2^-1", 1, 0.5},
+		{"x - -x", 3, 6},
+		{"--x", 3, 3},
+		{"0.2*x + 0.05*x^2", 10, 7},
+		{"sqrt(x)", 16, 4},
+		{"log(exp(x))", 5, 5},
+		{"abs(1 - x)", 5, 4},
+		{"sqrt(x*x + 9)", 4, 5},
+	}
+
+	for _, test := range tests {
+		curve, err := ParseCurve(test.expr)
+		if err != nil {
+			t.Errorf("ParseCurve(%q): %v", test.expr, err)
+			continue
+		}
+		if got := curve.eval(test.x); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s at x=%g = %g, want %g", test.expr, test.x, got, test.want)
+		}
+	}
+}
+
+func TestParseCurveErrors(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"x +",
+		"(x",
+		"sqrt(x",
+		"sqrt x",
+		"foo(x)",
+		"y",
+		"x x",
+		"1.2.3",
+		"x $ 2",
+		"1/(x - 1)",
+		"log(x - 200)",
+		"table:",
+		"table:1:1",
+		"table:2:1,1:2",
+		"table:1-1,2:2",
+		"table:a:1,2:2",
+		"table:1:b,2:2",
+	} {
+		if _, err := ParseCurve(value); err == nil {
+			t.Errorf("ParseCurve(%q) succeeded", value)
+		}
+	}
+}
+
+func TestCurveTable(t *testing.T) {
+	curve, err := ParseCurve("table:1:1, 4:7, 10:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		x, want float64
+	}{
+		{1, 1},
+		{2.5, 4},
+		{4, 7},
+		{7, 18.5},
+		{10, 30},
+		// The end segments carry on beyond the table
+		{0, -1},
+		{13, 41.5},
+	}
+	for _, test := range tests {
+		if got := curve.eval(test.x); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("at %g = %g, want %g", test.x, got, test.want)
+		}
+	}
+}
+
+func TestCurveApply(t *testing.T) {
+	curve, err := ParseCurve("log(150 - x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := curve.apply(-10), -math.Log(140); got != want {
+		t.Errorf("apply(-10) = %g, want %g", got, want)
+	}
+	// Undefined beyond the deltas ParseCurve checks
+	for _, value := range []int32{150, 200, -200} {
+		if got := curve.apply(value); got != 0 {
+			t.Errorf("apply(%d) = %g, want 0", value, got)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// Device name substrings that identify a trackball unless other keywords are
+// configured
+var trackballKeywords = []string{
+	"trackball",
+	"expert mouse",
+	"orbit",
+	"slimblade",
+}
+
+const KENSINGTON_VENDOR_ID = 0x047d
+
+// Where udev keeps the properties of each device, as c<major>:<minor> files
+// with one E:KEY=value line per property
+const UDEV_DATA_DIR = "/run/udev/data"
+
+// Seat of devices udev assigns to none, as logind sees it
+const DEFAULT_SEAT = "seat0"
+
+// Directories of stable symlinks to event devices, maintained by udev
+const (
+	INPUT_BY_ID_DIR   = "/dev/input/by-id"
+	INPUT_BY_PATH_DIR = "/dev/input/by-path"
+)
+
+// ProductID is a USB vendor:product ID pair
+type ProductID struct {
+	Vendor  uint16
+	Product uint16
+}
+
+// USB IDs of trackballs, for firmware whose device name has none of the
+// keywords. Kensington also sells ordinary mice, so its vendor ID alone isn't
+// enough
+var trackballProducts = []ProductID{
+	{KENSINGTON_VENDOR_ID, 0x1020}, // Expert Mouse Trackball
+	{KENSINGTON_VENDOR_ID, 0x2041}, // SlimBlade Trackball
+	{KENSINGTON_VENDOR_ID, 0x2048}, // Orbit Trackball with Scroll Ring
+	{KENSINGTON_VENDOR_ID, 0x8018}, // Expert Wireless TB Mouse
+}
+
+// Detection modes for device discovery
+const (
+	DETECT_MODE_NAME  = "name"
+	DETECT_MODE_PROPS = "props"
+	DETECT_MODE_BOTH  = "both"
+)
+
+// Linux evdev property constants used for structural detection
+const (
+	INPUT_PROP_POINTER = 0x00
+	INPUT_PROP_DIRECT  = 0x01
+)
+
+// EVIOCGPROP reads the property bits, 4 bytes being enough for INPUT_PROP_CNT
+var EVIOCGPROP = ioRead('E', 0x09, SIZEOF_INT)
+
+// Detection describes which input devices count as trackballs
+type Detection struct {
+	Mode     string      // DETECT_MODE_*
+	Keywords []string    // case-insensitive name substrings, DefaultKeywords() if nil
+	Products []ProductID // USB IDs of trackballs, DefaultProducts() if nil
+
+	// NameRegex, if set, must match the device name, replacing
+	// Keywords and Products
+	NameRegex *regexp.Regexp
+
+	// Exclude keeps devices out of detection even when they match
+	Exclude []Exclusion
+
+	// Seat, if set, limits detection to devices udev assigns to that seat
+	Seat string
+}
+
+// Exclusion rules out a device by path, name or capability. Create one with
+// ParseExclusion
+type Exclusion struct {
+	spec    string
+	path    string
+	name    *regexp.Regexp
+	capType int
+	capCode int // -1 for any code of capType
+}
+
+// ParseExclusion parses an exclusion: a device path starting with "/",
+// "has:<capability>" naming an event type or code such as EV_ABS or KEY_A, or
+// otherwise a case-insensitive regular expression for the device name
+func ParseExclusion(spec string) (Exclusion, error) {
+	exclusion := Exclusion{spec: spec, capCode: -1}
+
+	switch {
+	case strings.HasPrefix(spec, "/"):
+		exclusion.path = spec
+	case strings.HasPrefix(spec, "has:"):
+		capType, capCode, ok := lookupCapability(strings.TrimPrefix(spec, "has:"))
+		if !ok {
+			return Exclusion{}, fmt.Errorf("unknown capability in %q", spec)
+		}
+		exclusion.capType, exclusion.capCode = capType, capCode
+	default:
+		re, err := regexp.Compile("(?i)" + spec)
+		if err != nil {
+			return Exclusion{}, fmt.Errorf("invalid name pattern %q: %w", spec, err)
+		}
+		exclusion.name = re
+	}
+
+	return exclusion, nil
+}
+
+func (e Exclusion) String() string {
+	return e.spec
+}
+
+// excludes reports whether the exclusion applies to a device
+func (e Exclusion) excludes(device *evdev.InputDevice) bool {
+	switch {
+	case e.spec == "":
+		return false
+	case e.path != "":
+		return resolveDevicePath(device.Fn) == resolveDevicePath(e.path)
+	case e.name != nil:
+		return e.name.MatchString(device.Name)
+	default:
+		codes, ok := device.CapabilitiesFlat[e.capType]
+		return ok && (e.capCode < 0 || hasCode(codes, e.capCode))
+	}
+}
+
+// lookupCapability finds an event type (EV_ABS) or code (KEY_A, BTN_LEFT) by
+// name, returning a code of -1 for an event type
+func lookupCapability(name string) (capType int, capCode int, ok bool) {
+	if code, ok := lookupKeyAlias(name); ok {
+		return evdev.EV_KEY, code, true
+	}
+	for evType, evName := range evdev.EV {
+		if strings.EqualFold(evName, name) {
+			return evType, -1, true
+		}
+	}
+	for code, codeName := range evdev.BTN {
+		if strings.EqualFold(codeName, name) {
+			return evdev.EV_KEY, code, true
+		}
+	}
+	for evType, codes := range evdev.ByEventType {
+		for code, codeName := range codes {
+			if strings.EqualFold(codeName, name) {
+				return evType, code, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// DefaultKeywords returns the built-in trackball name keywords
+func DefaultKeywords() []string {
+	return append([]string(nil), trackballKeywords...)
+}
+
+// DefaultProducts returns the built-in trackball USB IDs
+func DefaultProducts() []ProductID {
+	return append([]ProductID(nil), trackballProducts...)
+}
+
+// Find searches for connected trackball devices
+func (d Detection) Find() ([]string, error) {
+	return findDevices(d.matches), nil
+}
+
+// FindByID searches for relative pointers with a USB vendor and product ID
+func FindByID(vendor, product uint16) []string {
+	return findDevices(func(device *evdev.InputDevice) bool {
+		return device.Vendor == vendor && device.Product == product && hasRelXY(device)
+	})
+}
+
+// findDevices returns the input devices accepted by match
+func findDevices(match func(device *evdev.InputDevice) bool) []string {
+	var paths []string
+
+	for _, devicePath := range eventDevices() {
+		device, err := evdev.Open(devicePath)
+		if err != nil {
+			continue
+		}
+
+		// Never pick up our own virtual device, whose name says "trackball"
+		if !isOwnDevice(device) && match(device) {
+			paths = append(paths, devicePath)
+			slog.Info("Found trackball", "name", device.Name, "path", devicePath)
+		}
+
+		device.File.Close()
+	}
+
+	return paths
+}
+
+// eventDevices lists the event device nodes in INPUT_DIR in numeric order
+func eventDevices() []string {
+	paths, _ := filepath.Glob(filepath.Join(INPUT_DIR, "event*"))
+	sort.Slice(paths, func(i, j int) bool {
+		return eventNumber(paths[i]) < eventNumber(paths[j])
+	})
+	return paths
+}
+
+// eventNumber returns N for /dev/input/eventN
+func eventNumber(path string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "event"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// resolveDevicePath follows symlinks such as those in /dev/input/by-id to the
+// event node they currently point at, or returns path unchanged if it can't
+func resolveDevicePath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
+
+// deviceLinks lists the by-id and by-path symlinks that point at devicePath
+func deviceLinks(devicePath string) []string {
+	var links []string
+	for _, dir := range []string{INPUT_BY_ID_DIR, INPUT_BY_PATH_DIR} {
+		entries, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, link := range entries {
+			if resolveDevicePath(link) == devicePath {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// ParseDeviceID parses a USB vendor:product ID in hex, e.g. 047d:2041
+func ParseDeviceID(value string) (vendor, product uint16, ok bool) {
+	vendorHex, productHex, found := strings.Cut(value, ":")
+	if !found {
+		return 0, 0, false
+	}
+
+	v, err := strconv.ParseUint(vendorHex, 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	p, err := strconv.ParseUint(productHex, 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint16(v), uint16(p), true
+}
+
+// DeviceInfo describes an input device and whether it looks like a trackball
+type DeviceInfo struct {
+	Path       string
+	Name       string
+	Phys       string
+	Vendor     uint16
+	Product    uint16
+	EventTypes []string
+	MatchName  bool
+	MatchProps bool
+	MatchUdev  bool // tagged ID_INPUT_TRACKBALL by udev
+	Excluded   bool
+	Seat       string
+	OtherSeat  bool     // not on the seat detection is limited to
+	Links      []string // by-id and by-path symlinks to Path
+}
+
+// ListDevices describes every input event device that can be opened, matching
+// names against the keywords of detect
+func ListDevices(detect Detection) []DeviceInfo {
+	var infos []DeviceInfo
+
+	for _, devicePath := range eventDevices() {
+		device, err := evdev.Open(devicePath)
+		if err != nil {
+			continue
+		}
+
+		// Our own virtual device would match by name
+		own := isOwnDevice(device)
+
+		var types []int
+		for t := range device.CapabilitiesFlat {
+			types = append(types, t)
+		}
+		sort.Ints(types)
+
+		info := DeviceInfo{
+			Path:       devicePath,
+			Name:       device.Name,
+			Phys:       device.Phys,
+			Vendor:     device.Vendor,
+			Product:    device.Product,
+			MatchName:  !own && detect.matchesName(device),
+			MatchProps: !own && detect.matchesProps(device, deviceProperties(device)),
+			MatchUdev:  !own && isTrackballByUdev(device),
+			Excluded:   detect.excluded(device),
+			Seat:       DeviceSeat(devicePath),
+			OtherSeat:  !detect.onSeat(devicePath),
+			Links:      deviceLinks(devicePath),
+		}
+		for _, t := range types {
+			info.EventTypes = append(info.EventTypes, evdev.EV[t])
+		}
+		infos = append(infos, info)
+
+		device.File.Close()
+	}
+
+	return infos
+}
+
+// matchesName checks if a pointer's name contains one of the trackball
+// keywords, or its USB ID is a known trackball's. Devices without pointer
+// capabilities never match, so the keyboard half of a combo receiver sharing
+// the trackball's name isn't picked up
+func (d Detection) matchesName(device *evdev.InputDevice) bool {
+	if !isPointer(device) {
+		return false
+	}
+	if d.NameRegex != nil {
+		return d.NameRegex.MatchString(device.Name)
+	}
+
+	keywords := d.Keywords
+	if keywords == nil {
+		keywords = trackballKeywords
+	}
+
+	name := strings.ToLower(device.Name)
+	for _, keyword := range keywords {
+		if strings.Contains(name, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+
+	products := d.Products
+	if products == nil {
+		products = trackballProducts
+	}
+	for _, product := range products {
+		if device.Vendor == product.Vendor && device.Product == product.Product {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether any exclusion applies to a device
+func (d Detection) excluded(device *evdev.InputDevice) bool {
+	for _, exclusion := range d.Exclude {
+		if exclusion.excludes(device) {
+			slog.Debug("Excluded device", "name", device.Name, "path", device.Fn, "exclude", exclusion.spec)
+			return true
+		}
+	}
+	return false
+}
+
+// matches classifies a device by name, by capabilities, or by either, unless
+// it is excluded. Whatever the mode, udev's own trackball tag is trusted
+func (d Detection) matches(device *evdev.InputDevice) bool {
+	if d.excluded(device) || !d.onSeat(device.Fn) {
+		return false
+	}
+	if isTrackballByUdev(device) {
+		return true
+	}
+
+	var props uint32
+	if d.Mode == DETECT_MODE_PROPS || d.Mode == DETECT_MODE_BOTH {
+		props = deviceProperties(device)
+	}
+	return d.classify(device, props)
+}
+
+// classify applies the detection mode to a device with the INPUT_PROP_*
+// bitmask props
+func (d Detection) classify(device *evdev.InputDevice, props uint32) bool {
+	switch d.Mode {
+	case DETECT_MODE_PROPS:
+		return d.matchesProps(device, props)
+	case DETECT_MODE_BOTH:
+		return d.matchesName(device) || d.matchesProps(device, props)
+	default:
+		return d.matchesName(device)
+	}
+}
+
+// onSeat reports whether a device is on the seat detection is limited to
+func (d Detection) onSeat(devicePath string) bool {
+	if d.Seat == "" {
+		return true
+	}
+	if seat := DeviceSeat(devicePath); seat != d.Seat {
+		slog.Debug("Device on another seat", "path", devicePath, "seat", seat)
+		return false
+	}
+	return true
+}
+
+// DeviceSeat returns the logind seat udev assigns a device node to
+func DeviceSeat(devicePath string) string {
+	if seat := udevProperty(devicePath, "ID_SEAT"); seat != "" {
+		return seat
+	}
+	return DEFAULT_SEAT
+}
+
+// matchesProps checks if a device is an indirect relative pointer, regardless
+// of its name, from the INPUT_PROP_* bitmask props and its capabilities. Few
+// trackballs set INPUT_PROP_POINTER, so without it the capabilities alone
+// decide; only INPUT_PROP_DIRECT, a pointer on a screen, rules a device out
+func (d Detection) matchesProps(device *evdev.InputDevice, props uint32) bool {
+	if props&(1<<INPUT_PROP_DIRECT) != 0 {
+		return false
+	}
+	return isPointer(device)
+}
+
+// isPointer reports whether a device has the capabilities of a relative
+// pointer: REL_X, REL_Y and BTN_LEFT, with no absolute axes and no touch
+func isPointer(device *evdev.InputDevice) bool {
+	if _, hasAbs := device.CapabilitiesFlat[evdev.EV_ABS]; hasAbs {
+		return false
+	}
+	keys := device.CapabilitiesFlat[evdev.EV_KEY]
+	if hasCode(keys, evdev.BTN_TOUCH) || hasCode(keys, evdev.BTN_TOOL_FINGER) {
+		return false
+	}
+	return hasRelXY(device) && hasCode(keys, evdev.BTN_LEFT)
+}
+
+// isTrackballByUdev reports whether udev tagged a device ID_INPUT_TRACKBALL,
+// from its hwdb or the device's own report descriptor
+func isTrackballByUdev(device *evdev.InputDevice) bool {
+	return udevProperty(device.Fn, "ID_INPUT_TRACKBALL") == "1"
+}
+
+// udevProperty reads a property udev recorded for a device node, or "" if
+// there is none or udev isn't running
+func udevProperty(devicePath string, key string) string {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(devicePath, &stat); err != nil {
+		return ""
+	}
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+
+	data, err := os.ReadFile(filepath.Join(UDEV_DATA_DIR, fmt.Sprintf("c%d:%d", major, minor)))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "E:"+key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// readDeviceProperties returns the INPUT_PROP_* bitmask of a device
+func readDeviceProperties(device *evdev.InputDevice) (uint32, error) {
+	var props uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.File.Fd(), EVIOCGPROP, uintptr(unsafe.Pointer(&props))); errno != 0 {
+		return 0, fmt.Errorf("failed to read properties of %s: %v", device.Fn, errno)
+	}
+	return props, nil
+}
+
+// deviceProperties returns the INPUT_PROP_* bitmask of a device, or none if
+// it can't be read
+func deviceProperties(device *evdev.InputDevice) uint32 {
+	props, err := readDeviceProperties(device)
+	if err != nil {
+		slog.Debug("Failed to read device properties", "path", device.Fn, "error", err)
+		return 0
+	}
+	return props
+}
+
+// hasRelXY reports whether a device has both relative pointer axes
+func hasRelXY(device *evdev.InputDevice) bool {
+	rel := device.CapabilitiesFlat[evdev.EV_REL]
+	return hasCode(rel, evdev.REL_X) && hasCode(rel, evdev.REL_Y)
+}
+
+func hasCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenDevice opens the specified input device, grabbing it unless
+// grab is false
+func OpenDevice(devicePath string, grab bool) (*evdev.InputDevice, error) {
+	device, err := evdev.Open(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	if !grab {
+		return device, nil
+	}
+
+	if err := device.Grab(); err != nil {
+		device.File.Close()
+		return nil, fmt.Errorf("failed to grab device %s: %w", devicePath, err)
+	}
+
+	return device, nil
+}
+
+// SelectDevices resolves a device setting to the candidate trackballs: the
+// given path, the devices with a vendor:product ID, or with "auto" every
+// detected trackball
+func SelectDevices(devicePath string, detect Detection) ([]string, error) {
+	trackballs, err := devicePaths(devicePath, detect)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trackballs) == 0 {
+		if devicePath != "auto" {
+			return nil, fmt.Errorf("no device with ID %s found", devicePath)
+		}
+		return nil, fmt.Errorf("no trackball devices found. Try to manually add a device with -device")
+	}
+
+	return trackballs, nil
+}
+
+// devicePaths lists the devices a device setting currently refers to
+func devicePaths(devicePath string, detect Detection) ([]string, error) {
+	if devicePath == "auto" {
+		slog.Debug("Detecting trackball devices")
+		trackballs, err := detect.Find()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan for devices: %w", err)
+		}
+		return trackballs, nil
+	}
+
+	if vendor, product, ok := ParseDeviceID(devicePath); ok {
+		slog.Debug("Looking for device by ID", "vendor", vendor, "product", product)
+		var seated []string
+		for _, path := range FindByID(vendor, product) {
+			if detect.onSeat(path) {
+				seated = append(seated, path)
+			}
+		}
+		return seated, nil
+	}
+
+	// A by-id or by-path link is followed each time, so it finds the device
+	// again after it is re-enumerated under another event number
+	resolved := resolveDevicePath(devicePath)
+	if resolved != devicePath {
+		slog.Debug("Resolved device link", "link", devicePath, "path", resolved)
+	}
+	return []string{resolved}, nil
+}
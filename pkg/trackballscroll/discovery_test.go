@@ -0,0 +1,224 @@
+package trackballscroll
+
+import (
+	"regexp"
+	"testing"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const (
+	propPointer = 1 << INPUT_PROP_POINTER
+	propDirect  = 1 << INPUT_PROP_DIRECT
+)
+
+// fakeDevice is a device with the given name, vendor and capabilities, as
+// event type to codes
+func fakeDevice(name string, vendor uint16, caps map[int][]int) *evdev.InputDevice {
+	return &evdev.InputDevice{Fn: "/dev/input/event99", Name: name, Vendor: vendor, CapabilitiesFlat: caps}
+}
+
+// fakeProduct is fakeDevice with a USB product ID as well
+func fakeProduct(name string, vendor, product uint16, caps map[int][]int) *evdev.InputDevice {
+	device := fakeDevice(name, vendor, caps)
+	device.Product = product
+	return device
+}
+
+// pointerCaps are the capabilities of an ordinary mouse or trackball
+func pointerCaps() map[int][]int {
+	return map[int][]int{
+		evdev.EV_SYN: {evdev.SYN_REPORT},
+		evdev.EV_KEY: {evdev.BTN_LEFT, evdev.BTN_RIGHT, evdev.BTN_MIDDLE},
+		evdev.EV_REL: {evdev.REL_X, evdev.REL_Y, evdev.REL_WHEEL},
+	}
+}
+
+func TestDetectionClassify(t *testing.T) {
+	withAbs := pointerCaps()
+	withAbs[evdev.EV_ABS] = []int{evdev.ABS_X, evdev.ABS_Y}
+
+	tests := []struct {
+		name   string
+		device *evdev.InputDevice
+		props  uint32
+		byName bool
+		byProp bool
+	}{
+		{
+			// Props mode goes by capabilities, which a mouse shares
+			name:   "ordinary mouse",
+			device: fakeDevice("Logitech USB Optical Mouse", 0x046d, pointerCaps()),
+			byProp: true,
+		},
+		{
+			name:   "unknown name without property bits",
+			device: fakeDevice("Acme Ball 3000", 0x1234, pointerCaps()),
+			byProp: true,
+		},
+		{
+			name: "touch pointer",
+			device: fakeDevice("Acme Trackball Touch", 0x1234, map[int][]int{
+				evdev.EV_KEY: {evdev.BTN_LEFT, evdev.BTN_TOUCH, evdev.BTN_TOOL_FINGER},
+				evdev.EV_REL: {evdev.REL_X, evdev.REL_Y},
+			}),
+		},
+		{
+			name:   "trackball by name without property bits",
+			device: fakeDevice("Logitech USB Trackball", 0x046d, pointerCaps()),
+			byName: true,
+			byProp: true,
+		},
+		{
+			name:   "Kensington trackball ID without property bits",
+			device: fakeProduct("Kensington USB Device", KENSINGTON_VENDOR_ID, 0x2041, pointerCaps()),
+			byName: true,
+			byProp: true,
+		},
+		{
+			name:   "Kensington mouse",
+			device: fakeProduct("Kensington Pro Fit Mouse", KENSINGTON_VENDOR_ID, 0x4002, pointerCaps()),
+			byProp: true,
+		},
+		{
+			name:   "unknown name with INPUT_PROP_POINTER",
+			device: fakeDevice("Acme Ball 3000", 0x1234, pointerCaps()),
+			props:  propPointer,
+			byProp: true,
+		},
+		{
+			name:   "direct input device",
+			device: fakeDevice("Acme Ball 3000", 0x1234, pointerCaps()),
+			props:  propPointer | propDirect,
+		},
+		{
+			name:   "named trackball that is direct",
+			device: fakeDevice("Trackball Touch", 0x1234, pointerCaps()),
+			props:  propDirect,
+			byName: true,
+		},
+		{
+			name:   "absolute axes",
+			device: fakeDevice("Expert Mouse Tablet", KENSINGTON_VENDOR_ID, withAbs),
+			props:  propPointer,
+		},
+		{
+			name: "keyboard half of a combo receiver",
+			device: fakeDevice("Kensington Expert Mouse Keyboard", KENSINGTON_VENDOR_ID, map[int][]int{
+				evdev.EV_KEY: {evdev.KEY_A, evdev.KEY_B},
+			}),
+			props: propPointer,
+		},
+		{
+			name: "no pointer axes",
+			device: fakeDevice("Orbit Buttons", 0x1234, map[int][]int{
+				evdev.EV_KEY: {evdev.BTN_LEFT},
+				evdev.EV_REL: {evdev.REL_WHEEL},
+			}),
+			props: propPointer,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for mode, want := range map[string]bool{
+				DETECT_MODE_NAME:  test.byName,
+				DETECT_MODE_PROPS: test.byProp,
+				DETECT_MODE_BOTH:  test.byName || test.byProp,
+			} {
+				d := Detection{Mode: mode}
+				if got := d.classify(test.device, test.props); got != want {
+					t.Errorf("-detect-mode %s: got %v, want %v", mode, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectionMatchesName(t *testing.T) {
+	tests := []struct {
+		name   string
+		detect Detection
+		device *evdev.InputDevice
+		want   bool
+	}{
+		{
+			name:   "built-in keyword in any case",
+			device: fakeDevice("ELECOM TrackBall Mouse HUGE", 0x056e, pointerCaps()),
+			want:   true,
+		},
+		{
+			name:   "extra keyword",
+			detect: Detection{Keywords: append(DefaultKeywords(), "mx ergo")},
+			device: fakeDevice("Logitech MX Ergo", 0x046d, pointerCaps()),
+			want:   true,
+		},
+		{
+			name:   "keywords replaced",
+			detect: Detection{Keywords: []string{"huge"}, Products: []ProductID{}},
+			device: fakeProduct("Kensington Orbit", KENSINGTON_VENDOR_ID, 0x2048, pointerCaps()),
+			want:   false,
+		},
+		{
+			name:   "built-in trackball ID",
+			device: fakeProduct("Kensington Wireless Device", KENSINGTON_VENDOR_ID, 0x8018, pointerCaps()),
+			want:   true,
+		},
+		{
+			name:   "other product of a trackball vendor",
+			device: fakeProduct("Kensington Wireless Device", KENSINGTON_VENDOR_ID, 0x4002, pointerCaps()),
+			want:   false,
+		},
+		{
+			name:   "name pattern replaces keywords and product IDs",
+			detect: Detection{NameRegex: regexp.MustCompile(`^Acme`)},
+			device: fakeDevice("Acme Ball", 0x1234, pointerCaps()),
+			want:   true,
+		},
+		{
+			name:   "name pattern that doesn't match",
+			detect: Detection{NameRegex: regexp.MustCompile(`^Acme`)},
+			device: fakeDevice("Kensington Expert Mouse", KENSINGTON_VENDOR_ID, pointerCaps()),
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.detect.matchesName(test.device); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExclusion(t *testing.T) {
+	device := fakeDevice("Kensington Expert Mouse", KENSINGTON_VENDOR_ID, pointerCaps())
+	tests := []struct {
+		spec string
+		want bool
+	}{
+		{"expert", true},
+		{"^orbit", false},
+		{"has:REL_WHEEL", true},
+		{"has:EV_ABS", false},
+		{"has:BTN_RIGHT", true},
+		{"has:BTN_LEFT", true},
+		{"has:BTN_MOUSE", true},
+		{"has:btn_left", true},
+	}
+
+	for _, test := range tests {
+		exclusion, err := ParseExclusion(test.spec)
+		if err != nil {
+			t.Fatalf("ParseExclusion(%q): %v", test.spec, err)
+		}
+		if got := exclusion.excludes(device); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.spec, got, test.want)
+		}
+	}
+
+	if _, err := ParseExclusion("has:NOT_A_CODE"); err == nil {
+		t.Error("unknown capability accepted")
+	}
+}
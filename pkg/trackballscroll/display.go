@@ -0,0 +1,237 @@
+package trackballscroll
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REFERENCE_DPI       = 96.0        // DPI at which display scaling leaves sensitivity unchanged
+	DPI_POLL_INTERVAL   = time.Second // how often the pointer position is checked
+	DISPLAY_CMD_TIMEOUT = 500 * time.Millisecond
+)
+
+// xrandrOutputPattern matches connected outputs in `xrandr --current`, e.g.
+// "HDMI-1 connected primary 1920x1080+0+0 (normal ...) 527mm x 296mm"
+var xrandrOutputPattern = regexp.MustCompile(`^(\S+) connected (?:primary )?(\d+)x(\d+)\+(\d+)\+(\d+).* (\d+)mm x (\d+)mm`)
+
+// Monitor describes the geometry and physical size of one connected output
+type Monitor struct {
+	Name          string
+	X, Y          int
+	Width, Height int
+	WidthMM       int
+}
+
+// DPI returns the horizontal DPI of the monitor, or 0 if its size is unknown
+func (m Monitor) DPI() float64 {
+	if m.WidthMM <= 0 {
+		return 0
+	}
+	return float64(m.Width) / (float64(m.WidthMM) / 25.4)
+}
+
+// contains reports whether the screen coordinate (x, y) is on this monitor
+func (m Monitor) contains(x, y int) bool {
+	return x >= m.X && x < m.X+m.Width && y >= m.Y && y < m.Y+m.Height
+}
+
+// DPIWatcher tracks the DPI of the monitor under the pointer and exposes it
+// as a sensitivity multiplier. It relies on xrandr and xdotool, and on xev to
+// hear about monitor changes, and leaves the multiplier at 1 when no X display
+// is reachable or the session is Wayland, where xdotool can't see the pointer
+type DPIWatcher struct {
+	scale   atomic.Uint64 // math.Float64bits of the current multiplier
+	monitor string
+}
+
+// NewDPIWatcher returns a watcher with a multiplier of 1 until Run updates it
+func NewDPIWatcher() *DPIWatcher {
+	dw := &DPIWatcher{}
+	dw.scale.Store(math.Float64bits(1))
+	return dw
+}
+
+// Scale returns the current sensitivity multiplier
+func (dw *DPIWatcher) Scale() float64 {
+	return math.Float64frombits(dw.scale.Load())
+}
+
+// Run polls the pointer position until ctx is done, reading the monitor
+// layout again whenever RandR reports a change
+func (dw *DPIWatcher) Run(ctx context.Context) {
+	if os.Getenv("WAYLAND_DISPLAY") != "" || os.Getenv("XDG_SESSION_TYPE") == "wayland" {
+		slog.Warn("DPI scaling disabled: it needs an X11 session, not Wayland")
+		return
+	}
+	if os.Getenv("DISPLAY") == "" {
+		slog.Warn("DPI scaling disabled: no X display (DISPLAY is unset)")
+		return
+	}
+
+	changes := watchLayout(ctx)
+	monitors, layoutErr := queryMonitors()
+
+	ticker := time.NewTicker(DPI_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	warned := false
+	for {
+		err := layoutErr
+		if err == nil {
+			err = dw.update(monitors)
+		}
+		if err != nil && !warned {
+			slog.Warn("DPI scaling unavailable, using sensitivity as-is", "error", err)
+			warned = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			monitors, layoutErr = queryMonitors()
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchLayout runs xev on the root window and signals each RandR event, so
+// the layout is only read again when a monitor is plugged in, moved or
+// resized. Without xev the returned channel never fires
+func watchLayout(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	cmd := exec.CommandContext(ctx, "xev", "-root", "-event", "randr")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		slog.Warn("Monitor changes won't be noticed until restart", "error", fmt.Errorf("xev failed: %w", err))
+		return changes
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			// RRScreenChangeNotify and RRNotify start each event
+			if !strings.HasPrefix(scanner.Text(), "RR") {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			slog.Warn("Stopped watching for monitor changes", "error", fmt.Errorf("xev failed: %w", err))
+		}
+	}()
+	return changes
+}
+
+// update refreshes the multiplier from the monitor the pointer is on, or
+// resets it to 1 if the pointer is on none of known size
+func (dw *DPIWatcher) update(monitors []Monitor) error {
+	x, y, err := queryPointer()
+	if err != nil {
+		return err
+	}
+
+	for _, monitor := range monitors {
+		if !monitor.contains(x, y) || monitor.DPI() == 0 {
+			continue
+		}
+
+		if monitor.Name != dw.monitor {
+			dw.monitor = monitor.Name
+			slog.Info("Scaling sensitivity for monitor under pointer", "monitor", monitor.Name,
+				"dpi", math.Round(monitor.DPI()), "scale", monitor.DPI()/REFERENCE_DPI)
+		}
+		dw.scale.Store(math.Float64bits(monitor.DPI() / REFERENCE_DPI))
+		return nil
+	}
+
+	if dw.monitor != "" {
+		dw.monitor = ""
+		slog.Info("Pointer is on no monitor of known size, using sensitivity as-is")
+	}
+	dw.scale.Store(math.Float64bits(1))
+	return nil
+}
+
+// queryMonitors lists connected outputs with their geometry via xrandr. The
+// current configuration is used, as probing the outputs again is slow and can
+// make screens flicker
+func queryMonitors() ([]Monitor, error) {
+	output, err := runDisplayCommand("xrandr", "--current")
+	if err != nil {
+		return nil, err
+	}
+
+	var monitors []Monitor
+	for _, line := range strings.Split(output, "\n") {
+		match := xrandrOutputPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		fields := make([]int, 0, 6)
+		for _, field := range match[2:7] {
+			value, _ := strconv.Atoi(field)
+			fields = append(fields, value)
+		}
+		monitors = append(monitors, Monitor{
+			Name:    match[1],
+			Width:   fields[0],
+			Height:  fields[1],
+			X:       fields[2],
+			Y:       fields[3],
+			WidthMM: fields[4],
+		})
+	}
+
+	return monitors, nil
+}
+
+// queryPointer returns the pointer position in screen coordinates via xdotool
+func queryPointer() (int, int, error) {
+	output, err := runDisplayCommand("xdotool", "getmouselocation", "--shell")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var x, y int
+	for _, line := range strings.Split(output, "\n") {
+		if value, ok := strings.CutPrefix(line, "X="); ok {
+			x, _ = strconv.Atoi(value)
+		}
+		if value, ok := strings.CutPrefix(line, "Y="); ok {
+			y, _ = strconv.Atoi(value)
+		}
+	}
+
+	return x, y, nil
+}
+
+func runDisplayCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DISPLAY_CMD_TIMEOUT)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w", name, err)
+	}
+	return string(output), nil
+}
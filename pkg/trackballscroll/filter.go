@@ -0,0 +1,254 @@
+package trackballscroll
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const (
+	DEFAULT_FILTER_TIMEOUT = 50 * time.Millisecond
+	FILTER_RESTART_DELAY   = time.Second // so a filter that keeps crashing doesn't fork in a loop
+)
+
+// filterEvent is an input event as exchanged with a Config.Filter program,
+// one JSON object per line
+type filterEvent struct {
+	Type  uint16 `json:"type"`
+	Code  uint16 `json:"code"`
+	Value int32  `json:"value"`
+	Time  int64  `json:"time,omitempty"` // microseconds since the epoch
+}
+
+// filterSync is the line that ends each batch sent to a Config.Filter
+// program, which echoes it back once it has answered the events before it
+type filterSync struct {
+	Sync uint64 `json:"sync"`
+}
+
+// filter runs the Config.Filter program and passes each batch of input
+// events through it. The program gets one line of JSON per event and must
+// answer each with one line holding a JSON array of the events to use
+// instead: [] drops the event, [<the same event>] passes it on. Events it
+// returns without a time get the time of the event they answer. Each batch
+// ends with a {"sync":<n>} line the program must echo back, so an answer too
+// many or too few is caught at once rather than shifting every later answer
+// onto the wrong event. While the program is down, events pass through
+// unchanged; it is restarted after FILTER_RESTART_DELAY if it exits, answers
+// nonsense or misses Config.FilterTimeout
+type filter struct {
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stdin    *os.File      // our end of the program's input, for its write deadline
+	replies  chan []byte   // lines the program writes, closed once it exits
+	done     chan struct{} // closed when the program is stopped
+	batch    uint64        // number of the last batch sent
+	failedAt time.Time
+	closed   bool
+	out      []evdev.InputEvent // reused buffer for the filtered batch
+}
+
+// apply returns events as filtered by the program. The result is only valid
+// until the next call
+func (f *filter) apply(cfg *Config, events []evdev.InputEvent) []evdev.InputEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cmd == nil && !f.start(cfg.Filter) {
+		return events
+	}
+	out, err := f.exchange(cfg.filterTimeout(), events)
+	if err != nil {
+		slog.Error("Filter failed, passing events through until it restarts", "filter", cfg.Filter, "error", err)
+		f.stop()
+		f.failedAt = time.Now()
+		return events
+	}
+	return out
+}
+
+// start runs command with the shell, unless it failed too recently
+func (f *filter) start(command string) bool {
+	if f.closed || time.Since(f.failedAt) < FILTER_RESTART_DELAY {
+		return false
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	// Its own process group, so stop gets any children the shell forked, and
+	// killed with us so it can't outlive a crash
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	// A pipe of our own rather than StdinPipe, whose writer can't be given
+	// a deadline
+	input, stdin, err := os.Pipe()
+	if err != nil {
+		slog.Error("Failed to start filter", "filter", command, "error", err)
+		f.failedAt = time.Now()
+		return false
+	}
+	cmd.Stdin = input
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		input.Close()
+		stdin.Close()
+		slog.Error("Failed to start filter", "filter", command, "error", err)
+		f.failedAt = time.Now()
+		return false
+	}
+	// Pdeathsig follows the thread that forks the program, not the process.
+	// Go only ends a thread when a goroutine exits while locked to it, which
+	// nothing here does, so the forking thread lives as long as we do; the
+	// lock keeps the whole of Start on that one thread
+	runtime.LockOSThread()
+	err = cmd.Start()
+	runtime.UnlockOSThread()
+	input.Close()
+	if err != nil {
+		stdin.Close()
+		slog.Error("Failed to start filter", "filter", command, "error", err)
+		f.failedAt = time.Now()
+		return false
+	}
+	slog.Info("Started filter", "filter", command, "pid", cmd.Process.Pid)
+
+	replies := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case replies <- bytes.Clone(scanner.Bytes()):
+			case <-done:
+			}
+		}
+		// Everything is read, so it's now safe to reap the program. Being
+		// killed by stop isn't worth a warning
+		err := cmd.Wait()
+		select {
+		case <-done:
+		default:
+			slog.Warn("Filter exited", "filter", command, "error", err)
+		}
+		close(replies)
+	}()
+
+	f.cmd, f.stdin, f.replies, f.done = cmd, stdin, replies, done
+	return true
+}
+
+// exchange writes events to the program and reads back its answers, all
+// within timeout, so a program that stops reading can't block the write
+func (f *filter) exchange(timeout time.Duration, events []evdev.InputEvent) ([]evdev.InputEvent, error) {
+	var request bytes.Buffer
+	encoder := json.NewEncoder(&request)
+	for _, event := range events {
+		t := eventTime(event)
+		encoder.Encode(filterEvent{Type: event.Type, Code: event.Code, Value: event.Value, Time: t.UnixMicro()})
+	}
+	f.batch++
+	encoder.Encode(filterSync{Sync: f.batch})
+	f.stdin.SetWriteDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	if _, err := f.stdin.Write(request.Bytes()); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("events not read within %v", timeout)
+		}
+		return nil, fmt.Errorf("failed to write events: %w", err)
+	}
+
+	deadline := time.NewTimer(timeout - time.Since(start))
+	defer deadline.Stop()
+
+	out := f.out[:0]
+	answered := 0
+	for {
+		var line []byte
+		select {
+		case reply, ok := <-f.replies:
+			if !ok {
+				return nil, fmt.Errorf("filter exited")
+			}
+			line = reply
+		case <-deadline.C:
+			return nil, fmt.Errorf("no answer within %v", timeout)
+		}
+
+		var sync filterSync
+		if json.Unmarshal(line, &sync) == nil && sync.Sync != 0 {
+			if sync.Sync != f.batch {
+				return nil, fmt.Errorf("end of batch %d while waiting for batch %d", sync.Sync, f.batch)
+			}
+			if answered != len(events) {
+				return nil, fmt.Errorf("%d answers to %d events", answered, len(events))
+			}
+			break
+		}
+		if answered == len(events) {
+			return nil, fmt.Errorf("more answers than the %d events", len(events))
+		}
+		event := events[answered]
+		answered++
+
+		var answer []filterEvent
+		if err := json.Unmarshal(line, &answer); err != nil {
+			return nil, fmt.Errorf("invalid answer %q: %w", line, err)
+		}
+		for _, a := range answer {
+			filtered := evdev.InputEvent{Time: event.Time, Type: a.Type, Code: a.Code, Value: a.Value}
+			if a.Time != 0 {
+				filtered.Time = syscall.NsecToTimeval(a.Time * int64(time.Microsecond))
+			}
+			out = append(out, filtered)
+		}
+	}
+
+	f.out = out
+	return out, nil
+}
+
+// stop kills the program, if it is running
+func (f *filter) stop() {
+	if f.cmd == nil {
+		return
+	}
+	f.stdin.Close()
+	syscall.Kill(-f.cmd.Process.Pid, syscall.SIGKILL)
+	close(f.done)
+	f.cmd, f.stdin, f.replies, f.done = nil, nil, nil, nil
+}
+
+// restart stops the program so the next batch starts it afresh, for a
+// changed Config.Filter
+func (f *filter) restart() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stop()
+	f.failedAt = time.Time{}
+}
+
+// close stops the program for good
+func (f *filter) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stop()
+	f.closed = true
+}
+
+// filterTimeout returns how long the filter program has to answer a batch
+func (cfg *Config) filterTimeout() time.Duration {
+	if cfg.FilterTimeout > 0 {
+		return cfg.FilterTimeout
+	}
+	return DEFAULT_FILTER_TIMEOUT
+}
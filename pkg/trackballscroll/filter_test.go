@@ -0,0 +1,80 @@
+package trackballscroll
+
+import (
+	"testing"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// filterScript answers each event line as the case patterns in answers do,
+// and echoes the end of each batch back
+func filterScript(answers string) string {
+	return `while read -r line; do case "$line" in *'"sync"'*) echo "$line";; ` + answers + `; esac; done`
+}
+
+func TestFilter(t *testing.T) {
+	cfg := testConfig()
+	// Drops sideways motion and passes the rest on
+	cfg.Filter = filterScript(`*'"code":0,'*) echo '[]';; *) echo "[$line]"`)
+	cfg.FilterTimeout = time.Second
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+	defer ts.Close()
+
+	feed(t, ts,
+		batch(0, rel(0, REL_X, 4), rel(0, REL_Y, 2)),
+		batch(10, rel(10, REL_Y, 3), rel(10, REL_X, 1)),
+	)
+	assertFrames(t, writer, [][]out{{wheel(2)}, {wheel(3)}})
+}
+
+func TestFilterAnsweringTwiceIsDropped(t *testing.T) {
+	cfg := testConfig()
+	cfg.Filter = filterScript(`*) echo "[$line]"; echo "[$line]"`)
+	cfg.FilterTimeout = time.Second
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+	defer ts.Close()
+
+	feed(t, ts, batch(0, rel(0, REL_X, 4), rel(0, REL_Y, 2)))
+	// Passed through unchanged rather than answered out of step
+	assertFrames(t, writer, [][]out{{hwheel(4), wheel(2)}})
+
+	ts.filter.mu.Lock()
+	defer ts.filter.mu.Unlock()
+	if ts.filter.cmd != nil {
+		t.Error("filter still running after answering out of step")
+	}
+}
+
+func TestFilterThatStopsReadingTimesOut(t *testing.T) {
+	cfg := testConfig()
+	// Never reads its input, so a batch bigger than the pipe buffer blocks
+	// the write
+	cfg.Filter = "exec sleep 10"
+	cfg.FilterTimeout = 50 * time.Millisecond
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+	defer ts.Close()
+
+	var events []evdev.InputEvent
+	for i := 0; i < 2000; i++ {
+		events = append(events, rel(0, REL_X, 1))
+	}
+	events = append(events, rel(0, REL_Y, 3))
+
+	start := time.Now()
+	feed(t, ts, batch(0, events...))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("batch took %v, want the filter dropped after %v", elapsed, cfg.FilterTimeout)
+	}
+	// Passed through unchanged
+	assertFrames(t, writer, [][]out{{hwheel(2000), wheel(3)}})
+
+	ts.filter.mu.Lock()
+	defer ts.filter.mu.Unlock()
+	if ts.filter.cmd != nil {
+		t.Error("filter still running after the timeout")
+	}
+}
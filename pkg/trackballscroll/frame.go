@@ -0,0 +1,283 @@
+package trackballscroll
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// frameWriter serializes writes to the virtual device. While batching, the
+// relative events of a whole input batch are summed per code and sent as one
+// frame when the batch ends; key events still go out in their own frame, after
+// whatever motion came before them, so a modifier wraps the wheel it belongs to
+type frameWriter struct {
+	mu       sync.Mutex
+	batching bool
+	stamp    syscall.Timeval // time of the input batch, zero outside one
+	rel      []InputEvent    // summed relative events waiting for the end of the batch
+	out      []InputEvent    // reused buffer for the frame being written
+	failures int             // frames in a row that failed with an error, not counting WriteFull drops
+
+	// Reused buffers for the halves of a frame split between the pointer
+	// and scroll devices
+	pointer []InputEvent
+	scroll  []InputEvent
+}
+
+// add sums events into the pending relative events
+func (f *frameWriter) add(events []InputEvent) {
+next:
+	for _, event := range events {
+		for i := range f.rel {
+			if f.rel[i].Code == event.Code {
+				f.rel[i].Value += event.Value
+				continue next
+			}
+		}
+		f.rel = append(f.rel, event)
+	}
+}
+
+// route splits events between the pointer device and the scroll device
+func (f *frameWriter) route(events []InputEvent) (pointer, scroll []InputEvent) {
+	f.pointer, f.scroll = f.pointer[:0], f.scroll[:0]
+	for _, event := range events {
+		if isPointerEvent(event.Type, event.Code) {
+			f.pointer = append(f.pointer, event)
+		} else {
+			f.scroll = append(f.scroll, event)
+		}
+	}
+	return f.pointer, f.scroll
+}
+
+// onlyRelative reports whether events can be merged into a batched frame
+func onlyRelative(events []InputEvent) bool {
+	for _, event := range events {
+		if event.Type != EV_REL {
+			return false
+		}
+	}
+	return true
+}
+
+// beginBatch holds relative events back until endBatch, and stamps every
+// frame until then with stamp, the time of the input batch
+func (ts *Scroller) beginBatch(stamp syscall.Timeval) {
+	ts.frame.mu.Lock()
+	ts.frame.batching = true
+	ts.frame.stamp = stamp
+	ts.frame.mu.Unlock()
+}
+
+// endBatch sends the relative events held back since beginBatch as one frame
+func (ts *Scroller) endBatch() error {
+	ts.frame.mu.Lock()
+	defer ts.frame.mu.Unlock()
+
+	ts.frame.batching = false
+	err := ts.flushFrame()
+	ts.frame.stamp = syscall.Timeval{}
+	return err
+}
+
+// sendFrame writes events followed by a sync report, or merges them into the
+// current batch if they are all relative
+func (ts *Scroller) sendFrame(events []InputEvent) error {
+	ts.frame.mu.Lock()
+	defer ts.frame.mu.Unlock()
+
+	if ts.writer == nil {
+		return nil // dry run
+	}
+
+	if ts.frame.batching && onlyRelative(events) {
+		ts.frame.add(events)
+		return nil
+	}
+	if err := ts.flushFrame(); err != nil {
+		return err
+	}
+	return ts.writeFrame(events)
+}
+
+// flushFrame writes the pending relative events, if any. The caller holds
+// ts.frame.mu
+func (ts *Scroller) flushFrame() error {
+	if len(ts.frame.rel) == 0 || ts.writer == nil {
+		return nil
+	}
+
+	err := ts.writeFrame(ts.frame.rel)
+	ts.frame.rel = ts.frame.rel[:0]
+	return err
+}
+
+// writeFrame writes events to the virtual device, or with Config.SplitDevices
+// the pointer motion and buttons to the pointer device and the rest to the
+// scroll device, each as a frame of its own. The caller holds ts.frame.mu
+func (ts *Scroller) writeFrame(events []InputEvent) error {
+	if ts.pointerWriter == nil {
+		return ts.writeFrameTo(ts.writer, events)
+	}
+
+	pointer, scroll := ts.frame.route(events)
+	var err error
+	if len(pointer) > 0 {
+		err = ts.writeFrameTo(ts.pointerWriter, pointer)
+	}
+	if len(scroll) > 0 {
+		err = errors.Join(err, ts.writeFrameTo(ts.writer, scroll))
+	}
+	return err
+}
+
+// writeFrameTo writes events and a sync report to writer in a single write.
+// Each carries the time of the input batch it comes from, or the current time
+// for output of its own such as kinetic scrolling, so writers other than
+// uinput can tell how fast things happened. uinput itself restamps events as
+// it receives them. The caller holds ts.frame.mu
+func (ts *Scroller) writeFrameTo(writer EventWriter, events []InputEvent) error {
+	stamp := ts.frame.stamp
+	if stamp == (syscall.Timeval{}) {
+		stamp = syscall.NsecToTimeval(time.Now().UnixNano())
+	}
+
+	frame := append(ts.frame.out[:0], events...)
+	frame = append(frame, InputEvent{Type: EV_SYN, Code: SYN_REPORT, Value: 0})
+	for i := range frame {
+		frame[i].Time = stamp
+	}
+	ts.frame.out = frame
+
+	written, err := ts.writeEvents(writer, frame)
+	if written {
+		ts.frame.failures = 0
+		return nil
+	}
+
+	ts.droppedEvents.Add(1)
+	ts.observers.EventDropped()
+	if err == nil {
+		// Dropped by the WriteFull policy: the device is busy, not broken
+		return nil
+	}
+
+	ts.frame.failures++
+	if ts.frame.failures >= WRITE_FAILURE_LIMIT {
+		ts.frame.failures = 0
+		ts.reopenVirtualDevice(err)
+	}
+	return fmt.Errorf("failed to write event: %w", err)
+}
+
+// reopenVirtualDevice replaces a virtual device that has stopped taking
+// events with a new one, both of them if it is split. Writers given with
+// WithWriter are left alone. The caller holds ts.frame.mu
+func (ts *Scroller) reopenVirtualDevice(cause error) {
+	if !ts.ownsWriter {
+		return
+	}
+	slog.Warn("Virtual device keeps failing, recreating it", "device", ts.Device().Name, "failures", WRITE_FAILURE_LIMIT, "error", cause)
+
+	writer, pointerWriter, err := ts.createVirtualDevices(*ts.Config())
+	if err != nil {
+		slog.Error("Failed to recreate virtual device", "device", ts.Device().Name, "error", err)
+		return
+	}
+	ts.closeWriters()
+	ts.writer, ts.pointerWriter = writer, pointerWriter
+}
+
+// closeWriters destroys the virtual devices. The caller holds ts.frame.mu
+func (ts *Scroller) closeWriters() {
+	if ts.writer != nil {
+		ts.writer.Close()
+	}
+	if ts.pointerWriter != nil {
+		ts.pointerWriter.Close()
+	}
+}
+
+// writeEvents writes a frame to writer, going on with the rest after a short
+// write and applying the WriteFull policy to whatever is left if the writer
+// reports EAGAIN. It returns false if the rest of the frame was dropped
+func (ts *Scroller) writeEvents(writer EventWriter, events []InputEvent) (bool, error) {
+	n, err := writer.WriteEvents(events)
+	for err == nil && n > 0 && n < len(events) {
+		events = events[n:]
+		n, err = writer.WriteEvents(events)
+	}
+	if err == nil && n < len(events) {
+		return false, io.ErrShortWrite
+	}
+	if err != syscall.EAGAIN {
+		return err == nil, err
+	}
+	events = events[n:]
+
+	switch ts.Config().WriteFull {
+	case WRITE_FULL_BLOCK:
+		// Only this frame waits; the next write is nonblocking again, in
+		// case the policy changes on reload
+		if err := writer.SetBlocking(true); err != nil {
+			return false, fmt.Errorf("failed to make uinput blocking: %w", err)
+		}
+		defer writer.SetBlocking(false)
+		for len(events) > 0 {
+			n, err = writer.WriteEvents(events)
+			events = events[n:]
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			if n == 0 {
+				return false, io.ErrShortWrite
+			}
+		}
+		return true, nil
+	case WRITE_FULL_RETRY:
+		deadline := time.Now().Add(WRITE_RETRY_DEADLINE)
+		polled := false
+		// A retry can itself be short, so keep going until the whole frame,
+		// sync report included, is written
+		for len(events) > 0 && (err == nil || err == syscall.EAGAIN) && time.Now().Before(deadline) {
+			// Once the device has claimed room and still refused, polling
+			// again would only spin, so sleep instead
+			if err == syscall.EAGAIN {
+				if polled || !waitWritable(writer, time.Until(deadline)) {
+					time.Sleep(WRITE_RETRY_INTERVAL)
+				}
+				polled = true
+			}
+			n, err = writer.WriteEvents(events)
+			events = events[n:]
+			if n > 0 {
+				polled = false
+			} else if err == nil {
+				return false, io.ErrShortWrite
+			}
+		}
+		if err == nil || err == syscall.EAGAIN {
+			return len(events) == 0, nil
+		}
+		return false, err
+	default:
+		return false, nil
+	}
+}
+
+// waitWritable waits up to timeout for writer to have room, reporting false
+// if it can't tell
+func waitWritable(writer EventWriter, timeout time.Duration) bool {
+	if waiter, ok := writer.(writeWaiter); ok {
+		return waiter.WaitWritable(timeout)
+	}
+	return false
+}
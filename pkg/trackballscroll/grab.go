@@ -0,0 +1,100 @@
+package trackballscroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const (
+	GRAB_RETRY_INITIAL      = 100 * time.Millisecond
+	GRAB_RETRY_MAX          = 2 * time.Second
+	DEFAULT_GRAB_TIMEOUT_MS = 10000
+)
+
+// Process is a running program, as found under /proc
+type Process struct {
+	PID     int
+	Command string
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%s (pid %d)", p.Command, p.PID)
+}
+
+// OpenDeviceRetry opens and grabs a device like OpenDevice, but while another
+// process holds the grab it keeps trying with growing delays for up to
+// timeout. A crashed previous instance or a slow-to-exit one often lets go
+// within a few seconds. It returns ctx's error if ctx is done first
+func OpenDeviceRetry(ctx context.Context, devicePath string, timeout time.Duration) (*evdev.InputDevice, error) {
+	deadline := time.Now().Add(timeout)
+	delay := GRAB_RETRY_INITIAL
+	reported := false
+
+	for {
+		device, err := OpenDevice(devicePath, true)
+		if err == nil || !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return device, err
+		}
+
+		if !reported {
+			slog.Warn("Device is grabbed by another process, retrying", "path", devicePath,
+				"holders", DeviceHolders(devicePath), "timeout", timeout)
+			reported = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, GRAB_RETRY_MAX)
+	}
+}
+
+// DeviceHolders lists the other processes that have a device open, found
+// through their /proc/<pid>/fd links. Which of them holds the grab can't be
+// told from there, and processes of other users are only visible to root
+func DeviceHolders(devicePath string) []Process {
+	target := resolveDevicePath(devicePath)
+	self := os.Getpid()
+
+	fdDirs, _ := filepath.Glob("/proc/[0-9]*/fd")
+	var holders []Process
+	for _, fdDir := range fdDirs {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(fdDir)))
+		if err != nil || pid == self {
+			continue
+		}
+
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				holders = append(holders, Process{PID: pid, Command: processCommand(pid)})
+				break
+			}
+		}
+	}
+	return holders
+}
+
+// processCommand returns the command name of a process, or "?" if it is gone
+func processCommand(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(comm))
+}
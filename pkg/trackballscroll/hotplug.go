@@ -0,0 +1,84 @@
+package trackballscroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const (
+	INPUT_DIR            = "/dev/input"
+	HOTPLUG_SETTLE_DELAY = 200 * time.Millisecond // let udev finish permissions on a new node
+)
+
+// WaitForTrackball blocks until the requested device (a path, or "auto") can be
+// opened and grabbed, rescanning whenever something changes under /dev/input.
+// It returns a nil device if ctx is done first
+func WaitForTrackball(ctx context.Context, devicePath string, detect Detection) (*evdev.InputDevice, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start inotify: %w", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, INPUT_DIR, syscall.IN_CREATE|syscall.IN_ATTRIB); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", INPUT_DIR, err)
+	}
+
+	// udev adds a by-id or by-path link after the event node, so watch for
+	// that too when waiting on one. The directory may not exist yet
+	if dir := filepath.Dir(devicePath); strings.HasPrefix(dir, INPUT_DIR+"/") {
+		syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE)
+	}
+
+	// A nonblocking fd goes through the runtime poller, so closing it
+	// interrupts a pending Read when ctx is done
+	watcher := os.NewFile(uintptr(fd), "inotify")
+	stop := context.AfterFunc(ctx, func() { watcher.Close() })
+	defer func() {
+		if stop() {
+			watcher.Close()
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		if device := tryOpenTrackball(devicePath, detect); device != nil {
+			return device, nil
+		}
+
+		if _, err := watcher.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to read inotify events: %w", err)
+		}
+		time.Sleep(HOTPLUG_SETTLE_DELAY)
+	}
+}
+
+// tryOpenTrackball opens and grabs the requested device if it is present. In
+// auto mode or by vendor:product ID it takes the first match not already
+// grabbed
+func tryOpenTrackball(devicePath string, detect Detection) *evdev.InputDevice {
+	paths, _ := devicePaths(devicePath, detect)
+
+	for _, path := range paths {
+		if device, err := OpenDevice(path, true); err == nil {
+			return device
+		}
+	}
+	return nil
+}
+
+// isDeviceGone reports whether a read error means the device was unplugged
+func isDeviceGone(err error) bool {
+	return errors.Is(err, syscall.ENODEV) || errors.Is(err, io.EOF)
+}
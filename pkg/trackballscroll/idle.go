@@ -0,0 +1,57 @@
+package trackballscroll
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const IDLE_CHECKS = 4 // checks for idleness per Config.IdleUngrab
+
+// runIdleUngrab releases the grab after cfg.IdleUngrab without events, so
+// other programs such as firmware configurators and games reading raw input
+// can have the device. Reading carries on without the grab, and the next
+// event grabs it again
+func (ts *Scroller) runIdleUngrab(ctx context.Context) {
+	defer ts.cleanupOnPanic()
+	ticker := time.NewTicker(ts.Config().IdleUngrab / IDLE_CHECKS)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if ts.paused.Load() || ts.idle.Load() {
+			continue
+		}
+		silence := time.Since(time.Unix(0, ts.lastEventAt.Load()))
+		if silence < ts.Config().IdleUngrab {
+			continue
+		}
+
+		device := ts.Device()
+		if err := device.Release(); err != nil {
+			slog.Warn("Failed to release idle device", "device", device.Fn, "error", err)
+			continue
+		}
+		ts.idle.Store(true)
+		slog.Info("Idle, released device until it is used again", "device", device.Name)
+	}
+}
+
+// wake grabs an idle device again. The events that woke it have already
+// reached the system unconverted, so the caller drops them
+func (ts *Scroller) wake() {
+	if !ts.idle.Swap(false) {
+		return
+	}
+	device := ts.Device()
+	if err := device.Grab(); err != nil {
+		slog.Warn("Failed to grab device again", "device", device.Fn, "error", err)
+		return
+	}
+	slog.Info("Device in use, grabbed it again", "device", device.Name)
+}
@@ -0,0 +1,102 @@
+package trackballscroll
+
+import (
+	"io"
+	"syscall"
+	"time"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// DeviceReader is the source of input events for a scroller. An
+// *evdev.InputDevice satisfies it
+type DeviceReader interface {
+	Read() ([]evdev.InputEvent, error)
+}
+
+// EventWriter is the sink for events sent to the virtual device
+type EventWriter interface {
+	// WriteEvents writes a frame of events at once and returns how many were
+	// written, with syscall.EAGAIN if the device can't take the rest without
+	// blocking
+	WriteEvents(events []InputEvent) (int, error)
+
+	// SetBlocking switches WriteEvents between failing with EAGAIN and waiting
+	SetBlocking(blocking bool) error
+
+	Close() error
+}
+
+// writeWaiter is implemented by writers that can wait for room for more
+// events, which WRITE_FULL_RETRY does rather than sleeping
+type writeWaiter interface {
+	// WaitWritable waits up to timeout and reports whether there is room
+	WaitWritable(timeout time.Duration) bool
+}
+
+// pollFd is the kernel's struct pollfd
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const POLLOUT = 0x4
+
+// uinputWriter writes events to a uinput virtual device
+type uinputWriter struct {
+	fd      int
+	sysname string // sysfs name, recorded in ownDevices
+}
+
+// newUinputWriter wraps a created virtual device and records it as our own
+func newUinputWriter(fd int) *uinputWriter {
+	w := &uinputWriter{fd: fd}
+	if sysname, err := virtualSysname(fd); err == nil {
+		w.sysname = sysname
+		ownDevices.Store(sysname, struct{}{})
+	}
+	return w
+}
+
+func (w *uinputWriter) WriteEvents(events []InputEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	size := int(unsafe.Sizeof(events[0]))
+	eventBytes := unsafe.Slice((*byte)(unsafe.Pointer(&events[0])), len(events)*size)
+	n, err := syscall.Write(w.fd, eventBytes)
+	if n < 0 {
+		n = 0
+	}
+	if err == nil && n%size != 0 {
+		// Half an event can't be finished by writing the rest
+		err = io.ErrShortWrite
+	}
+	return n / size, err
+}
+
+// WaitWritable polls the device for room. ppoll is used as it exists on
+// every architecture, unlike poll
+func (w *uinputWriter) WaitWritable(timeout time.Duration) bool {
+	fds := []pollFd{{fd: int32(w.fd), events: POLLOUT}}
+	limit := syscall.NsecToTimespec(int64(max(timeout, 0)))
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)),
+		uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	return errno == 0 && n > 0 && fds[0].revents&POLLOUT != 0
+}
+
+func (w *uinputWriter) SetBlocking(blocking bool) error {
+	return syscall.SetNonblock(w.fd, !blocking)
+}
+
+// Close destroys the virtual device
+func (w *uinputWriter) Close() error {
+	if w.sysname != "" {
+		ownDevices.Delete(w.sysname)
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, uintptr(w.fd), UI_DEV_DESTROY, 0)
+	return syscall.Close(w.fd)
+}
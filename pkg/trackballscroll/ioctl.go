@@ -0,0 +1,42 @@
+package trackballscroll
+
+import "unsafe"
+
+// ioctl request numbers pack a direction, type, number and argument size the
+// way the kernel's _IOC macro does. Building them from the argument's size
+// keeps them right where pointers are 32 bits, and the per-architecture
+// IOC_* constants cover those that lay the bits out differently
+const (
+	IOC_NRBITS    = 8
+	IOC_TYPEBITS  = 8
+	IOC_NRSHIFT   = 0
+	IOC_TYPESHIFT = IOC_NRSHIFT + IOC_NRBITS
+	IOC_SIZESHIFT = IOC_TYPESHIFT + IOC_TYPEBITS
+	IOC_DIRSHIFT  = IOC_SIZESHIFT + IOC_SIZEBITS
+)
+
+// ioc is _IOC
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir<<IOC_DIRSHIFT | typ<<IOC_TYPESHIFT | nr<<IOC_NRSHIFT | size<<IOC_SIZESHIFT
+}
+
+// ioNone is _IO, for requests without an argument
+func ioNone(typ, nr uintptr) uintptr {
+	return ioc(IOC_NONE, typ, nr, 0)
+}
+
+// ioRead is _IOR, for requests the kernel fills in size bytes of
+func ioRead(typ, nr, size uintptr) uintptr {
+	return ioc(IOC_READ, typ, nr, size)
+}
+
+// ioWrite is _IOW, for requests passing size bytes to the kernel
+func ioWrite(typ, nr, size uintptr) uintptr {
+	return ioc(IOC_WRITE, typ, nr, size)
+}
+
+// Sizes of ioctl arguments
+const (
+	SIZEOF_INT     = unsafe.Sizeof(int32(0))
+	SIZEOF_POINTER = unsafe.Sizeof(uintptr(0))
+)
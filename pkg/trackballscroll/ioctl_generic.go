@@ -0,0 +1,11 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le
+
+package trackballscroll
+
+// ioctl direction bits, from asm-generic/ioctl.h
+const (
+	IOC_SIZEBITS = 14
+	IOC_NONE     = 0
+	IOC_WRITE    = 1
+	IOC_READ     = 2
+)
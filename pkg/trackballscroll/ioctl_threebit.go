@@ -0,0 +1,12 @@
+//go:build mips || mipsle || mips64 || mips64le || ppc64 || ppc64le
+
+package trackballscroll
+
+// ioctl direction bits on MIPS and PowerPC, which have three of them and a
+// smaller size field
+const (
+	IOC_SIZEBITS = 13
+	IOC_NONE     = 1
+	IOC_READ     = 2
+	IOC_WRITE    = 4
+)
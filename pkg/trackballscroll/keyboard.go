@@ -0,0 +1,83 @@
+package trackballscroll
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const KEY_MAX = 0x2ff
+
+// KeyboardWatcher reads a keyboard device without grabbing it, so typing
+// still reaches the desktop, and records when a key was last pressed and
+// which keys are held down
+type KeyboardWatcher struct {
+	device    *evdev.InputDevice
+	lastKeyAt atomic.Int64 // unix nanoseconds of the last key press or repeat
+	held      [KEY_MAX + 1]atomic.Bool
+}
+
+// NewKeyboardWatcher opens the keyboard device at devicePath for watching
+func NewKeyboardWatcher(devicePath string) (*KeyboardWatcher, error) {
+	device, err := evdev.Open(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyboard %s: %w", devicePath, err)
+	}
+
+	return &KeyboardWatcher{device: device}, nil
+}
+
+// Run reads key events until the device fails or ctx is done
+func (kw *KeyboardWatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		events, err := kw.device.Read()
+		if err != nil {
+			slog.Warn("Stopped watching keyboard", "device", kw.device.Fn, "error", err)
+			return
+		}
+
+		for _, event := range events {
+			kw.observe(event)
+		}
+	}
+}
+
+// observe records a key press, repeat or release
+func (kw *KeyboardWatcher) observe(event evdev.InputEvent) {
+	if event.Type != evdev.EV_KEY || event.Code > KEY_MAX {
+		return
+	}
+	kw.held[event.Code].Store(event.Value != int32(evdev.KeyUp))
+	if event.Value != int32(evdev.KeyUp) {
+		kw.lastKeyAt.Store(eventTime(event).UnixNano())
+	}
+}
+
+// Held reports whether a key is currently held down
+func (kw *KeyboardWatcher) Held(code uint16) bool {
+	return code <= KEY_MAX && kw.held[code].Load()
+}
+
+// lastKeyTime returns when a key was last pressed, or the zero time if never
+func (kw *KeyboardWatcher) lastKeyTime() time.Time {
+	nanos := kw.lastKeyAt.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Close stops watching the keyboard
+func (kw *KeyboardWatcher) Close() {
+	kw.device.File.Close()
+}
@@ -0,0 +1,114 @@
+package trackballscroll
+
+import (
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// What ball scrolling sends, for Config.ScrollOutput
+const (
+	SCROLL_OUTPUT_WHEEL  = "wheel"
+	SCROLL_OUTPUT_PAGE   = "page"   // KEY_PAGEUP/KEY_PAGEDOWN, and arrows sideways
+	SCROLL_OUTPUT_ARROWS = "arrows" // KEY_UP/KEY_DOWN and KEY_LEFT/KEY_RIGHT
+	SCROLL_OUTPUT_MEDIA  = "media"  // volume, and next and previous song sideways
+)
+
+// Scroll clicks of ball travel per key press when Config.KeyThreshold is 0.
+// A page moves much further than a wheel click, an arrow about as far
+const (
+	DEFAULT_PAGE_THRESHOLD  = 5.0
+	DEFAULT_ARROW_THRESHOLD = 1.0
+	DEFAULT_MEDIA_THRESHOLD = 2.0 // so a nudge sideways doesn't skip a song
+)
+
+// scrollOutputKeys are the keys each key output sends for scrolling up and
+// down, then right and left
+var scrollOutputKeys = map[string][2][2]uint16{
+	SCROLL_OUTPUT_PAGE: {
+		{uint16(evdev.KEY_PAGEUP), uint16(evdev.KEY_PAGEDOWN)},
+		{uint16(evdev.KEY_RIGHT), uint16(evdev.KEY_LEFT)},
+	},
+	SCROLL_OUTPUT_ARROWS: {
+		{uint16(evdev.KEY_UP), uint16(evdev.KEY_DOWN)},
+		{uint16(evdev.KEY_RIGHT), uint16(evdev.KEY_LEFT)},
+	},
+	SCROLL_OUTPUT_MEDIA: {
+		{uint16(evdev.KEY_VOLUMEUP), uint16(evdev.KEY_VOLUMEDOWN)},
+		{uint16(evdev.KEY_NEXTSONG), uint16(evdev.KEY_PREVIOUSSONG)},
+	},
+}
+
+// outputKeys returns the keys an axis scrolls with for a SCROLL_OUTPUT_*, and
+// false if it sends wheel events
+func outputKeys(output string, isHorizontal bool) ([2]uint16, bool) {
+	keys, ok := scrollOutputKeys[output]
+	if !ok {
+		return [2]uint16{}, false
+	}
+	if isHorizontal {
+		return keys[1], true
+	}
+	return keys[0], true
+}
+
+// switchesMedia reports whether media mode can be switched on, which needs
+// the virtual device to advertise the media keys
+func (cfg *Config) switchesMedia() bool {
+	return cfg.MediaButton != 0 || cfg.MediaKeys || hasMode(cfg.modes(), MODE_MEDIA)
+}
+
+// keyThreshold returns the scroll clicks of travel per key press for output
+func (cfg *Config) keyThreshold(output string) float64 {
+	if cfg.KeyThreshold > 0 && output == cfg.ScrollOutput {
+		return cfg.KeyThreshold
+	}
+	switch output {
+	case SCROLL_OUTPUT_PAGE:
+		return DEFAULT_PAGE_THRESHOLD
+	case SCROLL_OUTPUT_MEDIA:
+		return DEFAULT_MEDIA_THRESHOLD
+	default:
+		return DEFAULT_ARROW_THRESHOLD
+	}
+}
+
+// scrollKeys returns what ball scrolling sends in mode and the keys an axis
+// scrolls with, or false for wheel events. Custom mode with no keys for the
+// axis returns zero keys, which scrollWithKeys drops
+func (cfg *Config) scrollKeys(mode string, isHorizontal bool) (string, [2]uint16, bool) {
+	axis := 0
+	if isHorizontal {
+		axis = 1
+	}
+
+	switch mode {
+	case MODE_MEDIA:
+		keys, _ := outputKeys(SCROLL_OUTPUT_MEDIA, isHorizontal)
+		return SCROLL_OUTPUT_MEDIA, keys, true
+	case MODE_CUSTOM:
+		return MODE_CUSTOM, cfg.CustomKeys[axis], true
+	default:
+		keys, ok := outputKeys(cfg.ScrollOutput, isHorizontal)
+		return cfg.ScrollOutput, keys, ok
+	}
+}
+
+// scrollWithKeys taps keys for scroll, once per keyThreshold clicks of
+// travel, carrying the rest into the next event
+func (ts *Scroller) scrollWithKeys(cfg *Config, output string, keys [2]uint16, isHorizontal bool, scroll float64, delta int32, t time.Time) {
+	remainder := &ts.keyRemainderY
+	if isHorizontal {
+		remainder = &ts.keyRemainderX
+	}
+	presses := carry(remainder, scroll/cfg.keyThreshold(output))
+	if presses == 0 || keys[0] == 0 || !ts.rateLimit.allow(t, cfg.MaxScrollRate) {
+		return
+	}
+
+	if cfg.DryRun {
+		printDryRun(isHorizontal, output, presses, delta)
+	}
+	ts.sendWheelKeys(keys, presses)
+	ts.observers.ScrollLatency(time.Since(t))
+}
@@ -0,0 +1,113 @@
+package trackballscroll
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	KINETIC_RATE         = 60                    // coasting ticks per second
+	KINETIC_RELEASE_GAP  = 50 * time.Millisecond // pause after which the ball counts as released
+	KINETIC_MIN_VELOCITY = 2.0                   // notches per second below which coasting stops
+	KINETIC_SMOOTHING    = 0.3                   // weight of the newest sample in the velocity estimate
+)
+
+// kineticState tracks scroll velocity while the ball moves and coasts with
+// decaying velocity once it is released
+type kineticState struct {
+	mu         sync.Mutex
+	velX, velY float64 // notches per second
+	accX, accY float64 // fractional notches not yet emitted while coasting
+	lastMotion time.Time
+	coasting   bool
+}
+
+// touch cancels any coasting as soon as the ball moves again
+func (k *kineticState) touch() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.coasting {
+		k.coasting = false
+		k.velX, k.velY = 0, 0
+	}
+}
+
+// observe folds an emitted scroll amount into the velocity estimate
+func (k *kineticState) observe(isHorizontal bool, scroll float64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	dt := now.Sub(k.lastMotion)
+	if dt > VELOCITY_RESET_GAP {
+		k.velX, k.velY = 0, 0
+	}
+	if dt < time.Millisecond {
+		dt = time.Millisecond
+	}
+	k.lastMotion = now
+
+	vel := &k.velY
+	if isHorizontal {
+		vel = &k.velX
+	}
+	*vel = (1-KINETIC_SMOOTHING)*(*vel) + KINETIC_SMOOTHING*(scroll/dt.Seconds())
+}
+
+// step advances coasting by one tick and returns the whole notches to emit
+func (k *kineticState) step(friction float64) (int32, int32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.coasting {
+		released := !k.lastMotion.IsZero() && time.Since(k.lastMotion) > KINETIC_RELEASE_GAP
+		if !released || math.Hypot(k.velX, k.velY) < KINETIC_MIN_VELOCITY {
+			return 0, 0
+		}
+		k.coasting = true
+		k.accX, k.accY = 0, 0
+		k.lastMotion = time.Time{}
+	}
+
+	k.accX += k.velX / KINETIC_RATE
+	k.accY += k.velY / KINETIC_RATE
+	stepX, stepY := math.Trunc(k.accX), math.Trunc(k.accY)
+	k.accX -= stepX
+	k.accY -= stepY
+
+	k.velX *= 1 - friction
+	k.velY *= 1 - friction
+	if math.Hypot(k.velX, k.velY) < KINETIC_MIN_VELOCITY {
+		k.coasting = false
+		k.velX, k.velY = 0, 0
+	}
+
+	return int32(stepX), int32(stepY)
+}
+
+// runKinetic keeps scrolling after a flick, slowing down by the configured
+// friction each tick until the ball is touched again or the motion dies out
+func (ts *Scroller) runKinetic(ctx context.Context) {
+	defer ts.cleanupOnPanic()
+	ticker := time.NewTicker(time.Second / KINETIC_RATE)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stepX, stepY := ts.kinetic.step(ts.Config().KineticFriction)
+		if stepX != 0 {
+			ts.sendScrollEvent(true, stepX)
+		}
+		if stepY != 0 {
+			ts.sendScrollEvent(false, stepY)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// What the ball does when no button or modifier says otherwise, for
+// Config.Modes and Scroller.SetMode
+const (
+	MODE_POINTER = "pointer"
+	MODE_SCROLL  = "scroll"
+	MODE_ZOOM    = "zoom"   // Ctrl+wheel, as while ZoomButton is held
+	MODE_MEDIA   = "media"  // SCROLL_OUTPUT_MEDIA keys
+	MODE_CUSTOM  = "custom" // Config.CustomKeys
+)
+
+// DEFAULT_MODES is what Config.ModeButton cycles through if Config.Modes is
+// empty
+var DEFAULT_MODES = []string{MODE_POINTER, MODE_SCROLL}
+
+// ParseModes parses a comma-separated list of modes, such as
+// pointer,scroll,media
+func ParseModes(value string) ([]string, error) {
+	var modes []string
+	for _, mode := range strings.Split(value, ",") {
+		mode = strings.TrimSpace(mode)
+		switch mode {
+		case MODE_POINTER, MODE_SCROLL, MODE_ZOOM, MODE_MEDIA, MODE_CUSTOM:
+		default:
+			return nil, fmt.Errorf("unknown mode %q: must be pointer, scroll, zoom, media or custom", mode)
+		}
+		if hasMode(modes, mode) {
+			return nil, fmt.Errorf("mode %q is listed twice", mode)
+		}
+		modes = append(modes, mode)
+	}
+	return modes, nil
+}
+
+// ParseCustomKeys parses the keys custom mode sends, as
+// <up key>/<down key> optionally followed by ,<right key>/<left key>
+func ParseCustomKeys(value string) ([2][2]uint16, error) {
+	vertical, horizontal, sideways := strings.Cut(value, ",")
+
+	var keys [2][2]uint16
+	var err error
+	if keys[0], err = ParseWheelKeys(vertical); err != nil {
+		return keys, err
+	}
+	if sideways {
+		if keys[1], err = ParseWheelKeys(horizontal); err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+func hasMode(modes []string, mode string) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// modes returns the modes that can be switched to, nil if there are none
+func (cfg *Config) modes() []string {
+	if len(cfg.Modes) > 0 {
+		return cfg.Modes
+	}
+	if cfg.ModeButton != 0 {
+		return DEFAULT_MODES
+	}
+	return nil
+}
+
+// defaultMode returns the mode the ball starts in: the first of Modes, or
+// else pointer motion if a button or modifier is needed to scroll
+func (cfg *Config) defaultMode() string {
+	if modes := cfg.modes(); len(modes) > 0 {
+		return modes[0]
+	}
+	if cfg.movesPointer() {
+		return MODE_POINTER
+	}
+	return MODE_SCROLL
+}
+
+// supportsMode reports whether the virtual device advertises what mode sends
+func (cfg *Config) supportsMode(mode string) bool {
+	switch mode {
+	case MODE_POINTER:
+		return cfg.movesPointer()
+	case MODE_SCROLL:
+		return true
+	case MODE_ZOOM:
+		return cfg.sendsCtrl()
+	case MODE_MEDIA:
+		return cfg.switchesMedia()
+	case MODE_CUSTOM:
+		return hasMode(cfg.modes(), MODE_CUSTOM) && cfg.CustomKeys[0][0] != 0
+	default:
+		return false
+	}
+}
+
+// Mode returns the current MODE_*
+func (ts *Scroller) Mode() string {
+	if mode := ts.mode.Load(); mode != nil {
+		return *mode
+	}
+	return ts.Config().defaultMode()
+}
+
+// SetMode switches to a MODE_*. It fails if the virtual device wasn't created
+// with what the mode sends: pointer motion needs a scroll button, toggle
+// button, scroll modifier or pointer in Modes, and so on
+func (ts *Scroller) SetMode(mode string) error {
+	if !ts.Config().supportsMode(mode) {
+		return fmt.Errorf("%s mode isn't enabled for this device", mode)
+	}
+
+	old := ts.Mode()
+	ts.mode.Store(&mode)
+	if old == mode {
+		return nil
+	}
+	slog.Info("Switched mode", "device", ts.Device().Name, "mode", mode)
+	ts.observers.ModeChanged(ts.Device(), mode)
+	return nil
+}
+
+// CycleMode switches to the mode after the current one in Modes, wrapping
+// around to the first
+func (ts *Scroller) CycleMode() error {
+	modes := ts.Config().modes()
+	if len(modes) == 0 {
+		return fmt.Errorf("no modes to cycle through")
+	}
+
+	current := ts.Mode()
+	next := modes[0]
+	for i, mode := range modes {
+		if mode == current {
+			next = modes[(i+1)%len(modes)]
+			break
+		}
+	}
+	return ts.SetMode(next)
+}
+
+// Media reports whether media mode is on
+func (ts *Scroller) Media() bool {
+	return ts.Mode() == MODE_MEDIA
+}
+
+// SetMedia switches media mode on, or back to the default mode. While it is
+// on the ball is a jog dial: vertical motion changes the volume and sideways
+// motion skips songs, whether or not a scroll button is held
+func (ts *Scroller) SetMedia(on bool) error {
+	if on {
+		return ts.SetMode(MODE_MEDIA)
+	}
+	if ts.Media() {
+		return ts.SetMode(ts.Config().defaultMode())
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package trackballscroll
+
+import (
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// Observer is told about what a Scroller does, for metrics, signals and the
+// like. Methods are called from the scroller's goroutines and must not block
+type Observer interface {
+	DeviceConnected(device *evdev.InputDevice)
+	DeviceDisconnected(device *evdev.InputDevice)
+	EventsRead(n int)
+	ScrollEmitted()
+	EventDropped()
+
+	// InputDropped reports n input events discarded because the queue
+	// between reading and writing was full
+	InputDropped(n int)
+
+	// ScrollLatency reports the delay from an input event's kernel
+	// timestamp to its scroll output being written or queued
+	ScrollLatency(latency time.Duration)
+
+	// ModeChanged reports a switch to another MODE_*
+	ModeChanged(device *evdev.InputDevice, mode string)
+
+	// MotionRead reports ball motion read on an axis, before anything is
+	// done with it
+	MotionRead(device *evdev.InputDevice, isHorizontal bool, delta int32)
+
+	// ScrollSent reports wheel scrolling written to the virtual device, in
+	// clicks, which are fractional for hi-res scrolling
+	ScrollSent(device *evdev.InputDevice, isHorizontal bool, clicks float64)
+
+	// DeadZoneChecked reports motion on an axis that the dead zone
+	// suppressed or let through
+	DeadZoneChecked(device *evdev.InputDevice, isHorizontal bool, suppressed bool)
+}
+
+// ChordObserver is an Observer that carries out chords whose Chord.Action is
+// set. Observers given to WithObserver are checked for it
+type ChordObserver interface {
+	Observer
+
+	// ChordAction reports a chord pressed whose Chord.Action is set
+	ChordAction(device *evdev.InputDevice, action string)
+}
+
+// NopObserver implements Observer by ignoring everything. Embed it to
+// implement only some of the methods
+type NopObserver struct{}
+
+func (NopObserver) DeviceConnected(*evdev.InputDevice)             {}
+func (NopObserver) DeviceDisconnected(*evdev.InputDevice)          {}
+func (NopObserver) EventsRead(int)                                 {}
+func (NopObserver) ScrollEmitted()                                 {}
+func (NopObserver) EventDropped()                                  {}
+func (NopObserver) InputDropped(int)                               {}
+func (NopObserver) ScrollLatency(time.Duration)                    {}
+func (NopObserver) ModeChanged(*evdev.InputDevice, string)         {}
+func (NopObserver) MotionRead(*evdev.InputDevice, bool, int32)     {}
+func (NopObserver) ScrollSent(*evdev.InputDevice, bool, float64)   {}
+func (NopObserver) DeadZoneChecked(*evdev.InputDevice, bool, bool) {}
+
+// observers forwards each call to every Observer in the list
+type observers []Observer
+
+func (list observers) DeviceConnected(device *evdev.InputDevice) {
+	for _, o := range list {
+		o.DeviceConnected(device)
+	}
+}
+
+func (list observers) DeviceDisconnected(device *evdev.InputDevice) {
+	for _, o := range list {
+		o.DeviceDisconnected(device)
+	}
+}
+
+func (list observers) EventsRead(n int) {
+	for _, o := range list {
+		o.EventsRead(n)
+	}
+}
+
+func (list observers) ScrollEmitted() {
+	for _, o := range list {
+		o.ScrollEmitted()
+	}
+}
+
+func (list observers) EventDropped() {
+	for _, o := range list {
+		o.EventDropped()
+	}
+}
+
+func (list observers) InputDropped(n int) {
+	for _, o := range list {
+		o.InputDropped(n)
+	}
+}
+
+func (list observers) ScrollLatency(latency time.Duration) {
+	for _, o := range list {
+		o.ScrollLatency(latency)
+	}
+}
+
+func (list observers) ModeChanged(device *evdev.InputDevice, mode string) {
+	for _, o := range list {
+		o.ModeChanged(device, mode)
+	}
+}
+
+func (list observers) MotionRead(device *evdev.InputDevice, isHorizontal bool, delta int32) {
+	for _, o := range list {
+		o.MotionRead(device, isHorizontal, delta)
+	}
+}
+
+func (list observers) ScrollSent(device *evdev.InputDevice, isHorizontal bool, clicks float64) {
+	for _, o := range list {
+		o.ScrollSent(device, isHorizontal, clicks)
+	}
+}
+
+func (list observers) DeadZoneChecked(device *evdev.InputDevice, isHorizontal bool, suppressed bool) {
+	for _, o := range list {
+		o.DeadZoneChecked(device, isHorizontal, suppressed)
+	}
+}
+
+// ChordAction is passed to the observers that are ChordObservers
+func (list observers) ChordAction(device *evdev.InputDevice, action string) {
+	for _, o := range list {
+		if chords, ok := o.(ChordObserver); ok {
+			chords.ChordAction(device, action)
+		}
+	}
+}
+
+// Option customizes a Scroller built by NewScroller
+type Option func(*Scroller)
+
+// WithKeyboard suppresses scrolling right after typing on the watched
+// keyboard, for Config.PalmCheck
+func WithKeyboard(keyboard *KeyboardWatcher) Option {
+	return func(ts *Scroller) {
+		ts.keyboard = keyboard
+	}
+}
+
+// WithModifierKeyboard watches the keyboard whose keys are
+// Config.ScrollModifier and Config.HorizontalModifier
+func WithModifierKeyboard(keyboard *KeyboardWatcher) Option {
+	return func(ts *Scroller) {
+		ts.modifiers = keyboard
+	}
+}
+
+// WithDisplay scales sensitivity by the DPI of the monitor under the pointer
+func WithDisplay(display *DPIWatcher) Option {
+	return func(ts *Scroller) {
+		ts.display = display
+	}
+}
+
+// WithObserver adds an Observer. It can be given more than once
+func WithObserver(observer Observer) Option {
+	return func(ts *Scroller) {
+		ts.observers = append(ts.observers, observer)
+	}
+}
+
+// WithWriter sends events to writer instead of a new uinput device, e.g. to
+// drive a Scroller from tests
+func WithWriter(writer EventWriter) Option {
+	return func(ts *Scroller) {
+		ts.writer = writer
+	}
+}
@@ -0,0 +1,40 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// A panic while converting events must not leave the trackball grabbed, a
+// button held down or the virtual device behind. Fatal signals such as SIGKILL
+// can't be caught, but then the kernel closes our descriptors, which releases
+// the grab and destroys the virtual device just the same
+
+// recoverPanic turns a panic on the calling goroutine into an error in *errp,
+// letting go of any button the scroller holds down so Run can return and the
+// caller clean up as usual. Defer it directly
+func (ts *Scroller) recoverPanic(errp *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	slog.Error("Panic while converting events", "device", ts.Device().Name, "panic", r, "stack", string(debug.Stack()))
+	ts.setDragLock(false)
+	*errp = fmt.Errorf("panic: %v", r)
+}
+
+// cleanupOnPanic closes the scroller if a background goroutine panics, then
+// lets the panic carry on and end the process. Defer it directly
+func (ts *Scroller) cleanupOnPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	slog.Error("Panic in background task, releasing the device", "device", ts.Device().Name, "panic", r)
+	ts.setDragLock(false)
+	ts.Close()
+	panic(r)
+}
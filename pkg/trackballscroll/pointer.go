@@ -0,0 +1,18 @@
+package trackballscroll
+
+const DEFAULT_POINTER_SENSITIVITY = 1.0
+
+// pointerMotion scales ball motion passed through as pointer motion by the
+// PointerAccel profile and PointerSensitivity, carrying fractions of a count
+// into the next event so slow movement isn't lost
+func (ts *Scroller) pointerMotion(cfg *Config, isHorizontal bool, value int32) int32 {
+	if cfg.PointerSensitivity == 1 && (cfg.PointerAccel == "" || cfg.PointerAccel == ACCEL_LINEAR) {
+		return value
+	}
+
+	remainder := &ts.pointerRemainderY
+	if isHorizontal {
+		remainder = &ts.pointerRemainderX
+	}
+	return carry(remainder, shapeDelta(cfg.PointerAccel, cfg.AccelExponent, value)*cfg.PointerSensitivity)
+}
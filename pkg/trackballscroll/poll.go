@@ -0,0 +1,112 @@
+package trackballscroll
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const POLL_READ_EVENTS = 64 // events read from the device at once
+
+// errReadInterrupted is returned by pollReader.Read after interrupt
+var errReadInterrupted = errors.New("read interrupted")
+
+// pollReader reads events from a device through epoll, alongside a wake-up
+// pipe, so a pending read can be cut short on shutdown instead of blocking
+// until the ball next moves. Grabbing leaves the device fd in blocking mode,
+// which the runtime poller can't interrupt
+type pollReader struct {
+	fd     int
+	epfd   int
+	wake   [2]int // pipe written by interrupt
+	events []evdev.InputEvent
+	ready  []syscall.EpollEvent // one for the device, one for the pipe
+
+	mu     sync.Mutex // guards closed against interrupt
+	closed bool
+}
+
+func newPollReader(device *evdev.InputDevice) (*pollReader, error) {
+	r := &pollReader{
+		fd:     int(device.File.Fd()),
+		events: make([]evdev.InputEvent, POLL_READ_EVENTS),
+		ready:  make([]syscall.EpollEvent, 2),
+	}
+
+	var err error
+	if r.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, fmt.Errorf("failed to create epoll: %w", err)
+	}
+	if err := syscall.Pipe2(r.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(r.epfd)
+		return nil, fmt.Errorf("failed to create wake-up pipe: %w", err)
+	}
+
+	for _, fd := range []int{r.fd, r.wake[0]} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to poll %s: %w", device.Fn, err)
+		}
+	}
+
+	return r, nil
+}
+
+// Read waits for events and returns them. The slice is reused by the next
+// Read
+func (r *pollReader) Read() ([]evdev.InputEvent, error) {
+	for {
+		n, err := syscall.EpollWait(r.epfd, r.ready, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for events: %w", err)
+		}
+
+		for _, event := range r.ready[:n] {
+			if int(event.Fd) == r.wake[0] {
+				return nil, errReadInterrupted
+			}
+		}
+		if n > 0 {
+			break
+		}
+	}
+
+	eventSize := int(unsafe.Sizeof(evdev.InputEvent{}))
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&r.events[0])), len(r.events)*eventSize)
+	n, err := syscall.Read(r.fd, buf)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	return r.events[:n/eventSize], nil
+}
+
+// interrupt makes a pending or future Read return errReadInterrupted
+func (r *pollReader) interrupt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		syscall.Write(r.wake[1], []byte{0})
+	}
+}
+
+// Close frees the epoll and pipe fds. The device itself stays open
+func (r *pollReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	syscall.Close(r.wake[0])
+	syscall.Close(r.wake[1])
+	return syscall.Close(r.epfd)
+}
@@ -0,0 +1,193 @@
+package trackballscroll
+
+import (
+	"context"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const DEFAULT_QUEUE_SIZE = 0 // input batches buffered between reading and writing
+
+// Policies for Config.QueueFull, applied when the writer falls QueueSize
+// batches behind the reader
+const (
+	QUEUE_FULL_BLOCK       = "block"
+	QUEUE_FULL_DROP_OLDEST = "drop-oldest"
+)
+
+// pipeEvents reads on the calling goroutine and hands each batch to a single
+// writer goroutine through a channel of size batches, so a slow uinput write
+// never holds up draining the source device. When the channel is full the
+// reader waits for room or, with QUEUE_FULL_DROP_OLDEST, merges the queued
+// motion so only button changes are kept in full
+func (ts *Scroller) pipeEvents(ctx context.Context, reader DeviceReader, size int) error {
+	queue := make(chan []evdev.InputEvent, size)
+	free := newBatchPool(size)
+	done := make(chan struct{})
+	var writerErr error
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(&writerErr)
+		for events := range queue {
+			ts.handleEvents(events)
+			free.put(events)
+		}
+	}()
+
+	dropOldest := ts.Config().QueueFull == QUEUE_FULL_DROP_OLDEST
+	err := ts.readEvents(ctx, reader, func(events []evdev.InputEvent) error {
+		// The writer only stops early if it panicked
+		select {
+		case <-done:
+			return writerErr
+		default:
+		}
+
+		// The reader may reuse its buffer for the next read
+		batch := append(free.get(), events...)
+		if dropOldest {
+			ts.enqueueDroppingOldest(queue, free, batch)
+			return nil
+		}
+
+		select {
+		case queue <- batch:
+			return nil
+		case <-done:
+			return writerErr
+		}
+	})
+
+	close(queue)
+	<-done
+	if writerErr != nil {
+		return writerErr
+	}
+	return err
+}
+
+// enqueueDroppingOldest queues batch. If the queue is full it takes every
+// queued batch back, oldest first, and queues them with batch as one batch
+// whose motion is coalesced. Button changes and other non-EV_REL events are
+// never dropped; the EV_REL events merged away are counted as dropped input.
+// Only the reader sends, so the room made here stays free
+func (ts *Scroller) enqueueDroppingOldest(queue chan []evdev.InputEvent, free batchPool, batch []evdev.InputEvent) {
+	select {
+	case queue <- batch:
+		return
+	default:
+	}
+
+	merged := free.get()
+	for drained := false; !drained; {
+		select {
+		case oldest := <-queue:
+			merged = append(merged, oldest...)
+			free.put(oldest)
+		default:
+			drained = true
+		}
+	}
+	merged = append(merged, batch...)
+	free.put(batch)
+
+	coalesced := coalesceMotion(free.get(), merged)
+	if n := len(merged) - len(coalesced); n > 0 {
+		ts.droppedInput.Add(uint64(n))
+		ts.observers.InputDropped(n)
+	}
+	free.put(merged)
+	queue <- coalesced
+}
+
+// coalesceMotion appends events to dst with each run of reports that hold
+// only EV_REL events merged into one report, summing the values per code.
+// Reports with anything else in them, such as a button change, are kept as
+// they are and in order, so motion is never moved across a click
+func coalesceMotion(dst, events []evdev.InputEvent) []evdev.InputEvent {
+	var motion []evdev.InputEvent
+	var sync evdev.InputEvent
+	start := 0
+	for i, event := range events {
+		if event.Type != evdev.EV_SYN || event.Code != evdev.SYN_REPORT {
+			continue
+		}
+		report := events[start:i]
+		start = i + 1
+		if onlyMotion(report) {
+			motion = addMotion(motion, report)
+			sync = event
+			continue
+		}
+		dst = flushMotion(dst, motion, sync)
+		motion = motion[:0]
+		dst = append(dst, report...)
+		dst = append(dst, event)
+	}
+	dst = flushMotion(dst, motion, sync)
+	// A report left open at the end of the batch
+	return append(dst, events[start:]...)
+}
+
+// onlyMotion reports whether every event in report is EV_REL
+func onlyMotion(report []evdev.InputEvent) bool {
+	for _, event := range report {
+		if event.Type != evdev.EV_REL {
+			return false
+		}
+	}
+	return true
+}
+
+// addMotion sums report into motion, one event per code carrying the time of
+// the latest event summed into it
+func addMotion(motion, report []evdev.InputEvent) []evdev.InputEvent {
+next:
+	for _, event := range report {
+		for i := range motion {
+			if motion[i].Code == event.Code {
+				motion[i].Value += event.Value
+				motion[i].Time = event.Time
+				continue next
+			}
+		}
+		motion = append(motion, event)
+	}
+	return motion
+}
+
+// flushMotion appends the summed motion to dst as one report closed by sync
+func flushMotion(dst, motion []evdev.InputEvent, sync evdev.InputEvent) []evdev.InputEvent {
+	if len(motion) == 0 {
+		return dst
+	}
+	dst = append(dst, motion...)
+	return append(dst, sync)
+}
+
+// batchPool recycles the buffers batches are copied into, so a steady stream
+// of input doesn't allocate. It holds one more than the queue, for the batch
+// being handled
+type batchPool chan []evdev.InputEvent
+
+func newBatchPool(size int) batchPool {
+	return make(batchPool, size+1)
+}
+
+// get returns an empty buffer, allocating one only if none is free
+func (p batchPool) get() []evdev.InputEvent {
+	select {
+	case events := <-p:
+		return events[:0]
+	default:
+		return make([]evdev.InputEvent, 0, POLL_READ_EVENTS)
+	}
+}
+
+// put returns a buffer for reuse, dropping it if the pool is full
+func (p batchPool) put(events []evdev.InputEvent) {
+	select {
+	case p <- events:
+	default:
+	}
+}
@@ -0,0 +1,35 @@
+package trackballscroll
+
+import "time"
+
+// rateLimiter spaces scroll events at least 1/rate apart, so a fast spin
+// can't dump a burst of clicks into an application at once
+type rateLimiter struct {
+	lastAt time.Time
+}
+
+// allow reports whether an event at t fits within rate events per second,
+// recording it if so. A rate of 0 allows everything
+func (r *rateLimiter) allow(t time.Time, rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if !r.lastAt.IsZero() && t.Sub(r.lastAt) < time.Second/time.Duration(rate) {
+		return false
+	}
+	r.lastAt = t
+	return true
+}
+
+// clampScroll limits a scroll amount to ±limit clicks; 0 leaves it unlimited
+func clampScroll(scroll float64, limit float64) float64 {
+	switch {
+	case limit <= 0:
+		return scroll
+	case scroll > limit:
+		return limit
+	case scroll < -limit:
+		return -limit
+	}
+	return scroll
+}
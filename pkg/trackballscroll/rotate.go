@@ -0,0 +1,63 @@
+package trackballscroll
+
+import (
+	"math"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// rotation turns each frame's motion by Config.Rotation, for a trackball
+// mounted at an angle, before it is split into axes
+type rotation struct {
+	out        []evdev.InputEvent // reused buffer for the rotated batch
+	remainderX float64            // fractions of a count carried into the next frame
+	remainderY float64
+}
+
+// rotate returns events with the motion of each frame rotated clockwise by
+// cfg.Rotation degrees, like libinput's rotation. The result is only valid
+// until the next call
+func (r *rotation) rotate(cfg *Config, events []evdev.InputEvent) []evdev.InputEvent {
+	sin, cos := math.Sincos(cfg.Rotation * math.Pi / 180)
+	out := r.out[:0]
+
+	var x, y int32
+	var last evdev.InputEvent // the frame's last motion event, for its timestamp
+	moved := false
+	flush := func() {
+		if !moved {
+			return
+		}
+		rx := carry(&r.remainderX, float64(x)*cos-float64(y)*sin)
+		ry := carry(&r.remainderY, float64(x)*sin+float64(y)*cos)
+		if rx != 0 {
+			last.Code, last.Value = cfg.AxisXCode, rx
+			out = append(out, last)
+		}
+		if ry != 0 {
+			last.Code, last.Value = cfg.AxisYCode, ry
+			out = append(out, last)
+		}
+		x, y, moved = 0, 0, false
+	}
+
+	for _, event := range events {
+		switch {
+		case event.Type == evdev.EV_REL && event.Code == cfg.AxisXCode:
+			x += event.Value
+			last, moved = event, true
+		case event.Type == evdev.EV_REL && event.Code == cfg.AxisYCode:
+			y += event.Value
+			last, moved = event, true
+		case event.Type == evdev.EV_SYN && event.Code == evdev.SYN_REPORT:
+			flush()
+			out = append(out, event)
+		default:
+			out = append(out, event)
+		}
+	}
+	flush()
+
+	r.out = out
+	return out
+}
@@ -0,0 +1,233 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"go.starlark.net/starlark"
+)
+
+const (
+	SCRIPT_FUNCTION    = "event" // function a Config.Script defines
+	SCRIPT_MAX_STEPS   = 100000  // Starlark steps each event may take, so a runaway loop can't stall input
+	SCRIPT_RETRY_DELAY = time.Second
+)
+
+// scriptConstants are predeclared for a Config.Script, so it can name the
+// usual events instead of using numbers
+var scriptConstants = starlark.StringDict{
+	"EV_SYN":     starlark.MakeInt(evdev.EV_SYN),
+	"EV_KEY":     starlark.MakeInt(evdev.EV_KEY),
+	"EV_REL":     starlark.MakeInt(evdev.EV_REL),
+	"SYN_REPORT": starlark.MakeInt(evdev.SYN_REPORT),
+	"REL_X":      starlark.MakeInt(evdev.REL_X),
+	"REL_Y":      starlark.MakeInt(evdev.REL_Y),
+	"REL_WHEEL":  starlark.MakeInt(evdev.REL_WHEEL),
+	"REL_HWHEEL": starlark.MakeInt(evdev.REL_HWHEEL),
+	"BTN_LEFT":   starlark.MakeInt(evdev.BTN_LEFT),
+	"BTN_RIGHT":  starlark.MakeInt(evdev.BTN_RIGHT),
+	"BTN_MIDDLE": starlark.MakeInt(evdev.BTN_MIDDLE),
+	"BTN_SIDE":   starlark.MakeInt(evdev.BTN_SIDE),
+	"BTN_EXTRA":  starlark.MakeInt(evdev.BTN_EXTRA),
+}
+
+// script runs the Config.Script Starlark file on each input event, after
+// Config.Filter. The file defines event(ev, state): ev is a dict with the
+// event's "type", "code" and "value", its "time" in microseconds since the
+// epoch and "buttons", the codes of the buttons held before it, and state is
+// a dict the script can keep anything in between calls. It returns a list of
+// dicts with "type", "code", "value" and optionally "time" to use instead,
+// or None to pass the event on unchanged. If loading or running the script
+// fails, events pass through unchanged and it is loaded afresh after
+// SCRIPT_RETRY_DELAY
+type script struct {
+	mu       sync.Mutex
+	path     string // loaded script, "" if none
+	thread   *starlark.Thread
+	fn       starlark.Callable
+	state    *starlark.Dict
+	held     map[uint16]bool // buttons down in the input
+	failedAt time.Time
+	out      []evdev.InputEvent // reused buffer for the scripted batch
+}
+
+// CheckScript loads the Starlark file at path and checks that it defines
+// the event function, so a broken script is reported at startup
+func CheckScript(path string) error {
+	_, _, err := loadScript(path)
+	return err
+}
+
+// loadScript runs the file at path and returns a thread to call its event
+// function on
+func loadScript(path string) (*starlark.Thread, starlark.Callable, error) {
+	thread := &starlark.Thread{
+		Name: path,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.Info("Script", "script", path, "message", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(SCRIPT_MAX_STEPS)
+	globals, err := starlark.ExecFile(thread, path, nil, scriptConstants)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	fn, ok := globals[SCRIPT_FUNCTION].(starlark.Callable)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s doesn't define %s(ev, state)", path, SCRIPT_FUNCTION)
+	}
+	return thread, fn, nil
+}
+
+// apply returns events as changed by the script. The result is only valid
+// until the next call
+func (s *script) apply(cfg *Config, events []evdev.InputEvent) []evdev.InputEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path != cfg.Script && !s.load(cfg.Script) {
+		s.track(events)
+		return events
+	}
+	out, err := s.run(events)
+	if err != nil {
+		slog.Error("Script failed, passing events through until it is reloaded", "script", cfg.Script, "error", err)
+		s.path = ""
+		s.failedAt = time.Now()
+		s.track(events)
+		return events
+	}
+	return out
+}
+
+// load loads the script at path with fresh state, unless it failed too
+// recently
+func (s *script) load(path string) bool {
+	if time.Since(s.failedAt) < SCRIPT_RETRY_DELAY {
+		return false
+	}
+	thread, fn, err := loadScript(path)
+	if err != nil {
+		slog.Error("Failed to load script", "script", path, "error", err)
+		s.failedAt = time.Now()
+		return false
+	}
+	slog.Info("Loaded script", "script", path)
+	s.path, s.thread, s.fn, s.state = path, thread, fn, starlark.NewDict(0)
+	return true
+}
+
+// run calls the script's event function for each event and collects the
+// events it returns
+func (s *script) run(events []evdev.InputEvent) ([]evdev.InputEvent, error) {
+	out := s.out[:0]
+	for _, event := range events {
+		s.thread.Uncancel()
+		s.thread.SetMaxExecutionSteps(s.thread.ExecutionSteps() + SCRIPT_MAX_STEPS)
+		result, err := starlark.Call(s.thread, s.fn, starlark.Tuple{s.eventDict(event), s.state}, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.track([]evdev.InputEvent{event})
+
+		if result == starlark.None {
+			out = append(out, event)
+			continue
+		}
+		list, ok := result.(starlark.Indexable)
+		if !ok {
+			return nil, fmt.Errorf("%s returned %s, want a list of events or None", SCRIPT_FUNCTION, result.Type())
+		}
+		for i := 0; i < list.Len(); i++ {
+			scripted, err := scriptEvent(list.Index(i), event)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, scripted)
+		}
+	}
+
+	s.out = out
+	return out, nil
+}
+
+// eventDict returns event as the dict the script gets
+func (s *script) eventDict(event evdev.InputEvent) *starlark.Dict {
+	buttons := make([]int, 0, len(s.held))
+	for code := range s.held {
+		buttons = append(buttons, int(code))
+	}
+	sort.Ints(buttons)
+	held := make([]starlark.Value, len(buttons))
+	for i, code := range buttons {
+		held[i] = starlark.MakeInt(code)
+	}
+
+	dict := starlark.NewDict(5)
+	dict.SetKey(starlark.String("type"), starlark.MakeInt(int(event.Type)))
+	dict.SetKey(starlark.String("code"), starlark.MakeInt(int(event.Code)))
+	dict.SetKey(starlark.String("value"), starlark.MakeInt(int(event.Value)))
+	dict.SetKey(starlark.String("time"), starlark.MakeInt64(eventTime(event).UnixMicro()))
+	dict.SetKey(starlark.String("buttons"), starlark.NewList(held))
+	return dict
+}
+
+// scriptEvent converts an event the script returned in answer to event
+func scriptEvent(value starlark.Value, event evdev.InputEvent) (evdev.InputEvent, error) {
+	dict, ok := value.(*starlark.Dict)
+	if !ok {
+		return evdev.InputEvent{}, fmt.Errorf("%s returned %s in its list, want a dict", SCRIPT_FUNCTION, value.Type())
+	}
+	scripted := evdev.InputEvent{Time: event.Time}
+	fields := []struct {
+		name string
+		ptr  interface{}
+	}{
+		{"type", &scripted.Type},
+		{"code", &scripted.Code},
+		{"value", &scripted.Value},
+	}
+	for _, field := range fields {
+		v, found, err := dict.Get(starlark.String(field.name))
+		if err != nil {
+			return evdev.InputEvent{}, err
+		}
+		if !found {
+			return evdev.InputEvent{}, fmt.Errorf("%s returned an event without %q", SCRIPT_FUNCTION, field.name)
+		}
+		if err := starlark.AsInt(v, field.ptr); err != nil {
+			return evdev.InputEvent{}, fmt.Errorf("invalid %q in event: %w", field.name, err)
+		}
+	}
+
+	if v, found, _ := dict.Get(starlark.String("time")); found {
+		var micros int64
+		if err := starlark.AsInt(v, &micros); err != nil {
+			return evdev.InputEvent{}, fmt.Errorf("invalid \"time\" in event: %w", err)
+		}
+		scripted.Time = syscall.NsecToTimeval(micros * int64(time.Microsecond))
+	}
+	return scripted, nil
+}
+
+// track follows which buttons are held in the input
+func (s *script) track(events []evdev.InputEvent) {
+	for _, event := range events {
+		if event.Type != evdev.EV_KEY {
+			continue
+		}
+		if s.held == nil {
+			s.held = make(map[uint16]bool)
+		}
+		if event.Value == 0 {
+			delete(s.held, event.Code)
+		} else {
+			s.held[event.Code] = true
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package trackballscroll
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// writeScript saves source as a script file and returns its path
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.star")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		batches [][]evdev.InputEvent
+		want    [][]out
+	}{
+		{
+			name: "pass through",
+			source: `
+def event(ev, state):
+    return None
+`,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name: "change",
+			source: `
+def event(ev, state):
+    if ev["type"] == EV_REL and ev["code"] == REL_Y:
+        return [{"type": EV_REL, "code": REL_Y, "value": -2 * ev["value"]}]
+    return [ev]
+`,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(-6)}},
+		},
+		{
+			name: "drop while a button is held",
+			source: `
+def event(ev, state):
+    if ev["type"] == EV_REL and BTN_SIDE in ev["buttons"]:
+        return []
+    return None
+`,
+			batches: [][]evdev.InputEvent{
+				batch(0, key(0, evdev.BTN_SIDE, 1)),
+				batch(10, rel(10, REL_Y, 5)),
+				batch(20, key(20, evdev.BTN_SIDE, 0)),
+				batch(30, rel(30, REL_Y, 5)),
+			},
+			want: [][]out{
+				{button(evdev.BTN_SIDE, 1)},
+				{button(evdev.BTN_SIDE, 0)},
+				{wheel(5)},
+			},
+		},
+		{
+			name: "state kept between events",
+			source: `
+def event(ev, state):
+    if ev["type"] != EV_REL:
+        return None
+    state["n"] = state.get("n", 0) + 1
+    return [{"type": ev["type"], "code": ev["code"], "value": ev["value"] * state["n"]}]
+`,
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 1)),
+				batch(10, rel(10, REL_Y, 1)),
+			},
+			want: [][]out{{wheel(1)}, {wheel(2)}},
+		},
+		{
+			name: "error passes events through",
+			source: `
+def event(ev, state):
+    return [{"type": ev["type"]}]
+`,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name: "runaway loop is stopped",
+			source: `
+def event(ev, state):
+    for i in range(1000000000):
+        pass
+`,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(3)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Script = writeScript(t, test.source)
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{name: "valid", source: "def event(ev, state):\n    return None\n"},
+		{name: "syntax error", source: "def event(ev, state)\n", wantErr: "failed to load"},
+		{name: "no event function", source: "x = 1\n", wantErr: "doesn't define event"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckScript(writeScript(t, test.source))
+			if test.wantErr == "" && err != nil {
+				t.Errorf("CheckScript: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("CheckScript = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
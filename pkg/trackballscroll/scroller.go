@@ -0,0 +1,1082 @@
+package trackballscroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const (
+	DEFAULT_SENSITIVITY   = 0.3
+	DEFAULT_DEAD_ZONE     = 2
+	DEFAULT_DOUBLE_TAP_MS = 300
+	DEVICE_SETUP_DELAY    = 100 * time.Millisecond
+	SMOOTH_EMIT_RATE      = 120 // ticks per second in smooth-emit mode
+	SMOOTH_EMIT_SPREAD    = 4   // ticks over which a burst of scroll is spread
+
+	VELOCITY_RESET_GAP         = 100 * time.Millisecond // pause after which a new gesture starts
+	ANTI_OVERSHOOT_DECEL_RATIO = 0.5                    // velocity drop that counts as a sharp deceleration
+	ANTI_OVERSHOOT_ATTENUATION = 0.5                    // scale applied to scroll while decelerating sharply
+
+	WRITE_RETRY_DEADLINE = 10 * time.Millisecond // how long WRITE_FULL_RETRY keeps trying
+	WRITE_RETRY_INTERVAL = time.Millisecond
+	WRITE_FAILURE_LIMIT  = 50 // frames in a row that fail before the virtual device is recreated
+)
+
+// Policies for Config.WriteFull, applied when a write to /dev/uinput would block
+const (
+	WRITE_FULL_DROP  = "drop"
+	WRITE_FULL_BLOCK = "block"
+	WRITE_FULL_RETRY = "retry"
+)
+
+// DeadZoneStats counts motion events on one axis that the dead zone
+// suppressed versus let through
+type DeadZoneStats struct {
+	Suppressed uint64 `json:"suppressed"`
+	Passed     uint64 `json:"passed"`
+}
+
+// deadZoneCounter is DeadZoneStats as it is counted on the event goroutine
+// and read from others
+type deadZoneCounter struct {
+	suppressed atomic.Uint64
+	passed     atomic.Uint64
+}
+
+func (c *deadZoneCounter) stats() DeadZoneStats {
+	return DeadZoneStats{Suppressed: c.suppressed.Load(), Passed: c.passed.Load()}
+}
+
+// velocityTracker estimates ball speed on one axis from event timestamps
+type velocityTracker struct {
+	lastAt   time.Time
+	velocity float64 // counts per second
+}
+
+// update records motion at t and returns the previous and current velocity
+func (v *velocityTracker) update(t time.Time, value int32) (float64, float64) {
+	prev := v.velocity
+	dt := t.Sub(v.lastAt)
+
+	switch {
+	case v.lastAt.IsZero() || dt > VELOCITY_RESET_GAP:
+		v.velocity = 0
+	case dt > 0:
+		v.velocity = float64(abs(value)) / dt.Seconds()
+	}
+
+	v.lastAt = t
+	return prev, v.velocity
+}
+
+// intentGate holds back scrolling until the rolling sum of recent motion
+// magnitudes shows deliberate intent, then lets the rest of the gesture through
+type intentGate struct {
+	window []int32 // ring buffer of recent magnitudes
+	next   int
+	sum    int32
+	open   bool
+	lastAt time.Time
+}
+
+func newIntentGate(size int) *intentGate {
+	return &intentGate{window: make([]int32, size)}
+}
+
+func (g *intentGate) reset() {
+	for i := range g.window {
+		g.window[i] = 0
+	}
+	g.next = 0
+	g.sum = 0
+	g.open = false
+	g.lastAt = time.Time{}
+}
+
+// observe records one motion event and reports whether scrolling is allowed
+func (g *intentGate) observe(t time.Time, magnitude int32, threshold int32) bool {
+	if !g.lastAt.IsZero() && t.Sub(g.lastAt) > VELOCITY_RESET_GAP {
+		g.reset()
+	}
+	g.lastAt = t
+
+	if g.open {
+		return true
+	}
+
+	g.sum += magnitude - g.window[g.next]
+	g.window[g.next] = magnitude
+	g.next = (g.next + 1) % len(g.window)
+	g.open = g.sum >= threshold
+	return g.open
+}
+
+// Scroller manages trackball input conversion to scroll events
+type Scroller struct {
+	device atomic.Pointer[evdev.InputDevice] // replaced by runScroller on reconnect
+
+	writer        EventWriter            // the virtual device; nil in a dry run. Guarded by frame.mu
+	pointerWriter EventWriter            // the pointer device with Config.SplitDevices, writer being the scroll one. Guarded by frame.mu
+	ownsWriter    bool                   // writer is a uinput device created here, so it can be recreated
+	cfg           atomic.Pointer[Config] // swapped as a whole on reload
+
+	lastButtonAt time.Time // timestamp of the most recent EV_KEY event
+	scrollHeld   bool      // whether cfg.ScrollButton is currently pressed
+	zoomHeld     bool      // whether cfg.ZoomButton is currently pressed
+	lastTapAt    time.Time // previous press of cfg.ToggleButton, zero after a double-tap
+	lastMotionAt time.Time // timestamp of the most recent ball motion, for cfg.ScrollAfterIdle
+	idleEngaged  bool      // whether cfg.ScrollAfterIdle has the ball scrolling until a click
+
+	deadZoneX deadZoneCounter
+	deadZoneY deadZoneCounter
+
+	velocityX velocityTracker
+	velocityY velocityTracker
+
+	ballisticsX ballistics
+	ballisticsY ballistics
+
+	smoothX emaFilter
+	smoothY emaFilter
+
+	rateLimit rateLimiter
+
+	// Hi-res motion not yet turned into a discrete click
+	hiResX int32
+	hiResY int32
+
+	// Fraction of a scroll click not yet emitted, carried into the next event
+	remainderX float64
+	remainderY float64
+
+	// The same for the source device's own wheel
+	wheelRemainderX float64
+	wheelRemainderY float64
+
+	// And for ball travel sent as key presses
+	keyRemainderX float64
+	keyRemainderY float64
+
+	// And for pointer motion scaled by PointerSensitivity
+	pointerRemainderX float64
+	pointerRemainderY float64
+
+	droppedEvents atomic.Uint64 // frames discarded because uinput was full or failed
+	droppedInput  atomic.Uint64 // input events discarded because the queue was full
+	lastEventAt   atomic.Int64  // unix nanoseconds of the last read from the device
+	recheck       chan struct{} // signalled by CheckDevice
+
+	intent    *intentGate
+	kinetic   kineticState
+	axisLock  axisLock
+	axisSnap  axisSnap
+	rotation  rotation
+	filter    filter
+	script    script
+	softStart softStart
+	circular  circularScroll
+	chords    chorder
+	keyboard  *KeyboardWatcher // set by WithKeyboard
+	modifiers *KeyboardWatcher // set by WithModifierKeyboard
+	display   *DPIWatcher      // set by WithDisplay
+	observers observers
+
+	paused     atomic.Bool            // device released and events ignored
+	idle       atomic.Bool            // device released by runIdleUngrab until the next event
+	dragLocked atomic.Bool            // BTN_LEFT held down by cfg.DragLockButton
+	mode       atomic.Pointer[string] // the MODE_* set by SetMode; nil for cfg.defaultMode()
+
+	frame     frameWriter
+	closeOnce sync.Once
+
+	// Scroll accumulated for the smooth-emit ticker, guarded by pendingMu
+	pendingMu sync.Mutex
+	pendingX  int32
+	pendingY  int32
+}
+
+// NewScroller converts events from device into scroll events on a new uinput
+// virtual device, or on the writer given with WithWriter. The device should
+// already be grabbed unless cfg.DryRun or cfg.Overlay is set
+func NewScroller(device *evdev.InputDevice, cfg Config, options ...Option) (*Scroller, error) {
+	ts := &Scroller{
+		intent:  newIntentGate(cfg.IntentWindow),
+		recheck: make(chan struct{}, 1),
+	}
+	ts.device.Store(device)
+	for _, option := range options {
+		option(ts)
+	}
+
+	if ts.writer == nil && !cfg.DryRun {
+		writer, pointerWriter, err := ts.createVirtualDevices(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ts.writer, ts.pointerWriter, ts.ownsWriter = writer, pointerWriter, true
+	}
+
+	ts.cfg.Store(&cfg)
+	ts.lastEventAt.Store(time.Now().UnixNano())
+
+	return ts, nil
+}
+
+// createVirtualDevices creates the uinput device events are written to, or
+// with cfg.SplitDevices a scroll device and then a pointer device. The second
+// writer is nil unless the device is split
+func (ts *Scroller) createVirtualDevices(cfg Config) (EventWriter, EventWriter, error) {
+	if !cfg.SplitDevices {
+		writer, err := ts.createVirtualDevice(cfg, DEVICE_PART_ALL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return writer, nil, nil
+	}
+
+	scroll, err := ts.createVirtualDevice(cfg, DEVICE_PART_SCROLL)
+	if err != nil {
+		return nil, nil, err
+	}
+	pointer, err := ts.createVirtualDevice(cfg, DEVICE_PART_POINTER)
+	if err != nil {
+		scroll.Close()
+		return nil, nil, err
+	}
+	return scroll, pointer, nil
+}
+
+// createVirtualDevice creates a uinput device for part of the events
+func (ts *Scroller) createVirtualDevice(cfg Config, part int) (*uinputWriter, error) {
+	device := ts.Device()
+	phys := fmt.Sprintf("%s%d/%s/%s", VIRTUAL_PHYS_PREFIX, os.Getpid(), filepath.Base(device.Fn), DeviceSeat(device.Fn))
+	identity := cfg.Identity
+	if cfg.CloneIdentity {
+		identity = cloneIdentity(device, identity)
+	}
+	virtualFd, err := createVirtualDevice(cfg, identity, phys, part)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create virtual device: %w", err)
+	}
+	return newUinputWriter(virtualFd), nil
+}
+
+// Run converts events until ctx is done or the device fails. With
+// Config.Reconnect an unplugged device is replaced once it comes back
+func (ts *Scroller) Run(ctx context.Context) error {
+	// Background emitters stop with Run even if ctx lives on
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cfg := ts.Config()
+
+	if cfg.SmoothEmit {
+		go ts.runSmoothEmitter(ctx)
+	}
+	if cfg.Kinetic {
+		go ts.runKinetic(ctx)
+	}
+	if cfg.IdleUngrab > 0 && cfg.grabs() {
+		go ts.runIdleUngrab(ctx)
+	}
+
+	return runScroller(ctx, ts, cfg.DevicePath, cfg.Detect, cfg.Reconnect)
+}
+
+// Device returns the input device currently being converted
+func (ts *Scroller) Device() *evdev.InputDevice {
+	return ts.device.Load()
+}
+
+func (ts *Scroller) sendScrollEvent(isHorizontal bool, value int32) error {
+	code := uint16(REL_WHEEL)
+	if isHorizontal {
+		code = uint16(REL_HWHEEL)
+	}
+
+	if err := ts.sendEvent(EV_REL, code, value); err != nil {
+		return err
+	}
+	ts.observers.ScrollEmitted()
+	ts.observers.ScrollSent(ts.Device(), isHorizontal, float64(value))
+	return nil
+}
+
+// sendPointerEvent forwards ball motion as pointer motion
+func (ts *Scroller) sendPointerEvent(isHorizontal bool, value int32) error {
+	code := uint16(REL_Y)
+	if isHorizontal {
+		code = uint16(REL_X)
+	}
+
+	return ts.sendEvent(EV_REL, code, value)
+}
+
+// sendButtonEvent forwards a physical button press or release
+func (ts *Scroller) sendButtonEvent(code uint16, value int32) error {
+	return ts.sendEvent(EV_KEY, code, value)
+}
+
+// forwardButton passes a physical button event on to the virtual device,
+// remapped if ButtonMap says so
+func (ts *Scroller) forwardButton(code uint16, value int32) {
+	if outputs, ok := ts.Config().ButtonMap[code]; ok {
+		ts.sendMappedButton(outputs, value)
+	} else if code >= BTN_LEFT && code <= BTN_TASK {
+		ts.sendButtonEvent(code, value)
+	}
+}
+
+// sendMappedButton presses the keys a button is remapped to in order, or
+// releases them in reverse. Key repeats are ignored
+func (ts *Scroller) sendMappedButton(keys []uint16, value int32) error {
+	if len(keys) == 0 || value > 1 {
+		return nil
+	}
+
+	events := make([]InputEvent, len(keys))
+	for i, key := range keys {
+		if value == 0 {
+			key = keys[len(keys)-1-i]
+		}
+		events[i] = InputEvent{Type: EV_KEY, Code: key, Value: value}
+	}
+	return ts.sendFrame(events)
+}
+
+// sendZoomEvent sends a wheel event with Ctrl held down, which zooms in most
+// browsers and image editors
+func (ts *Scroller) sendZoomEvent(value int32) error {
+	if err := ts.sendEvent(EV_KEY, KEY_LEFTCTRL, 1); err != nil {
+		return err
+	}
+	err := ts.sendScrollEvent(false, value)
+	if releaseErr := ts.sendEvent(EV_KEY, KEY_LEFTCTRL, 0); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// sendHiResScroll emits a high-resolution wheel event, plus a discrete click
+// whenever the accumulated hi-res motion crosses a full notch
+func (ts *Scroller) sendHiResScroll(isHorizontal bool, value int32) error {
+	if value == 0 {
+		return nil
+	}
+
+	code, hiResCode, pending := uint16(REL_WHEEL), uint16(REL_WHEEL_HI_RES), &ts.hiResY
+	if isHorizontal {
+		code, hiResCode, pending = uint16(REL_HWHEEL), uint16(REL_HWHEEL_HI_RES), &ts.hiResX
+	}
+
+	*pending += value
+	clicks := *pending / HI_RES_PER_NOTCH
+	*pending -= clicks * HI_RES_PER_NOTCH
+
+	events := []InputEvent{{Type: EV_REL, Code: hiResCode, Value: value}}
+	if clicks != 0 {
+		events = append(events, InputEvent{Type: EV_REL, Code: code, Value: clicks})
+	}
+	if err := ts.sendFrame(events); err != nil {
+		return err
+	}
+	ts.observers.ScrollEmitted()
+	ts.observers.ScrollSent(ts.Device(), isHorizontal, float64(value)/HI_RES_PER_NOTCH)
+	return nil
+}
+
+// sendEvent writes a single event followed by a sync report
+func (ts *Scroller) sendEvent(evType uint16, code uint16, value int32) error {
+	return ts.sendFrame([]InputEvent{{Type: evType, Code: code, Value: value}})
+}
+
+// Close destroys the virtual device and releases the input device. Only the
+// first call does anything
+func (ts *Scroller) Close() {
+	ts.closeOnce.Do(func() {
+		ts.filter.close()
+		ts.frame.mu.Lock()
+		ts.closeWriters()
+		ts.frame.mu.Unlock()
+
+		if device := ts.Device(); device != nil {
+			device.Release()
+		}
+	})
+}
+
+// processEvents reads events from reader and handles them until ctx is done
+// or the read fails, through a queue if Config.QueueSize is set. A panic
+// while handling events ends it with an error
+func (ts *Scroller) processEvents(ctx context.Context, reader DeviceReader) (err error) {
+	defer ts.recoverPanic(&err)
+
+	if size := ts.Config().QueueSize; size > 0 {
+		return ts.pipeEvents(ctx, reader, size)
+	}
+	return ts.readEvents(ctx, reader, func(events []evdev.InputEvent) error {
+		ts.handleEvents(events)
+		return nil
+	})
+}
+
+// readEvents passes each batch read from reader to handle until ctx is done
+// or the read or handle fails
+func (ts *Scroller) readEvents(ctx context.Context, reader DeviceReader, handle func([]evdev.InputEvent) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		events, err := reader.Read()
+		if errors.Is(err, errReadInterrupted) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading events: %w", err)
+		}
+		ts.lastEventAt.Store(time.Now().UnixNano())
+		ts.observers.EventsRead(len(events))
+
+		if err := handle(events); err != nil {
+			return err
+		}
+	}
+}
+
+func (ts *Scroller) handleEvents(events []evdev.InputEvent) {
+	if ts.paused.Load() || len(events) == 0 {
+		return
+	}
+	if ts.idle.Load() {
+		ts.wake()
+		return
+	}
+
+	// Everything the batch scrolls goes out as one frame, stamped with the
+	// time of its last event, the sync report the kernel closes it with
+	ts.beginBatch(events[len(events)-1].Time)
+	defer ts.endBatch()
+
+	cfg := ts.Config()
+	if cfg.Filter != "" {
+		events = ts.filter.apply(cfg, events)
+	}
+	if cfg.Script != "" {
+		events = ts.script.apply(cfg, events)
+	}
+	if cfg.Rotation != 0 {
+		events = ts.rotation.rotate(cfg, events)
+	}
+	for _, event := range events {
+		t := eventTime(event)
+		if event.Type == evdev.EV_SYN && event.Code == evdev.SYN_DROPPED {
+			ts.intent.reset()
+			continue
+		}
+
+		if event.Type == evdev.EV_SYN && event.Code == evdev.SYN_REPORT && cfg.Circular {
+			ts.emitCircular(cfg, t)
+			continue
+		}
+
+		if event.Type == evdev.EV_KEY {
+			if cfg.ToggleButton != 0 && event.Code == cfg.ToggleButton {
+				if event.Value == 1 {
+					ts.tapToggle(t, cfg.DoubleTap)
+				}
+				if event.Code != cfg.ScrollButton {
+					continue
+				}
+			}
+			if cfg.ScrollButton != 0 && event.Code == cfg.ScrollButton {
+				ts.scrollHeld = event.Value != 0
+				continue
+			}
+			if cfg.MediaButton != 0 && event.Code == cfg.MediaButton {
+				if event.Value == 1 {
+					ts.SetMedia(!ts.Media())
+				}
+				continue
+			}
+			if cfg.ModeButton != 0 && event.Code == cfg.ModeButton {
+				if event.Value == 1 {
+					ts.CycleMode()
+				}
+				continue
+			}
+			if cfg.DragLockButton != 0 && event.Code == cfg.DragLockButton {
+				if event.Value == 1 {
+					ts.setDragLock(!ts.dragLocked.Load())
+				}
+				continue
+			}
+			if cfg.ZoomButton != 0 && event.Code == cfg.ZoomButton {
+				ts.zoomHeld = event.Value != 0
+				continue
+			}
+			ts.lastButtonAt = t
+			if event.Value == 1 {
+				ts.disengageAfterIdle()
+			}
+			if cfg.Overlay {
+				// The system already has the button
+				continue
+			}
+			if len(cfg.Chords) > 0 && ts.chords.handle(ts, cfg.Chords, cfg.ChordWindow, event.Code, event.Value) {
+				continue
+			}
+			ts.forwardButton(event.Code, event.Value)
+			continue
+		}
+
+		if event.Type != evdev.EV_REL {
+			continue
+		}
+
+		var isHorizontal, invert bool
+
+		switch event.Code {
+		case cfg.AxisXCode:
+			isHorizontal, invert = true, cfg.InvertX
+		case cfg.AxisYCode:
+			isHorizontal, invert = false, cfg.InvertY
+		case REL_WHEEL, REL_HWHEEL:
+			if !cfg.Overlay {
+				ts.passWheel(cfg, event)
+			}
+			continue
+		default:
+			continue
+		}
+		ts.observers.MotionRead(ts.Device(), isHorizontal, event.Value)
+
+		mode := ts.Mode()
+		if cfg.ScrollAfterIdle > 0 && mode == MODE_POINTER {
+			ts.engageAfterIdle(t, cfg.ScrollAfterIdle)
+		}
+		if mode == MODE_POINTER && !ts.scrollHeld && !ts.zoomHeld && !ts.idleEngaged && !ts.modifierHeld(cfg.ScrollModifier) {
+			if cfg.Overlay {
+				continue
+			}
+			if motion := ts.pointerMotion(cfg, isHorizontal, event.Value); motion != 0 {
+				ts.sendPointerEvent(isHorizontal, motion)
+			}
+			continue
+		}
+
+		if cfg.SwapAxes && !cfg.Circular {
+			// Only straight scrolling is swapped: pointer motion went through
+			// above, and swapping would reverse the direction of circling
+			isHorizontal = !isHorizontal
+			invert = cfg.InvertY
+			if isHorizontal {
+				invert = cfg.InvertX
+			}
+		}
+
+		if ts.modifierHeld(cfg.HorizontalModifier) {
+			// Like Shift with a wheel: the ball's vertical motion scrolls
+			// sideways, in the direction set for vertical scrolling, and its
+			// sideways motion is ignored
+			if isHorizontal {
+				continue
+			}
+			isHorizontal = true
+		}
+
+		if cfg.Circular {
+			ts.circular.add(isHorizontal, event.Value)
+			continue
+		}
+
+		ratchet := cfg.NotchCounts > 0
+		var scroll float64
+		if ratchet {
+			// Exactly one click per NotchCounts of raw travel, which none of
+			// the shaping below may scale
+			scroll = float64(event.Value) / float64(cfg.NotchCounts)
+		} else {
+			delta := accelerate(cfg, event.Value)
+			if cfg.Smoothing > 0 {
+				smooth := &ts.smoothY
+				if isHorizontal {
+					smooth = &ts.smoothX
+				}
+				delta = smooth.filter(t, delta, cfg.Smoothing)
+			}
+
+			scroll = delta * ts.sensitivity(isHorizontal)
+			if cfg.Ballistics {
+				speed := &ts.ballisticsY
+				if isHorizontal {
+					speed = &ts.ballisticsX
+				}
+				scroll *= ballisticGain(cfg, speed.speed(t, event.Value))
+			}
+		}
+		if invert {
+			scroll = -scroll
+		}
+
+		if cfg.Kinetic {
+			ts.kinetic.touch()
+		}
+
+		stats, velocity := &ts.deadZoneY, &ts.velocityY
+		if isHorizontal {
+			stats, velocity = &ts.deadZoneX, &ts.velocityX
+		}
+		prevVelocity, curVelocity := velocity.update(t, event.Value)
+
+		if ts.inClickCooldown(t) {
+			continue
+		}
+
+		if ts.inPalmCheck(t) {
+			continue
+		}
+
+		if cfg.IntentThreshold > 0 && !ts.intent.observe(t, abs(event.Value), cfg.IntentThreshold) {
+			continue
+		}
+
+		if cfg.AxisLock && !ts.axisLock.allow(isHorizontal, event.Value, t, cfg.AxisLockTimeout) {
+			continue
+		}
+
+		if cfg.AxisSnapRatio > 0 && !ts.axisSnap.allow(isHorizontal, event.Value, t, cfg.AxisSnapRatio) {
+			continue
+		}
+
+		if !ratchet {
+			deadZone := cfg.DeadZoneY
+			if isHorizontal {
+				deadZone = cfg.DeadZoneX
+			}
+
+			suppressed := abs(event.Value) <= deadZone
+			ts.observers.DeadZoneChecked(ts.Device(), isHorizontal, suppressed)
+			if suppressed {
+				stats.suppressed.Add(1)
+				continue
+			}
+			stats.passed.Add(1)
+
+			if cfg.SoftStart > 0 {
+				scroll *= ts.softStart.factor(t, cfg.SoftStart)
+			}
+
+			if cfg.AntiOvershoot && curVelocity < prevVelocity*ANTI_OVERSHOOT_DECEL_RATIO {
+				scroll *= ANTI_OVERSHOOT_ATTENUATION
+			}
+			scroll = clampScroll(scroll, cfg.MaxScrollStep)
+		}
+
+		if ts.zoomHeld || (mode == MODE_ZOOM && !ts.scrollHeld) {
+			if isHorizontal {
+				continue
+			}
+			zoomValue := ts.accumulate(false, scroll)
+			if zoomValue != 0 && ts.rateLimit.allow(t, cfg.MaxScrollRate) {
+				if cfg.DryRun {
+					printDryRun(false, "zoom", zoomValue, event.Value)
+				}
+				ts.sendZoomEvent(zoomValue)
+				ts.observers.ScrollLatency(time.Since(t))
+			}
+			continue
+		}
+
+		if output, keys, ok := cfg.scrollKeys(mode, isHorizontal); ok {
+			ts.scrollWithKeys(cfg, output, keys, isHorizontal, scroll, event.Value, t)
+			continue
+		}
+
+		if cfg.Kinetic {
+			ts.kinetic.observe(isHorizontal, scroll)
+		}
+
+		if cfg.HiRes && !ratchet {
+			if ts.rateLimit.allow(t, cfg.MaxScrollRate) {
+				hiRes := int32(math.Round(scroll * HI_RES_PER_NOTCH))
+				if cfg.DryRun {
+					printDryRun(isHorizontal, "hi-res", hiRes, event.Value)
+				}
+				ts.sendHiResScroll(isHorizontal, hiRes)
+				ts.observers.ScrollLatency(time.Since(t))
+			}
+			continue
+		}
+
+		scrollValue := ts.accumulate(isHorizontal, scroll)
+		if scrollValue != 0 && ts.rateLimit.allow(t, cfg.MaxScrollRate) {
+			if cfg.DryRun {
+				printDryRun(isHorizontal, "scroll", scrollValue, event.Value)
+			}
+			ts.queueScroll(isHorizontal, scrollValue)
+			ts.observers.ScrollLatency(time.Since(t))
+		}
+	}
+}
+
+// setDragLock presses or releases BTN_LEFT on behalf of drag lock
+func (ts *Scroller) setDragLock(locked bool) {
+	if ts.dragLocked.Swap(locked) == locked {
+		return
+	}
+
+	value := int32(0)
+	if locked {
+		value = 1
+	}
+	ts.sendButtonEvent(BTN_LEFT, value)
+}
+
+// tapToggle records a press of the toggle button at t, switching between
+// scrolling and pointer motion if it follows the previous press within window
+func (ts *Scroller) tapToggle(t time.Time, window time.Duration) {
+	if ts.lastTapAt.IsZero() || t.Sub(ts.lastTapAt) > window {
+		ts.lastTapAt = t
+		return
+	}
+
+	ts.lastTapAt = time.Time{}
+	if ts.Mode() == MODE_POINTER {
+		ts.SetMode(MODE_SCROLL)
+	} else {
+		ts.SetMode(MODE_POINTER)
+	}
+}
+
+// engageAfterIdle records ball motion at t, switching to scrolling if the
+// ball had been still for at least idle before it
+func (ts *Scroller) engageAfterIdle(t time.Time, idle time.Duration) {
+	if !ts.idleEngaged && (ts.lastMotionAt.IsZero() || t.Sub(ts.lastMotionAt) >= idle) {
+		ts.idleEngaged = true
+		slog.Debug("Scrolling after idle until the next click", "device", ts.Device().Name)
+	}
+	ts.lastMotionAt = t
+}
+
+// disengageAfterIdle goes back to moving the pointer on a click
+func (ts *Scroller) disengageAfterIdle() {
+	if ts.idleEngaged {
+		ts.idleEngaged = false
+		slog.Debug("Moving the pointer again after a click", "device", ts.Device().Name)
+	}
+}
+
+// emitCircular scrolls by the rotation of the frame ending at t
+func (ts *Scroller) emitCircular(cfg *Config, t time.Time) {
+	clicks := ts.circular.frame(t, cfg.CircularDegrees)
+	if clicks == 0 || !ts.rateLimit.allow(t, cfg.MaxScrollRate) {
+		return
+	}
+
+	// Clockwise scrolls down, which is a negative wheel value
+	if cfg.DryRun {
+		printDryRun(false, "circular", -clicks, 0)
+	}
+	ts.sendScrollEvent(false, -clicks)
+	ts.observers.ScrollLatency(time.Since(t))
+}
+
+// printDryRun prints a scroll event that a dry run would otherwise have sent,
+// along with the device delta it came from
+func printDryRun(isHorizontal bool, kind string, value int32, delta int32) {
+	axis := "Y"
+	if isHorizontal {
+		axis = "X"
+	}
+	fmt.Printf("%s %s %+d (delta %+d)\n", axis, kind, value, delta)
+}
+
+// accumulate adds scroll to the axis's carried remainder and returns the
+// whole clicks ready to emit, so slow movement below one click isn't lost.
+// Reversing direction drops the remainder so the turn-around isn't delayed
+func (ts *Scroller) accumulate(isHorizontal bool, scroll float64) int32 {
+	remainder := &ts.remainderY
+	if isHorizontal {
+		remainder = &ts.remainderX
+	}
+	return carry(remainder, scroll)
+}
+
+// carry adds scroll to a remainder and returns the whole clicks in it,
+// dropping the remainder when the direction reverses
+func carry(remainder *float64, scroll float64) int32 {
+	if (*remainder < 0) != (scroll < 0) {
+		*remainder = 0
+	}
+
+	*remainder += scroll
+	clicks := math.Trunc(*remainder)
+	*remainder -= clicks
+	return int32(clicks)
+}
+
+// LogStats reports how aggressive the dead zone has been per axis
+func (ts *Scroller) LogStats() {
+	name := ts.Device().Name
+	slog.Info("Dropped scroll events", "device", name, "count", ts.droppedEvents.Load())
+	slog.Info("Dropped input events", "device", name, "count", ts.droppedInput.Load())
+
+	x, y := ts.DeadZoneStats()
+	for _, axis := range []struct {
+		name  string
+		stats DeadZoneStats
+	}{
+		{"X", x},
+		{"Y", y},
+	} {
+		total := axis.stats.Suppressed + axis.stats.Passed
+		if total == 0 {
+			slog.Info("Dead zone saw no motion", "device", name, "axis", axis.name)
+			continue
+		}
+		slog.Info("Dead zone", "device", name, "axis", axis.name,
+			"suppressed", axis.stats.Suppressed, "passed", axis.stats.Passed,
+			"suppressed_pct", math.Round(1000*float64(axis.stats.Suppressed)/float64(total))/10)
+	}
+}
+
+// DeadZoneStats returns how many motion events the dead zone has suppressed
+// and let through on each axis
+func (ts *Scroller) DeadZoneStats() (x, y DeadZoneStats) {
+	return ts.deadZoneX.stats(), ts.deadZoneY.stats()
+}
+
+// Config returns the settings currently in effect
+func (ts *Scroller) Config() *Config {
+	return ts.cfg.Load()
+}
+
+// SetConfig swaps in new settings while running. Settings that shape the
+// virtual device or background goroutines keep their old values until restart
+func (ts *Scroller) SetConfig(cfg Config) {
+	old := ts.Config()
+	cfg.SmoothEmit = old.SmoothEmit
+	cfg.IntentWindow = old.IntentWindow
+	cfg.Watchdog = old.Watchdog
+	cfg.IdleUngrab = old.IdleUngrab
+	cfg.HiRes = old.HiRes
+	cfg.Kinetic = old.Kinetic
+	cfg.DryRun = old.DryRun
+	cfg.Overlay = old.Overlay
+	cfg.Identity = old.Identity
+	cfg.CloneIdentity = old.CloneIdentity
+	cfg.SplitDevices = old.SplitDevices
+	cfg.DevicePath = old.DevicePath
+	cfg.Detect = old.Detect
+	cfg.Reconnect = old.Reconnect
+	cfg.QueueSize = old.QueueSize
+	cfg.QueueFull = old.QueueFull
+	if cfg.movesPointer() != old.movesPointer() {
+		cfg.ScrollButton = old.ScrollButton
+		cfg.ToggleButton = old.ToggleButton
+		cfg.ScrollAfterIdle = old.ScrollAfterIdle
+		cfg.ScrollModifier = old.ScrollModifier
+		cfg.Modes, cfg.ModeButton = old.Modes, old.ModeButton
+	}
+	if cfg.sendsCtrl() != old.sendsCtrl() {
+		cfg.ZoomButton = old.ZoomButton
+		cfg.WheelOutput = old.WheelOutput
+		cfg.Modes, cfg.ModeButton = old.Modes, old.ModeButton
+	}
+	for _, key := range cfg.extraKeys() {
+		// The virtual device can only send keys it advertised
+		if !hasKey(old.extraKeys(), key) {
+			cfg.ButtonMap = old.ButtonMap
+			cfg.Chords = old.Chords
+			cfg.WheelOutput, cfg.WheelKeys = old.WheelOutput, old.WheelKeys
+			cfg.ScrollOutput = old.ScrollOutput
+			cfg.MediaButton, cfg.MediaKeys = old.MediaButton, old.MediaKeys
+			cfg.Modes, cfg.ModeButton, cfg.CustomKeys = old.Modes, old.ModeButton, old.CustomKeys
+			break
+		}
+	}
+
+	ts.cfg.Store(&cfg)
+	if cfg.Filter != old.Filter {
+		ts.filter.restart()
+	}
+	if cfg.DragLockButton == 0 {
+		ts.setDragLock(false)
+	}
+	if !cfg.supportsMode(ts.Mode()) {
+		ts.SetMode(cfg.defaultMode())
+	}
+}
+
+// Pause releases the device so its events reach the system unconverted
+func (ts *Scroller) Pause() error {
+	if ts.paused.Swap(true) || !ts.Config().grabs() {
+		return nil
+	}
+	ts.setDragLock(false)
+	// An idle device is already released
+	device := ts.Device()
+	if err := device.Release(); err != nil && !ts.idle.Load() {
+		ts.paused.Store(false)
+		return fmt.Errorf("failed to release %s: %w", device.Fn, err)
+	}
+	ts.idle.Store(false)
+	slog.Info("Paused", "device", device.Name)
+	return nil
+}
+
+// Paused reports whether the device is released by Pause
+func (ts *Scroller) Paused() bool {
+	return ts.paused.Load()
+}
+
+// Resume grabs the device again after pause
+func (ts *Scroller) Resume() error {
+	if !ts.paused.Load() {
+		return nil
+	}
+	if !ts.Config().grabs() {
+		ts.paused.Store(false)
+		return nil
+	}
+	// A device that went away while paused, e.g. across suspend, is grabbed
+	// when it reconnects
+	device := ts.Device()
+	if err := device.Grab(); err != nil && !isDeviceGone(err) {
+		return fmt.Errorf("failed to grab %s: %w", device.Fn, err)
+	}
+	ts.paused.Store(false)
+	slog.Info("Resumed", "device", device.Name)
+	return nil
+}
+
+// sensitivity returns the configured sensitivity for an axis, scaled by the
+// DPI of the monitor under the pointer when a DPIWatcher is set
+func (ts *Scroller) sensitivity(isHorizontal bool) float64 {
+	sensitivity := ts.Config().SensitivityY
+	if isHorizontal {
+		sensitivity = ts.Config().SensitivityX
+	}
+
+	if ts.display == nil {
+		return sensitivity
+	}
+	return sensitivity * ts.display.Scale()
+}
+
+// inClickCooldown reports whether motion at t falls too soon after a button
+// event, where it is most likely the ball wobbling under the click
+func (ts *Scroller) inClickCooldown(t time.Time) bool {
+	if ts.Config().ClickCooldown <= 0 || ts.lastButtonAt.IsZero() {
+		return false
+	}
+	return t.Sub(ts.lastButtonAt) < ts.Config().ClickCooldown
+}
+
+// inPalmCheck reports whether motion at t comes right after typing, when a
+// resting hand is likely brushing the ball
+func (ts *Scroller) inPalmCheck(t time.Time) bool {
+	cfg := ts.Config()
+	if ts.keyboard == nil || cfg.PalmCheck <= 0 {
+		return false
+	}
+
+	// Pressing a modifier to scroll isn't typing
+	if ts.modifierHeld(cfg.ScrollModifier) || ts.modifierHeld(cfg.HorizontalModifier) {
+		return false
+	}
+
+	lastKey := ts.keyboard.lastKeyTime()
+	return !lastKey.IsZero() && t.Sub(lastKey) < cfg.PalmCheck
+}
+
+// modifierHeld reports whether a modifier key is held on the watched keyboard
+func (ts *Scroller) modifierHeld(code uint16) bool {
+	return code != 0 && ts.modifiers != nil && ts.modifiers.Held(code)
+}
+
+// eventTime converts an evdev event timestamp to a time.Time
+func eventTime(event evdev.InputEvent) time.Time {
+	return time.Unix(int64(event.Time.Sec), int64(event.Time.Usec)*int64(time.Microsecond))
+}
+
+// queueScroll sends a scroll value straight to the virtual device or, in
+// smooth-emit mode, adds it to the accumulator drained by runSmoothEmitter
+func (ts *Scroller) queueScroll(isHorizontal bool, value int32) {
+	if !ts.Config().SmoothEmit {
+		ts.sendScrollEvent(isHorizontal, value)
+		return
+	}
+
+	ts.pendingMu.Lock()
+	if isHorizontal {
+		ts.pendingX += value
+	} else {
+		ts.pendingY += value
+	}
+	ts.pendingMu.Unlock()
+}
+
+// runSmoothEmitter drains the accumulated scroll at a fixed rate so wheel
+// events are evenly spaced instead of arriving in bursts per input batch
+func (ts *Scroller) runSmoothEmitter(ctx context.Context) {
+	defer ts.cleanupOnPanic()
+	ticker := time.NewTicker(time.Second / SMOOTH_EMIT_RATE)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ts.pendingMu.Lock()
+		stepX := drainStep(ts.pendingX)
+		stepY := drainStep(ts.pendingY)
+		ts.pendingX -= stepX
+		ts.pendingY -= stepY
+		ts.pendingMu.Unlock()
+
+		if stepX != 0 {
+			ts.sendScrollEvent(true, stepX)
+		}
+		if stepY != 0 {
+			ts.sendScrollEvent(false, stepY)
+		}
+	}
+}
+
+// drainStep returns how much of the pending scroll to emit on one tick,
+// always at least one notch so nothing is left behind
+func drainStep(pending int32) int32 {
+	step := pending / SMOOTH_EMIT_SPREAD
+	if step == 0 {
+		switch {
+		case pending > 0:
+			step = 1
+		case pending < 0:
+			step = -1
+		}
+	}
+	return step
+}
+
+func abs(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,1084 @@
+package trackballscroll
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// testEpoch is when test input starts; events are stamped relative to it
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeReader hands out one batch per Read, then io.EOF
+type fakeReader struct {
+	batches [][]evdev.InputEvent
+}
+
+func (r *fakeReader) Read() ([]evdev.InputEvent, error) {
+	if len(r.batches) == 0 {
+		return nil, io.EOF
+	}
+	batch := r.batches[0]
+	r.batches = r.batches[1:]
+	return batch, nil
+}
+
+// writeResult is what one fakeWriter.WriteEvents call does: write up to n
+// events (all of them if n is negative) and fail with err
+type writeResult struct {
+	n   int
+	err error
+}
+
+// fakeWriter records the frames written to it. Each call takes its result
+// from results in turn; once they run out every write succeeds
+type fakeWriter struct {
+	mu       sync.Mutex
+	events   []InputEvent
+	results  []writeResult
+	blocking bool
+	switches []bool // every SetBlocking call
+	calls    int
+	closed   bool
+}
+
+func (w *fakeWriter) WriteEvents(events []InputEvent) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls++
+
+	result := writeResult{n: -1}
+	if len(w.results) > 0 {
+		result = w.results[0]
+		w.results = w.results[1:]
+	}
+	n := len(events)
+	if result.n >= 0 && result.n < n {
+		n = result.n
+	}
+	w.events = append(w.events, events[:n]...)
+	return n, result.err
+}
+
+func (w *fakeWriter) SetBlocking(blocking bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.blocking = blocking
+	w.switches = append(w.switches, blocking)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+// out is an emitted event without its timestamp
+type out struct {
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// frames splits what was written into frames at each sync report, dropping
+// the reports and timestamps
+func (w *fakeWriter) frames() [][]out {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var frames [][]out
+	var frame []out
+	for _, event := range w.events {
+		if event.Type == EV_SYN && event.Code == SYN_REPORT {
+			frames = append(frames, frame)
+			frame = nil
+			continue
+		}
+		frame = append(frame, out{event.Type, event.Code, event.Value})
+	}
+	return frames
+}
+
+// testConfig is a plain configuration: every count scrolls one click, with
+// no dead zone and nothing else in the way
+func testConfig() Config {
+	return Config{
+		SensitivityX: 1,
+		SensitivityY: 1,
+		AxisXCode:    REL_X,
+		AxisYCode:    REL_Y,
+		WriteFull:    WRITE_FULL_DROP,
+	}
+}
+
+// newTestScroller builds a scroller for a fake device writing to writer
+func newTestScroller(t *testing.T, cfg Config, writer EventWriter, options ...Option) *Scroller {
+	t.Helper()
+	device := &evdev.InputDevice{Fn: "/dev/input/event99", Name: "Test Trackball"}
+	ts, err := NewScroller(device, cfg, append([]Option{WithWriter(writer)}, options...)...)
+	if err != nil {
+		t.Fatalf("NewScroller: %v", err)
+	}
+	return ts
+}
+
+// feed runs batches through the scroller the way Run does, until the reader
+// runs dry
+func feed(t *testing.T, ts *Scroller, batches ...[]evdev.InputEvent) {
+	t.Helper()
+	err := ts.processEvents(context.Background(), &fakeReader{batches: batches})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("processEvents: got %v, want EOF", err)
+	}
+}
+
+// input builds an event at offset ms after testEpoch
+func input(ms int, evType, code uint16, value int32) evdev.InputEvent {
+	at := testEpoch.Add(time.Duration(ms) * time.Millisecond)
+	return evdev.InputEvent{
+		Time:  syscall.NsecToTimeval(at.UnixNano()),
+		Type:  evType,
+		Code:  code,
+		Value: value,
+	}
+}
+
+func rel(ms int, code uint16, value int32) evdev.InputEvent {
+	return input(ms, EV_REL, code, value)
+}
+
+func key(ms int, code uint16, value int32) evdev.InputEvent {
+	return input(ms, EV_KEY, code, value)
+}
+
+func syn(ms int) evdev.InputEvent {
+	return input(ms, EV_SYN, SYN_REPORT, 0)
+}
+
+// batch is the events of one read, closed by a sync report
+func batch(ms int, events ...evdev.InputEvent) []evdev.InputEvent {
+	return append(events, syn(ms))
+}
+
+func wheel(value int32) out {
+	return out{EV_REL, REL_WHEEL, value}
+}
+
+func hwheel(value int32) out {
+	return out{EV_REL, REL_HWHEEL, value}
+}
+
+func button(code uint16, value int32) out {
+	return out{EV_KEY, code, value}
+}
+
+func assertFrames(t *testing.T, writer *fakeWriter, want [][]out) {
+	t.Helper()
+	if got := writer.frames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("frames:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     func(*Config)
+		batches [][]evdev.InputEvent
+		want    [][]out
+	}{
+		{
+			name:    "vertical motion scrolls",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name:    "horizontal motion scrolls sideways",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_X, -2))},
+			want:    [][]out{{hwheel(-2)}},
+		},
+		{
+			name:    "sensitivity scales clicks",
+			cfg:     func(cfg *Config) { cfg.SensitivityY = 0.5 },
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 8))},
+			want:    [][]out{{wheel(4)}},
+		},
+		{
+			name: "fractions carry into the next batch",
+			cfg:  func(cfg *Config) { cfg.SensitivityY = 0.25 },
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 2)),
+				batch(10, rel(10, REL_Y, 2)),
+				batch(20, rel(20, REL_Y, 2)),
+			},
+			want: [][]out{{wheel(1)}},
+		},
+		{
+			name: "reversing drops the remainder",
+			cfg:  func(cfg *Config) { cfg.SensitivityY = 0.5 },
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 3)),
+				batch(10, rel(10, REL_Y, -1)),
+			},
+			want: [][]out{{wheel(1)}},
+		},
+		{
+			name: "dead zone suppresses small motion",
+			cfg:  func(cfg *Config) { cfg.DeadZoneY = 2 },
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 2)),
+				batch(10, rel(10, REL_Y, -1)),
+				batch(20, rel(20, REL_Y, 3)),
+			},
+			want: [][]out{{wheel(3)}},
+		},
+		{
+			name:    "dead zone is per axis",
+			cfg:     func(cfg *Config) { cfg.DeadZoneY = 5 },
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_X, 3), rel(0, REL_Y, 3))},
+			want:    [][]out{{hwheel(3)}},
+		},
+		{
+			name:    "invert reverses vertical scrolling",
+			cfg:     func(cfg *Config) { cfg.InvertY = true },
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3), rel(0, REL_X, 2))},
+			want:    [][]out{{wheel(-3), hwheel(2)}},
+		},
+		{
+			name:    "invert reverses horizontal scrolling",
+			cfg:     func(cfg *Config) { cfg.InvertX = true },
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 3), rel(0, REL_X, 2))},
+			want:    [][]out{{wheel(3), hwheel(-2)}},
+		},
+		{
+			name:    "a batch is summed into one frame",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 1), rel(0, REL_Y, 2), rel(0, REL_X, 1), rel(0, REL_Y, 4))},
+			want:    [][]out{{wheel(7), hwheel(1)}},
+		},
+		{
+			name:    "each batch is its own frame",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 1)), batch(10, rel(10, REL_Y, 2))},
+			want:    [][]out{{wheel(1)}, {wheel(2)}},
+		},
+		{
+			name:    "a button splits the frame around it",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 2), key(0, BTN_LEFT, 1), rel(0, REL_Y, 3))},
+			want:    [][]out{{wheel(2)}, {button(BTN_LEFT, 1)}, {wheel(3)}},
+		},
+		{
+			name:    "unhandled codes are ignored",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, 0x07, 5), input(0, 0x03, 0, 9))},
+			want:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			if test.cfg != nil {
+				test.cfg(&cfg)
+			}
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestSmoothEmitKeepsTotals(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches [][][]evdev.InputEvent // fed with a pause between each group
+		wantX   int32
+		wantY   int32
+	}{
+		{
+			name:    "one burst",
+			batches: [][][]evdev.InputEvent{{batch(0, rel(0, REL_Y, 40))}},
+			wantY:   40,
+		},
+		{
+			name: "both axes",
+			batches: [][][]evdev.InputEvent{{
+				batch(0, rel(0, REL_Y, 13), rel(0, REL_X, -9)),
+				batch(10, rel(10, REL_Y, 5)),
+			}},
+			wantX: -9,
+			wantY: 18,
+		},
+		{
+			name: "direction reverses while draining",
+			batches: [][][]evdev.InputEvent{
+				{batch(0, rel(0, REL_Y, 40))},
+				{batch(20, rel(20, REL_Y, -25))},
+				{batch(40, rel(40, REL_Y, 7)), batch(50, rel(50, REL_Y, -3))},
+			},
+			wantY: 19,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.SmoothEmit = true
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ts.runSmoothEmitter(ctx)
+			}()
+			for _, group := range test.batches {
+				feed(t, ts, group...)
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				ts.pendingMu.Lock()
+				drained := ts.pendingX == 0 && ts.pendingY == 0
+				ts.pendingMu.Unlock()
+				if drained || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			cancel()
+			<-done
+
+			var x, y int32
+			ticks := 0
+			for _, frame := range writer.frames() {
+				ticks++
+				for _, event := range frame {
+					switch event.Code {
+					case REL_HWHEEL:
+						x += event.Value
+					case REL_WHEEL:
+						y += event.Value
+					}
+				}
+			}
+			if x != test.wantX || y != test.wantY {
+				t.Errorf("emitted %d horizontal and %d vertical clicks, want %d and %d", x, y, test.wantX, test.wantY)
+			}
+			// A burst is spread over several ticks rather than sent at once
+			if ticks < SMOOTH_EMIT_SPREAD {
+				t.Errorf("emitted in %d frames, want at least %d", ticks, SMOOTH_EMIT_SPREAD)
+			}
+		})
+	}
+}
+
+func TestHandleEventsThroughQueue(t *testing.T) {
+	cfg := testConfig()
+	cfg.QueueSize = 2
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+
+	var batches [][]evdev.InputEvent
+	var want [][]out
+	for i := 1; i <= 10; i++ {
+		batches = append(batches, batch(i*10, rel(i*10, REL_Y, int32(i))))
+		want = append(want, []out{wheel(int32(i))})
+	}
+	feed(t, ts, batches...)
+	assertFrames(t, writer, want)
+}
+
+func TestEnqueueDroppingOldest(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  [][]evdev.InputEvent
+		batch   []evdev.InputEvent
+		want    [][]evdev.InputEvent
+		dropped uint64
+	}{
+		{
+			name:   "room",
+			queued: [][]evdev.InputEvent{batch(10, rel(10, REL_Y, 1))},
+			batch:  batch(20, rel(20, REL_Y, 2)),
+			want: [][]evdev.InputEvent{
+				batch(10, rel(10, REL_Y, 1)),
+				batch(20, rel(20, REL_Y, 2)),
+			},
+		},
+		{
+			name: "motion coalesced",
+			queued: [][]evdev.InputEvent{
+				batch(10, rel(10, REL_Y, 1)),
+				batch(20, rel(20, REL_Y, 2), rel(20, REL_X, 1)),
+			},
+			batch: batch(30, rel(30, REL_Y, 3)),
+			want: [][]evdev.InputEvent{
+				batch(30, rel(30, REL_Y, 6), rel(20, REL_X, 1)),
+			},
+			dropped: 4,
+		},
+		{
+			name: "button kept",
+			queued: [][]evdev.InputEvent{
+				batch(10, rel(10, REL_Y, 1)),
+				batch(20, rel(20, REL_Y, 1)),
+			},
+			batch: batch(30, key(30, BTN_LEFT, 1), rel(30, REL_Y, 1)),
+			want: [][]evdev.InputEvent{
+				append(batch(20, rel(20, REL_Y, 2)), batch(30, key(30, BTN_LEFT, 1), rel(30, REL_Y, 1))...),
+			},
+			dropped: 2,
+		},
+		{
+			name: "motion not merged across a button",
+			queued: [][]evdev.InputEvent{
+				batch(10, rel(10, REL_Y, 1)),
+				batch(20, key(20, BTN_LEFT, 1)),
+			},
+			batch: batch(30, rel(30, REL_Y, 1)),
+			want: [][]evdev.InputEvent{
+				append(append(batch(10, rel(10, REL_Y, 1)), batch(20, key(20, BTN_LEFT, 1))...), batch(30, rel(30, REL_Y, 1))...),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestScroller(t, testConfig(), &fakeWriter{})
+			queue := make(chan []evdev.InputEvent, 2)
+			for _, queued := range test.queued {
+				queue <- queued
+			}
+			ts.enqueueDroppingOldest(queue, newBatchPool(2), test.batch)
+			close(queue)
+
+			var got [][]evdev.InputEvent
+			for events := range queue {
+				got = append(got, events)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("queued %v, want %v", got, test.want)
+			}
+			if dropped := ts.droppedInput.Load(); dropped != test.dropped {
+				t.Errorf("dropped %d, want %d", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestPausedScrollerIgnoresInput(t *testing.T) {
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, testConfig(), writer)
+	ts.paused.Store(true)
+	feed(t, ts, batch(0, rel(0, REL_Y, 5)))
+	assertFrames(t, writer, nil)
+}
+
+func TestWriteFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		results []writeResult
+		want    [][]out
+		dropped uint64
+
+		// SetBlocking calls, which must leave the writer nonblocking
+		switches []bool
+	}{
+		{
+			name:    "drop",
+			policy:  WRITE_FULL_DROP,
+			results: []writeResult{{0, syscall.EAGAIN}},
+			want:    nil,
+			dropped: 1,
+		},
+		{
+			name:    "drop keeps what was written",
+			policy:  WRITE_FULL_DROP,
+			results: []writeResult{{1, syscall.EAGAIN}},
+			want:    nil,
+			dropped: 1,
+		},
+		{
+			name:    "retry until there is room",
+			policy:  WRITE_FULL_RETRY,
+			results: []writeResult{{0, syscall.EAGAIN}, {0, syscall.EAGAIN}},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name:    "retry writes only the rest",
+			policy:  WRITE_FULL_RETRY,
+			results: []writeResult{{1, syscall.EAGAIN}},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name:    "retry finishes a short retry",
+			policy:  WRITE_FULL_RETRY,
+			results: []writeResult{{0, syscall.EAGAIN}, {1, nil}, {0, syscall.EAGAIN}, {1, nil}},
+			want:    [][]out{{wheel(3)}},
+		},
+		{
+			name:     "block waits for room",
+			policy:   WRITE_FULL_BLOCK,
+			results:  []writeResult{{0, syscall.EAGAIN}},
+			want:     [][]out{{wheel(3)}},
+			switches: []bool{true, false},
+		},
+		{
+			name:     "block finishes a short blocking write",
+			policy:   WRITE_FULL_BLOCK,
+			results:  []writeResult{{0, syscall.EAGAIN}, {1, nil}, {0, syscall.EINTR}},
+			want:     [][]out{{wheel(3)}},
+			switches: []bool{true, false},
+		},
+		{
+			name:     "block gives up on an error",
+			policy:   WRITE_FULL_BLOCK,
+			results:  []writeResult{{0, syscall.EAGAIN}, {0, syscall.EIO}},
+			want:     nil,
+			dropped:  1,
+			switches: []bool{true, false},
+		},
+		{
+			name:    "short write without an error is finished",
+			policy:  WRITE_FULL_DROP,
+			results: []writeResult{{1, nil}},
+			want:    [][]out{{wheel(3)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.WriteFull = test.policy
+			writer := &fakeWriter{results: test.results}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, batch(0, rel(0, REL_Y, 3)))
+
+			assertFrames(t, writer, test.want)
+			if got := ts.droppedEvents.Load(); got != test.dropped {
+				t.Errorf("dropped %d frames, want %d", got, test.dropped)
+			}
+			if !reflect.DeepEqual(writer.switches, test.switches) {
+				t.Errorf("SetBlocking calls %v, want %v", writer.switches, test.switches)
+			}
+		})
+	}
+}
+
+func TestWriteFullBlockOnlyBlocksOneFrame(t *testing.T) {
+	cfg := testConfig()
+	cfg.WriteFull = WRITE_FULL_BLOCK
+	writer := &fakeWriter{results: []writeResult{{0, syscall.EAGAIN}}}
+	ts := newTestScroller(t, cfg, writer)
+	feed(t, ts, batch(0, rel(0, REL_Y, 1)))
+
+	// After a reload to drop, a full device drops rather than waits
+	cfg.WriteFull = WRITE_FULL_DROP
+	ts.SetConfig(cfg)
+	writer.results = []writeResult{{0, syscall.EAGAIN}}
+	feed(t, ts, batch(10, rel(10, REL_Y, 2)))
+
+	if writer.blocking {
+		t.Error("writer left blocking")
+	}
+	assertFrames(t, writer, [][]out{{wheel(1)}})
+	if got := ts.droppedEvents.Load(); got != 1 {
+		t.Errorf("dropped %d frames, want 1", got)
+	}
+}
+
+func TestWriteFailuresCountOnlyErrors(t *testing.T) {
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, testConfig(), writer)
+	failures := func() int {
+		ts.frame.mu.Lock()
+		defer ts.frame.mu.Unlock()
+		return ts.frame.failures
+	}
+
+	// Frames the drop policy discards because the device is full don't
+	// count toward recreating it
+	writer.results = []writeResult{{0, syscall.EAGAIN}, {0, syscall.EAGAIN}}
+	feed(t, ts, batch(0, rel(0, REL_Y, 1)), batch(10, rel(10, REL_Y, 1)))
+	if got := failures(); got != 0 {
+		t.Errorf("%d failures after drops, want 0", got)
+	}
+
+	writer.results = []writeResult{{0, syscall.EIO}, {0, syscall.EAGAIN}, {0, syscall.EIO}}
+	feed(t, ts, batch(20, rel(20, REL_Y, 1)), batch(30, rel(30, REL_Y, 1)), batch(40, rel(40, REL_Y, 1)))
+	if got := failures(); got != 2 {
+		t.Errorf("%d failures after two errors, want 2", got)
+	}
+
+	feed(t, ts, batch(50, rel(50, REL_Y, 1)))
+	if got := failures(); got != 0 {
+		t.Errorf("%d failures after a write, want 0", got)
+	}
+	if got := ts.droppedEvents.Load(); got != 5 {
+		t.Errorf("dropped %d frames, want 5", got)
+	}
+}
+
+func TestClickCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		batches  [][]evdev.InputEvent
+		want     [][]out
+	}{
+		{
+			name:     "motion right after a click is dropped",
+			cooldown: 50 * time.Millisecond,
+			batches: [][]evdev.InputEvent{
+				batch(0, key(0, BTN_LEFT, 1)),
+				batch(10, rel(10, REL_Y, 2)),
+				batch(30, key(30, BTN_LEFT, 0), rel(30, REL_Y, 1)),
+				batch(70, rel(70, REL_Y, 3)),
+				batch(90, rel(90, REL_Y, 4)),
+			},
+			want: [][]out{{button(BTN_LEFT, 1)}, {button(BTN_LEFT, 0)}, {wheel(4)}},
+		},
+		{
+			name:     "the wobble in the same batch as the click",
+			cooldown: 50 * time.Millisecond,
+			batches:  [][]evdev.InputEvent{batch(0, key(0, evdev.BTN_RIGHT, 1), rel(0, REL_Y, 2))},
+			want:     [][]out{{button(evdev.BTN_RIGHT, 1)}},
+		},
+		{
+			name:     "motion before the click still scrolls",
+			cooldown: 50 * time.Millisecond,
+			batches:  [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 2), key(0, BTN_LEFT, 1))},
+			want:     [][]out{{wheel(2)}, {button(BTN_LEFT, 1)}},
+		},
+		{
+			name:    "no cooldown",
+			batches: [][]evdev.InputEvent{batch(0, key(0, BTN_LEFT, 1)), batch(1, rel(1, REL_Y, 2))},
+			want:    [][]out{{button(BTN_LEFT, 1)}, {wheel(2)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ClickCooldown = test.cooldown
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestDeadZoneStats(t *testing.T) {
+	cfg := testConfig()
+	cfg.DeadZoneX, cfg.DeadZoneY = 1, 2
+	cfg.ClickCooldown = 50 * time.Millisecond
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+
+	feed(t, ts,
+		batch(0, rel(0, REL_Y, 1), rel(0, REL_Y, 2), rel(0, REL_X, 1)),
+		batch(10, rel(10, REL_Y, 3), rel(10, REL_Y, -5), rel(10, REL_X, -2)),
+		// Dropped by the cooldown before the dead zone sees it
+		batch(20, key(20, BTN_LEFT, 1), rel(20, REL_Y, 1)),
+	)
+
+	x, y := ts.DeadZoneStats()
+	if want := (DeadZoneStats{Suppressed: 2, Passed: 2}); y != want {
+		t.Errorf("Y: got %+v, want %+v", y, want)
+	}
+	if want := (DeadZoneStats{Suppressed: 1, Passed: 1}); x != want {
+		t.Errorf("X: got %+v, want %+v", x, want)
+	}
+}
+
+func TestAntiOvershoot(t *testing.T) {
+	// One batch every 10ms, each with the given motion
+	ramp := func(values ...int32) [][]evdev.InputEvent {
+		var batches [][]evdev.InputEvent
+		for i, value := range values {
+			batches = append(batches, batch(i*10, rel(i*10, REL_Y, value)))
+		}
+		return batches
+	}
+	frames := func(values ...int32) [][]out {
+		var frames [][]out
+		for _, value := range values {
+			frames = append(frames, []out{wheel(value)})
+		}
+		return frames
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		notches int
+		batches [][]evdev.InputEvent
+		want    [][]out
+	}{
+		{
+			name:    "sharp deceleration is attenuated",
+			enabled: true,
+			batches: ramp(10, 10, 10, 4),
+			want:    frames(10, 10, 10, 2),
+		},
+		{
+			name:    "steady motion after the drop is not",
+			enabled: true,
+			batches: ramp(12, 12, 4, 4),
+			want:    frames(12, 12, 2, 4),
+		},
+		{
+			name:    "gentle deceleration is not",
+			enabled: true,
+			batches: ramp(10, 10, 8, 6),
+			want:    frames(10, 10, 8, 6),
+		},
+		{
+			name:    "disabled",
+			batches: ramp(10, 10, 10, 4),
+			want:    frames(10, 10, 10, 4),
+		},
+		{
+			name:    "off for notched scrolling",
+			enabled: true,
+			notches: 2,
+			batches: ramp(10, 10, 10, 4),
+			want:    frames(5, 5, 5, 2),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AntiOvershoot = test.enabled
+			cfg.NotchCounts = test.notches
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+// TestNotchCountsIgnoreShaping checks that a ratchet gives one click per
+// NotchCounts even with every option that scales scrolling turned on
+func TestNotchCountsIgnoreShaping(t *testing.T) {
+	cfg := testConfig()
+	cfg.NotchCounts = 5
+	cfg.SoftStart = 500 * time.Millisecond
+	cfg.Ballistics = true
+	cfg.BallisticsSlowSpeed = 10
+	cfg.BallisticsFastSpeed = 1000
+	cfg.BallisticsSlowGain = 0.2
+	cfg.BallisticsFastGain = 4
+	cfg.DeadZoneY = 2
+	cfg.MaxScrollStep = 0.1
+	cfg.Accel = ACCEL_EXPONENT
+	cfg.AccelExponent = 2
+
+	var batches [][]evdev.InputEvent
+	for i := 0; i < 10; i++ {
+		batches = append(batches, batch(i*10, rel(i*10, REL_Y, 1)))
+	}
+	batches = append(batches, batch(100, rel(100, REL_Y, 10)))
+
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+	feed(t, ts, batches...)
+	assertFrames(t, writer, [][]out{{wheel(1)}, {wheel(1)}, {wheel(2)}})
+}
+
+func TestIntentGate(t *testing.T) {
+	dropped := func(ms int) []evdev.InputEvent {
+		return []evdev.InputEvent{input(ms, evdev.EV_SYN, evdev.SYN_DROPPED, 0)}
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]evdev.InputEvent
+		want    [][]out
+	}{
+		{
+			name:    "a single spike under the threshold",
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_Y, 8))},
+		},
+		{
+			name: "sustained motion opens the gate",
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 4)),
+				batch(10, rel(10, REL_Y, 4)),
+				batch(20, rel(20, REL_Y, 4)),
+				batch(30, rel(30, REL_Y, 1)),
+			},
+			want: [][]out{{wheel(4)}, {wheel(1)}},
+		},
+		{
+			name: "only the last events of the window count",
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 7)),
+				batch(10, rel(10, REL_Y, 1)),
+				batch(20, rel(20, REL_Y, 1)),
+				batch(30, rel(30, REL_Y, 1)),
+			},
+		},
+		{
+			name: "a pause starts a new gesture",
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 6)),
+				batch(200, rel(200, REL_Y, 6)),
+				batch(210, rel(210, REL_Y, 6)),
+			},
+			want: [][]out{{wheel(6)}},
+		},
+		{
+			name: "an open gate closes after a pause",
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 12)),
+				batch(10, rel(10, REL_Y, 1)),
+				batch(200, rel(200, REL_Y, 1)),
+			},
+			want: [][]out{{wheel(12)}, {wheel(1)}},
+		},
+		{
+			name: "SYN_DROPPED resets the gate",
+			batches: [][]evdev.InputEvent{
+				batch(0, rel(0, REL_Y, 6)),
+				dropped(5),
+				batch(10, rel(10, REL_Y, 6)),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IntentThreshold = 10
+			cfg.IntentWindow = 3
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestPalmCheck(t *testing.T) {
+	// A step is a batch from either the keyboard or the trackball
+	type step struct {
+		keyboard bool
+		events   []evdev.InputEvent
+	}
+	typed := func(ms int, code uint16, value int32) step {
+		return step{keyboard: true, events: batch(ms, key(ms, code, value))}
+	}
+	ball := func(ms int, value int32) step {
+		return step{events: batch(ms, rel(ms, REL_Y, value))}
+	}
+
+	tests := []struct {
+		name     string
+		modifier uint16
+		steps    []step
+		want     [][]out
+	}{
+		{
+			name:  "motion right after a keystroke is dropped",
+			steps: []step{typed(0, evdev.KEY_A, 1), ball(50, 3), ball(150, 2)},
+			want:  [][]out{{wheel(2)}},
+		},
+		{
+			name:  "releasing a key doesn't restart the window",
+			steps: []step{typed(0, evdev.KEY_A, 1), typed(90, evdev.KEY_A, 0), ball(120, 2)},
+			want:  [][]out{{wheel(2)}},
+		},
+		{
+			name:  "key repeat extends the window",
+			steps: []step{typed(0, evdev.KEY_A, 1), typed(80, evdev.KEY_A, 2), ball(150, 3), ball(200, 2)},
+			want:  [][]out{{wheel(2)}},
+		},
+		{
+			name:  "motion before typing scrolls",
+			steps: []step{ball(0, 2), typed(10, evdev.KEY_A, 1), ball(20, 3)},
+			want:  [][]out{{wheel(2)}},
+		},
+		{
+			name:     "holding the scroll modifier isn't typing",
+			modifier: evdev.KEY_LEFTMETA,
+			steps:    []step{typed(0, evdev.KEY_LEFTMETA, 1), ball(10, 2)},
+			want:     [][]out{{wheel(2)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.PalmCheck = 100 * time.Millisecond
+			cfg.ScrollModifier = test.modifier
+			keyboard := &KeyboardWatcher{}
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer, WithKeyboard(keyboard), WithModifierKeyboard(keyboard))
+			for _, step := range test.steps {
+				if step.keyboard {
+					for _, event := range step.events {
+						keyboard.observe(event)
+					}
+					continue
+				}
+				feed(t, ts, step.events)
+			}
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestAxisCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		xCode   uint16
+		yCode   uint16
+		batches [][]evdev.InputEvent
+		want    [][]out
+	}{
+		{
+			name:    "rotation axes",
+			xCode:   evdev.REL_RX,
+			yCode:   evdev.REL_RY,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, evdev.REL_RY, 3), rel(0, evdev.REL_RX, 2))},
+			want:    [][]out{{wheel(3), hwheel(2)}},
+		},
+		{
+			name:    "the usual axes are ignored once remapped",
+			xCode:   evdev.REL_RX,
+			yCode:   evdev.REL_RY,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_X, 5), rel(0, REL_Y, 5))},
+		},
+		{
+			name:    "swapped axes",
+			xCode:   REL_Y,
+			yCode:   REL_X,
+			batches: [][]evdev.InputEvent{batch(0, rel(0, REL_X, 3)), batch(10, rel(10, REL_Y, 2))},
+			want:    [][]out{{wheel(3)}, {hwheel(2)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AxisXCode, cfg.AxisYCode = test.xCode, test.yCode
+			writer := &fakeWriter{}
+			ts := newTestScroller(t, cfg, writer)
+			feed(t, ts, test.batches...)
+			assertFrames(t, writer, test.want)
+		})
+	}
+}
+
+func TestSplitDevices(t *testing.T) {
+	cfg := testConfig()
+	cfg.ScrollButton = evdev.BTN_SIDE
+	cfg.PointerSensitivity = 1
+	cfg.ButtonMap = map[uint16][]uint16{evdev.BTN_EXTRA: {KEY_LEFTCTRL, evdev.KEY_W}}
+	scroll, pointer := &fakeWriter{}, &fakeWriter{}
+	ts := newTestScroller(t, cfg, scroll)
+	ts.pointerWriter = pointer
+
+	feed(t, ts,
+		batch(0, rel(0, REL_X, 3), rel(0, REL_Y, 2)),
+		batch(10, key(10, BTN_LEFT, 1)),
+		batch(20, key(20, evdev.BTN_SIDE, 1), rel(20, REL_Y, 4)),
+		batch(30, rel(30, REL_Y, 1), rel(30, REL_X, 2)),
+		batch(40, key(40, evdev.BTN_EXTRA, 1)),
+	)
+
+	assertFrames(t, pointer, [][]out{
+		{{EV_REL, REL_X, 3}, {EV_REL, REL_Y, 2}},
+		{button(BTN_LEFT, 1)},
+	})
+	assertFrames(t, scroll, [][]out{
+		{wheel(4)},
+		{wheel(1), hwheel(2)},
+		{button(KEY_LEFTCTRL, 1), button(evdev.KEY_W, 1)},
+	})
+
+	ts.Close()
+	if !scroll.closed || !pointer.closed {
+		t.Errorf("closed: scroll %v, pointer %v, want both", scroll.closed, pointer.closed)
+	}
+}
+
+func TestScrollAfterIdle(t *testing.T) {
+	cfg := testConfig()
+	cfg.ScrollAfterIdle = 500 * time.Millisecond
+	cfg.PointerSensitivity = 1
+	writer := &fakeWriter{}
+	ts := newTestScroller(t, cfg, writer)
+	pointerY := func(value int32) out { return out{EV_REL, REL_Y, value} }
+
+	feed(t, ts,
+		// Still since the start, so the ball scrolls
+		batch(0, rel(0, REL_Y, 2)),
+		batch(10, rel(10, REL_Y, 3)),
+		// A click goes back to pointing; the release changes nothing
+		batch(20, key(20, BTN_LEFT, 1)),
+		batch(30, key(30, BTN_LEFT, 0)),
+		batch(40, rel(40, REL_Y, 1)),
+		// Pauses shorter than the idle time keep pointing
+		batch(300, rel(300, REL_Y, 1)),
+		batch(790, rel(790, REL_Y, 1)),
+		// Still long enough: scrolling again, in both directions
+		batch(1300, rel(1300, REL_Y, 4)),
+		batch(1310, rel(1310, REL_X, 2)),
+		batch(1320, key(1320, BTN_LEFT, 1)),
+		batch(1330, rel(1330, REL_Y, 1)),
+	)
+
+	assertFrames(t, writer, [][]out{
+		{wheel(2)},
+		{wheel(3)},
+		{button(BTN_LEFT, 1)},
+		{button(BTN_LEFT, 0)},
+		{pointerY(1)},
+		{pointerY(1)},
+		{pointerY(1)},
+		{wheel(4)},
+		{hwheel(2)},
+		{button(BTN_LEFT, 1)},
+		{pointerY(1)},
+	})
+}
+
+// TestWatchdogMissingNodeReconnects checks that a device node that has
+// disappeared is reported as unplugged, so runScroller reconnects instead of
+// exiting
+func TestWatchdogMissingNodeReconnects(t *testing.T) {
+	cfg := testConfig()
+	cfg.Watchdog = 10 * time.Millisecond
+	ts := newTestScroller(t, cfg, &fakeWriter{})
+	ts.device.Store(&evdev.InputDevice{Fn: filepath.Join(t.TempDir(), "event99"), Name: "Test Trackball"})
+	ts.lastEventAt.Store(time.Now().Add(-time.Second).UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errChan := make(chan error, 1)
+	go ts.runWatchdog(ctx, errChan)
+
+	select {
+	case err := <-errChan:
+		if !isDeviceGone(err) {
+			t.Fatalf("watchdog error %v is not treated as unplugged", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("watchdog did not report the missing device")
+	}
+}
@@ -0,0 +1,23 @@
+package trackballscroll
+
+import "time"
+
+// emaFilter smooths motion on one axis with an exponential moving average,
+// so a worn ball's alternating ±1 jitter cancels out instead of scrolling
+type emaFilter struct {
+	value  float64
+	lastAt time.Time
+}
+
+// filter folds a delta observed at t into the average and returns the
+// smoothed delta. weight is the share kept from past motion; a pause longer
+// than VELOCITY_RESET_GAP starts a fresh gesture
+func (f *emaFilter) filter(t time.Time, delta float64, weight float64) float64 {
+	if f.lastAt.IsZero() || t.Sub(f.lastAt) > VELOCITY_RESET_GAP {
+		f.value = delta
+	} else {
+		f.value = weight*f.value + (1-weight)*delta
+	}
+	f.lastAt = t
+	return f.value
+}
@@ -0,0 +1,26 @@
+package trackballscroll
+
+import "time"
+
+// softStart ramps scroll up over the start of each gesture, so resting a
+// finger on the ball doesn't scroll away
+type softStart struct {
+	startedAt time.Time
+	lastAt    time.Time
+}
+
+// factor records motion at t and returns how much of it to keep: rising
+// linearly from 0 at the start of a gesture to 1 after ramp. A pause longer
+// than VELOCITY_RESET_GAP starts a new gesture
+func (s *softStart) factor(t time.Time, ramp time.Duration) float64 {
+	if s.lastAt.IsZero() || t.Sub(s.lastAt) > VELOCITY_RESET_GAP {
+		s.startedAt = t
+	}
+	s.lastAt = t
+
+	elapsed := t.Sub(s.startedAt)
+	if elapsed >= ramp {
+		return 1
+	}
+	return float64(elapsed) / float64(ramp)
+}
@@ -0,0 +1,489 @@
+package trackballscroll
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// Linux uinput constants for virtual input device creation
+const (
+	UINPUT_PATH          = "/dev/uinput"
+	LEGACY_UINPUT_PATH   = "/dev/input/uinput" // where Android and some older systems put it
+	UINPUT_MAX_NAME_SIZE = 80
+	VIRTUAL_DEVICE_NAME  = "Trackball Scroll Device"
+	VIRTUAL_VENDOR_ID    = 0x1234
+	VIRTUAL_PRODUCT_ID   = 0x5678
+	VIRTUAL_PHYS_PREFIX  = "trackball-scroll/" // followed by <pid>/<source event node>/<seat>
+	VIRTUAL_POINTER_TAG  = " (pointer)"        // appended to the name of the pointer device of a split pair
+	VIRTUAL_SCROLL_TAG   = " (scroll)"         // and of the scroll device
+	VIRTUAL_VERSION      = 1
+	BUS_USB              = 0x03
+	BUS_BLUETOOTH        = 0x05
+	BUS_VIRTUAL          = 0x06
+	UINPUT_IOCTL_BASE    = 'U'
+	UI_SYSNAME_SIZE      = 64
+	ABS_CNT              = 0x40
+	INPUT_PROP_MAX       = 0x1f
+	SYSFS_INPUT_DIR      = "/sys/class/input"
+	EV_KEY               = 0x01
+	EV_REL               = 0x02
+	REL_X                = 0x00
+	REL_Y                = 0x01
+	REL_WHEEL            = 0x08
+	REL_HWHEEL           = 0x06
+	REL_WHEEL_HI_RES     = 0x0b
+	REL_HWHEEL_HI_RES    = 0x0c
+	HI_RES_PER_NOTCH     = 120 // hi-res wheel units per detent, fixed by the kernel ABI
+	EV_SYN               = 0x00
+	SYN_REPORT           = 0x00
+	BTN_LEFT             = 0x110
+	BTN_TASK             = 0x117 // last of the mouse buttons starting at BTN_LEFT
+	KEY_LEFTCTRL         = 0x1d
+)
+
+// uinput ioctl requests
+var (
+	UI_SET_EVBIT   = ioWrite(UINPUT_IOCTL_BASE, 100, SIZEOF_INT)
+	UI_SET_KEYBIT  = ioWrite(UINPUT_IOCTL_BASE, 101, SIZEOF_INT)
+	UI_SET_RELBIT  = ioWrite(UINPUT_IOCTL_BASE, 102, SIZEOF_INT)
+	UI_DEV_SETUP   = ioWrite(UINPUT_IOCTL_BASE, 3, unsafe.Sizeof(UinputSetup{}))
+	UI_DEV_CREATE  = ioNone(UINPUT_IOCTL_BASE, 1)
+	UI_DEV_DESTROY = ioNone(UINPUT_IOCTL_BASE, 2)
+	UI_GET_SYSNAME = ioRead(UINPUT_IOCTL_BASE, 44, UI_SYSNAME_SIZE)
+	UI_SET_PHYS    = ioWrite(UINPUT_IOCTL_BASE, 108, SIZEOF_POINTER) // takes a char *
+	UI_SET_PROPBIT = ioWrite(UINPUT_IOCTL_BASE, 110, SIZEOF_INT)
+)
+
+// INPUT_EVENT_SIZE is the size of the kernel's struct input_event: a pair of
+// longs for the time, then type, code and value. syscall.Timeval matches
+// those longs on every architecture, 32-bit ARM and x86 included
+const INPUT_EVENT_SIZE = 2*SIZEOF_POINTER + 8
+
+// InputEvent must be exactly INPUT_EVENT_SIZE, or writes to uinput are
+// rejected. These fail to compile if it is not
+var (
+	_ [INPUT_EVENT_SIZE - unsafe.Sizeof(InputEvent{})]struct{}
+	_ [unsafe.Sizeof(InputEvent{}) - INPUT_EVENT_SIZE]struct{}
+)
+
+// Which events a virtual device carries: all of them, or one half of a device
+// split by Config.SplitDevices
+const (
+	DEVICE_PART_ALL = iota
+	DEVICE_PART_POINTER
+	DEVICE_PART_SCROLL
+)
+
+// isPointerEvent reports whether an event belongs on the pointer device of a
+// split pair: pointer motion and the mouse buttons. Wheels and keys go to the
+// scroll device
+func isPointerEvent(evType, code uint16) bool {
+	switch evType {
+	case EV_REL:
+		return code == REL_X || code == REL_Y
+	case EV_KEY:
+		return code >= BTN_LEFT && code <= BTN_TASK
+	}
+	return false
+}
+
+// ownDevices holds the sysfs names (input42) of the virtual devices this
+// process created, so discovery never mistakes one for a trackball
+var ownDevices sync.Map
+
+// virtualSysname asks uinput for the sysfs name of the device created on fd
+func virtualSysname(fd int) (string, error) {
+	var name [UI_SYSNAME_SIZE]byte
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_GET_SYSNAME, uintptr(unsafe.Pointer(&name))); errno != 0 {
+		return "", fmt.Errorf("failed to get virtual device name: %v", errno)
+	}
+	return string(bytes.TrimRight(name[:], "\x00")), nil
+}
+
+// inputSysname returns the sysfs name of the input device behind an event
+// node, e.g. input42 for /dev/input/event7
+func inputSysname(devicePath string) string {
+	link := filepath.Join(SYSFS_INPUT_DIR, filepath.Base(resolveDevicePath(devicePath)), "device")
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// isOwnDevice reports whether a device is a virtual device created by this
+// process, or by another instance
+func isOwnDevice(device *evdev.InputDevice) bool {
+	if isVirtualDevice(device) {
+		return true
+	}
+	if sysname := inputSysname(device.Fn); sysname != "" {
+		_, own := ownDevices.Load(sysname)
+		return own
+	}
+	return false
+}
+
+// isVirtualDevice reports whether a device was created by any instance. The
+// phys is checked first since the name and IDs can be configured
+func isVirtualDevice(device *evdev.InputDevice) bool {
+	return strings.HasPrefix(device.Phys, VIRTUAL_PHYS_PREFIX) ||
+		strings.HasPrefix(device.Name, VIRTUAL_DEVICE_NAME) ||
+		(device.Vendor == VIRTUAL_VENDOR_ID && device.Product == VIRTUAL_PRODUCT_ID)
+}
+
+// DeviceIdentity is the name and IDs the virtual device presents, which
+// desktop settings and libinput quirks are keyed on. Zero fields keep the
+// defaults: a numbered VIRTUAL_DEVICE_NAME on BUS_USB with
+// VIRTUAL_VENDOR_ID, VIRTUAL_PRODUCT_ID and VIRTUAL_VERSION
+type DeviceIdentity struct {
+	Name    string
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+	Props   uint32 // INPUT_PROP_* bits to advertise
+}
+
+// cloneIdentity copies the name, IDs and properties of a source device, with
+// any non-zero field of overrides taking precedence
+func cloneIdentity(device *evdev.InputDevice, overrides DeviceIdentity) DeviceIdentity {
+	id := DeviceIdentity{
+		Name:    device.Name,
+		Bustype: device.Bustype,
+		Vendor:  device.Vendor,
+		Product: device.Product,
+		Version: device.Version,
+	}
+	if props, err := readDeviceProperties(device); err == nil {
+		id.Props = props
+	}
+
+	if overrides.Name != "" {
+		id.Name = overrides.Name
+	}
+	if overrides.Bustype != 0 {
+		id.Bustype = overrides.Bustype
+	}
+	if overrides.Vendor != 0 || overrides.Product != 0 {
+		id.Vendor, id.Product = overrides.Vendor, overrides.Product
+	}
+	if overrides.Version != 0 {
+		id.Version = overrides.Version
+	}
+	if overrides.Props != 0 {
+		id.Props = overrides.Props
+	}
+	return id
+}
+
+// withDefaults fills in the fields left zero
+func (id DeviceIdentity) withDefaults() DeviceIdentity {
+	if id.Name == "" {
+		id.Name = virtualDeviceName()
+	}
+	if id.Bustype == 0 {
+		id.Bustype = BUS_USB
+	}
+	if id.Vendor == 0 && id.Product == 0 {
+		id.Vendor, id.Product = VIRTUAL_VENDOR_ID, VIRTUAL_PRODUCT_ID
+	}
+	if id.Version == 0 {
+		id.Version = VIRTUAL_VERSION
+	}
+	return id
+}
+
+// ParseBusType accepts a bus by name (usb, bluetooth, virtual) or number
+func ParseBusType(value string) (uint16, error) {
+	switch strings.ToLower(value) {
+	case "usb":
+		return BUS_USB, nil
+	case "bluetooth":
+		return BUS_BLUETOOTH, nil
+	case "virtual":
+		return BUS_VIRTUAL, nil
+	}
+
+	bus, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown bus type %q: use usb, bluetooth, virtual or a number", value)
+	}
+	return uint16(bus), nil
+}
+
+// VirtualDevice is a virtual device left by another instance, which stays
+// until the process that created it exits
+type VirtualDevice struct {
+	Path  string
+	Name  string
+	Owner Process // from the device's phys, PID 0 if it was made by an older version
+}
+
+// FindVirtualDevices lists the virtual devices of other instances
+func FindVirtualDevices() []VirtualDevice {
+	var found []VirtualDevice
+	for _, path := range eventDevices() {
+		device, err := evdev.Open(path)
+		if err != nil {
+			continue
+		}
+		_, own := ownDevices.Load(inputSysname(path))
+		if isVirtualDevice(device) && !own {
+			found = append(found, VirtualDevice{Path: path, Name: device.Name, Owner: physOwner(device.Phys)})
+		}
+		device.File.Close()
+	}
+	return found
+}
+
+// physOwner reads the process that created a virtual device from its phys
+func physOwner(phys string) Process {
+	pidText, _, _ := strings.Cut(strings.TrimPrefix(phys, VIRTUAL_PHYS_PREFIX), "/")
+	pid, err := strconv.Atoi(pidText)
+	if !strings.HasPrefix(phys, VIRTUAL_PHYS_PREFIX) || err != nil {
+		return Process{}
+	}
+	return Process{PID: pid, Command: processCommand(pid)}
+}
+
+// virtualDeviceName picks a name no other instance's device is using, so
+// several instances can run side by side and be told apart
+func virtualDeviceName() string {
+	taken := make(map[string]bool)
+	for _, device := range FindVirtualDevices() {
+		name := strings.TrimSuffix(device.Name, VIRTUAL_POINTER_TAG)
+		taken[strings.TrimSuffix(name, VIRTUAL_SCROLL_TAG)] = true
+	}
+
+	name := VIRTUAL_DEVICE_NAME
+	for n := 2; taken[name]; n++ {
+		name = fmt.Sprintf("%s %d", VIRTUAL_DEVICE_NAME, n)
+	}
+	return name
+}
+
+// UinputSetup defines the virtual device configuration for uinput interface
+type UinputSetup struct {
+	ID   InputID
+	Name [UINPUT_MAX_NAME_SIZE]byte
+	_    uint32 // ff_effects_max (unused)
+}
+
+// UinputUserDev is the setup written to uinput on kernels before 4.5, which
+// lack UI_DEV_SETUP
+type UinputUserDev struct {
+	Name [UINPUT_MAX_NAME_SIZE]byte
+	ID   InputID
+	_    uint32             // ff_effects_max (unused)
+	_    [4 * ABS_CNT]int32 // absmax, absmin, absfuzz and absflat (unused)
+}
+
+// InputID contains device identification information
+type InputID struct {
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+}
+
+// InputEvent represents a Linux input event structure
+type InputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// createVirtualDevice creates a virtual uinput device for scroll and button
+// events, which also carries pointer motion when a scroll button is set, or
+// for the pointer or scroll part of them. phys identifies the process and
+// source device it belongs to
+func createVirtualDevice(cfg Config, id DeviceIdentity, phys string, part int) (int, error) {
+	fd, err := syscall.Open(UINPUT_PATH, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err == syscall.ENOENT {
+		if legacyFd, legacyErr := syscall.Open(LEGACY_UINPUT_PATH, syscall.O_WRONLY|syscall.O_NONBLOCK, 0); legacyErr == nil {
+			fd, err = legacyFd, nil
+		}
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %s: %w", UINPUT_PATH, err)
+	}
+
+	if err := configureDevice(fd, cfg, part); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	if err := setPhys(fd, phys); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	id = id.withDefaults()
+	switch part {
+	case DEVICE_PART_POINTER:
+		id.Name += VIRTUAL_POINTER_TAG
+	case DEVICE_PART_SCROLL:
+		id.Name += VIRTUAL_SCROLL_TAG
+	}
+	if err := setProps(fd, id.Props); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	if err := setupDevice(fd, id); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	if err := createDevice(fd); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	time.Sleep(DEVICE_SETUP_DELAY)
+	return fd, nil
+}
+
+type capability struct {
+	cmd   uintptr
+	value uintptr
+	name  string
+}
+
+// configureDevice advertises the events of part, DEVICE_PART_ALL for all
+func configureDevice(fd int, cfg Config, part int) error {
+	capabilities := []capability{{UI_SET_EVBIT, EV_SYN, "EV_SYN"}}
+	pointer := part != DEVICE_PART_SCROLL && cfg.movesPointer()
+	if part != DEVICE_PART_POINTER || pointer {
+		capabilities = append(capabilities, capability{UI_SET_EVBIT, EV_REL, "EV_REL"})
+	}
+
+	if part != DEVICE_PART_POINTER {
+		capabilities = append(capabilities,
+			capability{UI_SET_RELBIT, REL_WHEEL, "REL_WHEEL"},
+			capability{UI_SET_RELBIT, REL_HWHEEL, "REL_HWHEEL"},
+		)
+
+		// Only advertise hi-res wheels when we send them: libinput ignores
+		// the legacy wheel events of a device that claims hi-res support
+		if cfg.HiRes {
+			capabilities = append(capabilities,
+				capability{UI_SET_RELBIT, REL_WHEEL_HI_RES, "REL_WHEEL_HI_RES"},
+				capability{UI_SET_RELBIT, REL_HWHEEL_HI_RES, "REL_HWHEEL_HI_RES"},
+			)
+		}
+	}
+
+	if pointer {
+		capabilities = append(capabilities,
+			capability{UI_SET_RELBIT, REL_X, "REL_X"},
+			capability{UI_SET_RELBIT, REL_Y, "REL_Y"},
+		)
+	}
+
+	var keys []capability
+	if part != DEVICE_PART_SCROLL {
+		// Buttons are always forwarded since the physical device is grabbed
+		for btn := uintptr(BTN_LEFT); btn <= BTN_TASK; btn++ {
+			keys = append(keys, capability{UI_SET_KEYBIT, btn, fmt.Sprintf("button 0x%x", btn)})
+		}
+	}
+
+	if part != DEVICE_PART_POINTER {
+		if cfg.sendsCtrl() {
+			keys = append(keys, capability{UI_SET_KEYBIT, KEY_LEFTCTRL, "KEY_LEFTCTRL"})
+		}
+		for _, key := range cfg.extraKeys() {
+			keys = append(keys, capability{UI_SET_KEYBIT, uintptr(key), fmt.Sprintf("key 0x%x", key)})
+		}
+	}
+
+	if len(keys) > 0 {
+		capabilities = append(capabilities, capability{UI_SET_EVBIT, EV_KEY, "EV_KEY"})
+		capabilities = append(capabilities, keys...)
+	}
+
+	for _, cap := range capabilities {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cap.cmd, cap.value); errno != 0 {
+			return fmt.Errorf("failed to set %s: %v", cap.name, errno)
+		}
+	}
+
+	return nil
+}
+
+// setPhys sets the physical path reported for the device
+func setPhys(fd int, phys string) error {
+	path := append([]byte(phys), 0)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_SET_PHYS, uintptr(unsafe.Pointer(&path[0]))); errno != 0 {
+		return fmt.Errorf("failed to set phys: %v", errno)
+	}
+	return nil
+}
+
+// setProps advertises INPUT_PROP_* bits such as INPUT_PROP_POINTER
+func setProps(fd int, props uint32) error {
+	for bit := uintptr(0); bit <= INPUT_PROP_MAX; bit++ {
+		if props&(1<<bit) == 0 {
+			continue
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_SET_PROPBIT, bit); errno != 0 {
+			return fmt.Errorf("failed to set property 0x%x: %v", bit, errno)
+		}
+	}
+	return nil
+}
+
+func setupDevice(fd int, id DeviceIdentity) error {
+	var setup UinputSetup
+	copy(setup.Name[:UINPUT_MAX_NAME_SIZE-1], id.Name)
+	setup.ID.Bustype = id.Bustype
+	setup.ID.Vendor = id.Vendor
+	setup.ID.Product = id.Product
+	setup.ID.Version = id.Version
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_DEV_SETUP, uintptr(unsafe.Pointer(&setup)))
+	if errno == syscall.ENOTTY {
+		// Kernels before 4.5 don't know the ioctl. EINVAL means one that does
+		// rejected the setup, which the legacy interface would only hide
+		return setupLegacyDevice(fd, setup)
+	}
+	if errno != 0 {
+		return fmt.Errorf("failed to setup device: %v", errno)
+	}
+
+	return nil
+}
+
+// setupLegacyDevice sets the device up by writing a uinput_user_dev, as
+// kernels without UI_DEV_SETUP expect
+func setupLegacyDevice(fd int, setup UinputSetup) error {
+	dev := UinputUserDev{Name: setup.Name, ID: setup.ID}
+	size := int(unsafe.Sizeof(dev))
+	n, err := syscall.Write(fd, unsafe.Slice((*byte)(unsafe.Pointer(&dev)), size))
+	if err != nil {
+		return fmt.Errorf("failed to setup device: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("failed to setup device: wrote %d of %d bytes", n, size)
+	}
+	return nil
+}
+
+func createDevice(fd int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), UI_DEV_CREATE, 0); errno != 0 {
+		return fmt.Errorf("failed to create device: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package trackballscroll
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// runWatchdog checks that the source device keeps delivering events. After
+// cfg.Watchdog of silence it warns once and probes the device; if the device
+// has disappeared without the blocked read noticing, it reports an error on
+// errChan so the caller can shut down instead of hanging
+func (ts *Scroller) runWatchdog(ctx context.Context, errChan chan<- error) {
+	defer ts.cleanupOnPanic()
+	device := ts.Device()
+	ticker := time.NewTicker(ts.Config().Watchdog)
+	defer ticker.Stop()
+
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		silence := time.Since(time.Unix(0, ts.lastEventAt.Load()))
+		if silence < ts.Config().Watchdog {
+			warned = false
+			continue
+		}
+
+		if !warned {
+			slog.Warn("Watchdog: no events, probing device", "device", device.Fn, "silence", silence.Round(time.Millisecond))
+			warned = true
+		}
+
+		if err := probeDevice(device); err != nil {
+			errChan <- fmt.Errorf("watchdog: %w", err)
+			return
+		}
+	}
+}
+
+// CheckDevice has Run probe the device, for when it may have gone away
+// without the read noticing, such as across suspend. A device that has is
+// handled as unplugged
+func (ts *Scroller) CheckDevice() {
+	select {
+	case ts.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// probeDevice checks that the device node still exists and is still usable.
+// A zero-byte read returns immediately and fails with ENODEV once the kernel
+// has dropped the device. Errors wrap ENODEV, so isDeviceGone takes a node
+// that has disappeared, which fails with ENOENT, as unplugged too
+func probeDevice(device *evdev.InputDevice) error {
+	if _, err := os.Stat(device.Fn); err != nil {
+		return fmt.Errorf("device %s is gone: %w: %w", device.Fn, syscall.ENODEV, err)
+	}
+
+	if _, err := syscall.Read(int(device.File.Fd()), []byte{}); err == syscall.ENODEV {
+		return fmt.Errorf("device %s is gone: %w", device.Fn, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package trackballscroll
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+const DEFAULT_WHEEL_SENSITIVITY = 1.0
+
+// What the source device's vertical wheel or scroll ring sends, for
+// Config.WheelOutput
+const (
+	WHEEL_OUTPUT_VERTICAL   = "vertical"
+	WHEEL_OUTPUT_HORIZONTAL = "horizontal"
+	WHEEL_OUTPUT_ZOOM       = "zoom"
+	WHEEL_OUTPUT_KEYS       = "keys" // Config.WheelKeys
+)
+
+// ParseWheelKeys parses the keys a wheel sends per click up and down, e.g.
+// KEY_VOLUMEUP/KEY_VOLUMEDOWN
+func ParseWheelKeys(value string) ([2]uint16, error) {
+	up, down, ok := strings.Cut(value, "/")
+	if !ok {
+		return [2]uint16{}, fmt.Errorf("expected <up key>/<down key>, got %q", value)
+	}
+
+	var keys [2]uint16
+	for i, name := range []string{up, down} {
+		key, err := ParseKeyCode(strings.TrimSpace(name))
+		if err != nil {
+			return [2]uint16{}, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// passWheel forwards the source device's own wheel events, such as the
+// SlimBlade's twist or the Expert Mouse's scroll ring, scaled by
+// WheelSensitivity and remapped by WheelOutput
+func (ts *Scroller) passWheel(cfg *Config, event evdev.InputEvent) {
+	isHorizontal := event.Code == REL_HWHEEL
+	output := WHEEL_OUTPUT_VERTICAL
+	if !isHorizontal && cfg.WheelOutput != "" {
+		output = cfg.WheelOutput
+	}
+	if output == WHEEL_OUTPUT_HORIZONTAL {
+		isHorizontal = true
+	}
+
+	scroll := float64(event.Value) * cfg.WheelSensitivity
+	if cfg.InvertWheel {
+		scroll = -scroll
+	}
+
+	if cfg.HiRes && (output == WHEEL_OUTPUT_VERTICAL || output == WHEEL_OUTPUT_HORIZONTAL) {
+		hiRes := int32(math.Round(scroll * HI_RES_PER_NOTCH))
+		if cfg.DryRun {
+			printDryRun(isHorizontal, "wheel hi-res", hiRes, event.Value)
+		}
+		ts.sendHiResScroll(isHorizontal, hiRes)
+		ts.observers.ScrollLatency(time.Since(eventTime(event)))
+		return
+	}
+
+	remainder := &ts.wheelRemainderY
+	if isHorizontal {
+		remainder = &ts.wheelRemainderX
+	}
+	clicks := carry(remainder, scroll)
+	if clicks == 0 {
+		return
+	}
+
+	if cfg.DryRun {
+		printDryRun(isHorizontal, "wheel "+output, clicks, event.Value)
+	}
+	switch output {
+	case WHEEL_OUTPUT_ZOOM:
+		ts.sendZoomEvent(clicks)
+	case WHEEL_OUTPUT_KEYS:
+		ts.sendWheelKeys(cfg.WheelKeys, clicks)
+	default:
+		ts.sendScrollEvent(isHorizontal, clicks)
+	}
+	ts.observers.ScrollLatency(time.Since(eventTime(event)))
+}
+
+// sendWheelKeys taps the up key once per click up, or the down key per click
+// down
+func (ts *Scroller) sendWheelKeys(keys [2]uint16, clicks int32) error {
+	key := keys[0]
+	if clicks < 0 {
+		key, clicks = keys[1], -clicks
+	}
+
+	for i := int32(0); i < clicks; i++ {
+		if err := ts.sendEvent(EV_KEY, key, 1); err != nil {
+			return err
+		}
+		if err := ts.sendEvent(EV_KEY, key, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
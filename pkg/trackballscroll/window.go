@@ -0,0 +1,138 @@
+package trackballscroll
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How long to wait before starting xprop again after it exits
+const WINDOW_RETRY_DELAY = 5 * time.Second
+
+// xpropStringPattern matches the quoted strings of an xprop value, e.g.
+// WM_CLASS(STRING) = "code", "Code"
+var xpropStringPattern = regexp.MustCompile(`"([^"]*)"`)
+
+// WindowWatcher reports the WM_CLASS of the focused X11 window, its instance
+// and class names, whenever focus moves to a different one. It relies on
+// xprop and does nothing when no X display is reachable
+type WindowWatcher struct {
+	onChange func(wmClass []string)
+	window   string // ID of the focused window, as xprop prints it
+	last     string
+}
+
+// NewWindowWatcher returns a watcher that calls onChange from Run
+func NewWindowWatcher(onChange func(wmClass []string)) *WindowWatcher {
+	return &WindowWatcher{onChange: onChange}
+}
+
+// Run follows the focused window until ctx is done
+func (ww *WindowWatcher) Run(ctx context.Context) {
+	if os.Getenv("DISPLAY") == "" {
+		slog.Warn("Per-application settings disabled: no X display (DISPLAY is unset)")
+		return
+	}
+
+	warned := false
+	for {
+		err := ww.spy(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if !warned {
+			slog.Warn("Can't follow the focused window, per-application settings unavailable", "error", err)
+			warned = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(WINDOW_RETRY_DELAY):
+		}
+	}
+}
+
+// spy runs a single xprop that prints the root window's _NET_ACTIVE_WINDOW
+// at start and whenever it changes, and looks up the WM_CLASS of each newly
+// focused window. It returns when xprop exits
+func (ww *WindowWatcher) spy(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "xprop", "-spy", "-root", "_NET_ACTIVE_WINDOW")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return fmt.Errorf("xprop failed: %w", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		window, err := parseActiveWindow(scanner.Text())
+		if err != nil {
+			slog.Debug("Ignoring xprop output", "error", err)
+			continue
+		}
+		ww.focus(window)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("xprop failed: %w", err)
+	}
+	return errors.New("xprop exited")
+}
+
+// focus reports the WM_CLASS of window if it isn't the one already focused
+func (ww *WindowWatcher) focus(window string) {
+	if window == ww.window {
+		return
+	}
+	ww.window = window
+
+	wmClass := queryWindowClass(window)
+	if key := strings.Join(wmClass, "\x00"); key != ww.last {
+		ww.last = key
+		ww.onChange(wmClass)
+	}
+}
+
+// parseActiveWindow returns the window ID in a line of xprop output, e.g.
+// _NET_ACTIVE_WINDOW(WINDOW): window id # 0x3a00007
+func parseActiveWindow(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected xprop output %q", line)
+	}
+	window := fields[len(fields)-1]
+	if !strings.HasPrefix(window, "0x") {
+		return "", fmt.Errorf("unexpected xprop output %q", line)
+	}
+	return window, nil
+}
+
+// queryWindowClass returns the WM_CLASS strings of a window, or nothing for
+// 0x0, when no window has focus
+func queryWindowClass(window string) []string {
+	if window == "0x0" {
+		return nil
+	}
+
+	output, err := runDisplayCommand("xprop", "-id", window, "WM_CLASS")
+	if err != nil {
+		// The window may have closed in between
+		return nil
+	}
+
+	var wmClass []string
+	for _, match := range xpropStringPattern.FindAllStringSubmatch(output, -1) {
+		wmClass = append(wmClass, match[1])
+	}
+	return wmClass
+}
@@ -0,0 +1,93 @@
+package trackballscroll
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"syscall"
+)
+
+// runScroller processes events for one scroller until ctx is done or it
+// fails. With reconnect set an unplugged device is closed and replaced by the
+// next matching one that can be grabbed, so each scroller keeps its own
+// virtual device
+func runScroller(ctx context.Context, scroller *Scroller, devicePath string, detect Detection, reconnect bool) error {
+	for {
+		err := runDevice(ctx, scroller)
+		if err == nil {
+			return nil
+		}
+		if !reconnect || !isDeviceGone(err) {
+			return err
+		}
+
+		gone := scroller.Device()
+		slog.Warn("Device disconnected, waiting for it to return", "device", gone.Name)
+		gone.File.Close()
+		scroller.observers.DeviceDisconnected(gone)
+
+		device, err := WaitForTrackball(ctx, devicePath, detect)
+		if err != nil {
+			return fmt.Errorf("failed to wait for device: %w", err)
+		}
+		if device == nil {
+			return nil
+		}
+
+		if scroller.paused.Load() || !scroller.Config().grabs() {
+			device.Release()
+		}
+
+		scroller.device.Store(device)
+		scroller.idle.Store(false)
+		slog.Info("Reconnected", "device", device.Name)
+		scroller.observers.DeviceConnected(device)
+	}
+}
+
+// runDevice processes events from the scroller's current device until ctx is
+// done or it fails, with the watchdog able to cut a silent stall short
+func runDevice(ctx context.Context, scroller *Scroller) error {
+	reader, err := newPollReader(scroller.Device())
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Wake the read as soon as we are asked to stop
+	go func() {
+		<-ctx.Done()
+		reader.interrupt()
+	}()
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- scroller.processEvents(ctx, reader)
+	}()
+	watchdogErr := make(chan error, 1)
+	if scroller.Config().Watchdog > 0 {
+		go scroller.runWatchdog(ctx, watchdogErr)
+	}
+
+	for {
+		select {
+		case err := <-readErr:
+			return err
+		case err := <-watchdogErr:
+			// Let the read finish before its fds are closed
+			cancel()
+			<-readErr
+			return err
+		case <-scroller.recheck:
+			if err := probeDevice(scroller.Device()); err != nil {
+				cancel()
+				<-readErr
+				// Treated as unplugged, so Config.Reconnect opens it again
+				return fmt.Errorf("%w: %w", syscall.ENODEV, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to an unprivileged user once the
+// devices are open and grabbed, so the event loop doesn't run as root. The
+// group defaults to the user's primary group, and the user's supplementary
+// groups are kept so devices it may access can still be reopened
+func dropPrivileges(userName, groupName string) error {
+	account, err := lookupUser(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q for user %s", account.Uid, account.Username)
+	}
+
+	gidString := account.Gid
+	if groupName != "" {
+		group, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidString = group.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q", gidString)
+	}
+
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == uid {
+			return nil
+		}
+		return fmt.Errorf("switching to user %s needs root", account.Username)
+	}
+
+	groups := []int{gid}
+	if accountGroups, err := userGroups(account); err == nil {
+		groups = append(groups, accountGroups...)
+	}
+
+	// Group changes need root, so they go before the user change
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user %s: %w", account.Username, err)
+	}
+
+	// Make sure root can't be regained
+	if err := syscall.Setuid(0); err == nil {
+		return fmt.Errorf("still able to regain root after switching to %s", account.Username)
+	}
+
+	slog.Info("Dropped privileges", "user", account.Username, "uid", uid, "gid", gid)
+	return nil
+}
+
+// lookupUser finds a user by name or numeric ID
+func lookupUser(name string) (*user.User, error) {
+	account, err := user.Lookup(name)
+	if err == nil {
+		return account, nil
+	}
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		if account, err := user.LookupId(name); err == nil {
+			return account, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown user %q: %w", name, err)
+}
+
+// lookupGroup finds a group by name or numeric ID
+func lookupGroup(name string) (*user.Group, error) {
+	group, err := user.LookupGroup(name)
+	if err == nil {
+		return group, nil
+	}
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		if group, err := user.LookupGroupId(name); err == nil {
+			return group, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown group %q: %w", name, err)
+}
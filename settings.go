@@ -0,0 +1,348 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// ACTION_PROFILE is the -chord action that switches to the next profile, or
+// with ":<name>" after it to that one
+const ACTION_PROFILE = "profile"
+
+// runtimeOptions are the options set accepts: tuning that takes effect
+// without a restart. The rest, such as -filter, -config, -user or -pidfile,
+// run commands or name files, so only the command line and config file can
+// give them
+var runtimeOptions = []string{
+	"sensitivity", "sensitivity-x", "sensitivity-y",
+	"deadzone", "deadzone-x", "deadzone-y",
+	"invert-x", "invert-y", "swap-axes",
+	"click-cooldown-ms", "anti-overshoot", "intent-threshold", "palmcheck-ms",
+	"double-tap-ms", "chord-window-ms",
+	"notch-counts", "wheel-sensitivity", "invert-wheel", "key-threshold", "circular-degrees",
+	"accel", "pointer-sensitivity", "pointer-accel", "accel-exponent", "curve",
+	"ballistics", "ballistics-slow-speed", "ballistics-fast-speed", "ballistics-slow-gain", "ballistics-fast-gain",
+	"smoothing", "max-scroll-rate", "max-scroll-step", "kinetic-friction",
+	"axis-lock", "axis-lock-timeout-ms", "axis-snap-ratio", "soft-start-ms",
+}
+
+// settings re-reads the command line and config file and applies the result
+// to every running scroller, along with the config file's table for the
+// focused application
+type settings struct {
+	mu        sync.Mutex
+	scrollers []*trackballscroll.Scroller
+	args      []string
+	overrides []string // options given to set, as arguments
+	apps      []string // application tables in the config file
+	app       string   // table in use, "" for none
+	profile   string   // last profile loaded, "" for none
+
+	onProfile func(name string) // called after a profile is loaded, if set
+}
+
+func newSettings(scrollers []*trackballscroll.Scroller, args []string, apps map[string]map[string]interface{}) *settings {
+	s := &settings{scrollers: scrollers, args: args}
+	s.setApps(apps)
+	return s
+}
+
+// reload re-reads the settings, keeping the old ones on error
+func (s *settings) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(s.args, s.app)
+}
+
+// load switches to settings read from other arguments, e.g. another -config,
+// keeping the options given to set
+func (s *settings) load(args []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	args = append(args[:len(args):len(args)], s.overrides...)
+	if err := s.apply(args, s.app); err != nil {
+		return err
+	}
+	s.args = args
+	return nil
+}
+
+// set applies option=value pairs, such as sensitivity=0.5, on top of the
+// current settings. They stay in effect across reloads, like options given on
+// the command line. Only runtimeOptions can be set
+func (s *settings) set(values []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	args := append([]string{}, s.args...)
+	overrides := append([]string{}, s.overrides...)
+	for _, value := range values {
+		name, _, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected option=value, got %q", value)
+		}
+		if !slices.Contains(runtimeOptions, name) {
+			return fmt.Errorf("-%s can't be set at runtime, give it on the command line or in the config file", name)
+		}
+		args = append(args, "-"+value)
+		overrides = append(overrides, "-"+value)
+	}
+
+	if err := s.apply(args, s.app); err != nil {
+		return err
+	}
+	s.args, s.overrides = args, overrides
+	return nil
+}
+
+// loadProfile switches to a named profile: a [profiles.<name>] table of the
+// config file, or else a profile's own config file, keeping the other
+// command-line options and those given to set. An empty name goes back to
+// the settings at startup, plus those given to set
+func (s *settings) loadProfile(name string) error {
+	args := append([]string{}, os.Args[1:]...)
+	opts, err := parseOptions(args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := opts.profiles[name]; ok {
+		args = append(args, "-profile", name)
+	} else if name != "" {
+		path, err := profilePath(name)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-config", path, "-profile", "")
+	}
+	if err := s.load(args); err != nil {
+		return err
+	}
+
+	if name == "" {
+		name = opts.Profile
+	}
+	s.mu.Lock()
+	s.profile = name
+	s.mu.Unlock()
+	if s.onProfile != nil {
+		s.onProfile(name)
+	}
+	return nil
+}
+
+// nextProfile switches to the profile after the current one, going back to
+// the settings at startup after the last
+func (s *settings) nextProfile() error {
+	profiles := s.profiles()
+	current := s.currentProfile()
+	next := ""
+	for i, name := range profiles {
+		if name == current && i+1 < len(profiles) {
+			next = profiles[i+1]
+			break
+		}
+	}
+	if current == "" && len(profiles) > 0 {
+		next = profiles[0]
+	}
+	return s.loadProfile(next)
+}
+
+// profiles returns the names of the profiles loadProfile can switch to: the
+// [profiles.<name>] tables of the config file given at startup, then the
+// profile config files not named the same
+func (s *settings) profiles() []string {
+	var names []string
+	if opts, err := parseOptions(os.Args[1:], flag.ContinueOnError); err == nil {
+		for name := range opts.profiles {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	files, _ := listProfiles()
+	for _, name := range files {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// currentProfile returns the last profile loaded, or "" if none was
+func (s *settings) currentProfile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profile
+}
+
+// values returns every option by name with the value currently in effect,
+// except secrets
+func (s *settings) values() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, flags, err := parseFlags(s.args, flag.ContinueOnError, s.app)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name != "api-token" {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values, nil
+}
+
+// save writes the current value of each named option to the config file in
+// use, or the user config file if there is none, and returns its path
+func (s *settings) save(names []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	opts, flags, err := parseFlags(s.args, flag.ContinueOnError, s.app)
+	if err != nil {
+		return "", err
+	}
+	path := opts.ConfigPath
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find config directory: %w", err)
+		}
+		path = filepath.Join(dir, CONFIG_DIR_NAME, CONFIG_FILE_NAME)
+	}
+
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil {
+			return "", fmt.Errorf("unknown option %q", name)
+		}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return "", fmt.Errorf("-%s can't be saved, edit %s instead", name, path)
+		}
+		value := f.Value.String()
+		if _, ok := getter.Get().(string); ok {
+			value = strconv.Quote(value)
+		}
+		if err := saveSetting(path, name, value); err != nil {
+			return "", err
+		}
+	}
+	slog.Info("Saved settings", "config", path, "options", names)
+	return path, nil
+}
+
+// focus applies the table of the application with the given WM_CLASS, or
+// the plain settings when it has none
+func (s *settings) focus(wmClass []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := matchApp(s.apps, wmClass)
+	if app == s.app {
+		return
+	}
+	if err := s.apply(s.args, app); err != nil {
+		slog.Error("Failed to apply application settings", "app", app, "error", err)
+		return
+	}
+	s.app = app
+}
+
+// apply reads the settings for args and app and hands them to the scrollers
+func (s *settings) apply(args []string, app string) error {
+	opts, err := parseAppOptions(args, flag.ContinueOnError, app)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := opts.scrollerConfig()
+	if err != nil {
+		return err
+	}
+
+	// Check every device's settings before changing any
+	configs := make([]trackballscroll.Config, len(s.scrollers))
+	for i, scroller := range s.scrollers {
+		if configs[i], err = opts.deviceConfig(cfg, args, app, scroller.Device()); err != nil {
+			return err
+		}
+	}
+	for i, scroller := range s.scrollers {
+		scroller.SetConfig(configs[i])
+	}
+	s.setApps(opts.apps)
+
+	if app != "" {
+		slog.Info("Applied application settings", "app", app)
+	} else {
+		slog.Info("Reloaded settings", "config", opts.ConfigPath)
+	}
+	return nil
+}
+
+func (s *settings) setApps(apps map[string]map[string]interface{}) {
+	s.apps = s.apps[:0]
+	for app := range apps {
+		s.apps = append(s.apps, app)
+	}
+	sort.Strings(s.apps)
+}
+
+// matchApp returns the application table named after one of the WM_CLASS
+// strings, the instance or the class name, ignoring case
+func matchApp(apps []string, wmClass []string) string {
+	for _, name := range wmClass {
+		for _, app := range apps {
+			if strings.EqualFold(app, name) {
+				return app
+			}
+		}
+	}
+	return ""
+}
+
+// validChordAction reports whether action is one chordActions carries out
+func validChordAction(action string) bool {
+	name, found := strings.CutPrefix(action, ACTION_PROFILE+":")
+	return action == ACTION_PROFILE || found && name != ""
+}
+
+// chordActions carries out the actions of -chord, which the scrollers only
+// report
+type chordActions struct {
+	trackballscroll.NopObserver
+
+	settings *settings // set once the scrollers exist, before they run
+}
+
+func (a *chordActions) ChordAction(device *evdev.InputDevice, action string) {
+	// Loading a profile reconfigures the scrollers, so not from their
+	// goroutine
+	go func() {
+		var err error
+		if name, found := strings.CutPrefix(action, ACTION_PROFILE+":"); found {
+			err = a.settings.loadProfile(name)
+		} else if action == ACTION_PROFILE {
+			err = a.settings.nextProfile()
+		}
+		if err != nil {
+			slog.Error("Failed to switch profile", "device", device.Name, "error", err)
+		}
+	}()
+}
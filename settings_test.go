@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeOptionsExist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, flags, err := parseFlags([]string{"-config", path}, flag.ContinueOnError, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range runtimeOptions {
+		if flags.Lookup(name) == nil {
+			t.Errorf("runtime option -%s is not an option", name)
+		}
+	}
+}
+
+func TestSetRejectsStartupOptions(t *testing.T) {
+	for _, value := range []string{
+		"filter=touch /tmp/x",
+		"config=/tmp/x.toml",
+		"user=root",
+		"pidfile=/tmp/x.pid",
+		"-filter=touch /tmp/x",
+	} {
+		t.Run(value, func(t *testing.T) {
+			s := newSettings(nil, nil, nil)
+			err := s.set([]string{"sensitivity=2", value})
+			if err == nil || !strings.Contains(err.Error(), "can't be set at runtime") {
+				t.Errorf("set(%q) = %v, want a runtime error", value, err)
+			}
+			if len(s.args) != 0 {
+				t.Errorf("set(%q) kept args %q", value, s.args)
+			}
+		})
+	}
+}
+
+func TestLoadProfileKeepsSetValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := "[profiles.reading]\ndeadzone = 5\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := os.Args
+	os.Args = []string{"trackball-scroll", "-config", path}
+	defer func() { os.Args = args }()
+
+	s := newSettings(nil, os.Args[1:], nil)
+	if err := s.set([]string{"sensitivity=2", "deadzone=3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		profile  string
+		deadZone string
+	}{
+		// The profile's table wins over set, which is kept for the rest
+		{"reading", "5"},
+		{"", "3"},
+	} {
+		if err := s.loadProfile(test.profile); err != nil {
+			t.Fatalf("loadProfile(%q): %v", test.profile, err)
+		}
+		values, err := s.values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values["sensitivity"] != "2" || values["deadzone"] != test.deadZone {
+			t.Errorf("after loadProfile(%q): sensitivity %s, deadzone %s, want 2 and %s",
+				test.profile, values["sensitivity"], values["deadzone"], test.deadZone)
+		}
+	}
+}
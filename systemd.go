@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SERVICE_FILE_NAME    = "trackball-scroll.service"
+	SERVICE_WATCHDOG_SEC = 10
+	SERVICE_START_EXTEND = 30 * time.Second // start timeout granted at a time while waiting for a device
+)
+
+// sdNotify sends a state string such as "READY=1" to systemd when running as
+// a Type=notify service, and does nothing otherwise
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to reach systemd: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// extendStartup keeps systemd from failing a Type=notify service that is
+// still waiting for its device, asking for more time until stop is called
+func extendStartup() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(SERVICE_START_EXTEND / 2)
+		defer ticker.Stop()
+
+		for {
+			sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", SERVICE_START_EXTEND.Microseconds()))
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, or 0
+// if WatchdogSec isn't set for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSystemdWatchdog pings systemd at half its watchdog interval until ctx is done
+func runSystemdWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Watchdog ping failed", "error", err)
+			}
+		}
+	}
+}
+
+// installService writes a systemd user unit that runs this executable with
+// args as its options
+func installService(args []string) error {
+	// Catch mistakes now rather than when the service starts
+	if _, err := parseOptions(args, flag.ContinueOnError); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return fmt.Errorf("failed to find config directory: %w", err)
+	}
+
+	command := []string{systemdQuote(executable)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+
+	unit := fmt.Sprintf(`[Unit]
+Description=Trackball scroll converter
+
+[Service]
+Type=notify
+ExecStart=%s
+WatchdogSec=%d
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, strings.Join(command, " "), SERVICE_WATCHDOG_SEC)
+
+	dir := filepath.Join(configDir, "systemd", "user")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, SERVICE_FILE_NAME)
+	if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	fmt.Printf("Wrote %s\n", path)
+	fmt.Println("Enable it with: systemctl --user daemon-reload && systemctl --user enable --now trackball-scroll")
+	return nil
+}
+
+// systemdQuote escapes a word for an ExecStart= line, quoting it when needed
+func systemdQuote(word string) string {
+	word = strings.NewReplacer("%", "%%", "$", "$$").Replace(word)
+	if word != "" && !strings.ContainsAny(word, " \t\"'\\;") {
+		return word
+	}
+	return strconv.Quote(word)
+}
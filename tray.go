@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/yourusername/trackball-scroll/pkg/trackballscroll"
+)
+
+// The tray icon is a StatusNotifierItem with a com.canonical.dbusmenu menu,
+// which desktop panels show without this program linking a GUI toolkit
+const (
+	SNI_PATH           = dbus.ObjectPath("/StatusNotifierItem")
+	SNI_INTERFACE      = "org.kde.StatusNotifierItem"
+	SNI_WATCHER        = "org.kde.StatusNotifierWatcher"
+	SNI_WATCHER_PATH   = dbus.ObjectPath("/StatusNotifierWatcher")
+	DBUSMENU_PATH      = dbus.ObjectPath("/MenuBar")
+	DBUSMENU_INTERFACE = "com.canonical.dbusmenu"
+
+	TRAY_ICON        = "input-mouse"
+	TRAY_PAUSED_ICON = "media-playback-pause"
+	TRAY_POLL        = time.Second // how often the icon catches up with changes made elsewhere
+)
+
+// SENSITIVITY_PRESETS are offered in the tray menu
+var SENSITIVITY_PRESETS = []float64{0.1, 0.2, 0.3, 0.5, 0.8, 1.2}
+
+// Menu item IDs. Profiles and presets are numbered from their base
+const (
+	MENU_ROOT        = 0
+	MENU_STATUS      = 1
+	MENU_PAUSE       = 2
+	MENU_PROFILES    = 3
+	MENU_SENSITIVITY = 4
+	MENU_SEPARATOR   = 5
+	MENU_PROFILE     = 100
+	MENU_PRESET      = 200
+)
+
+// menuLayout is a dbusmenu item with its children, (ia{sv}av) on the bus
+type menuLayout struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+	Children   []dbus.Variant
+}
+
+// menuItemProperties is one item's properties in GetGroupProperties replies
+type menuItemProperties struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+}
+
+// menuEvent is one event in EventGroup calls
+type menuEvent struct {
+	ID        int32
+	EventID   string
+	Data      dbus.Variant
+	Timestamp uint32
+}
+
+// tooltip is the StatusNotifierItem ToolTip, (sa(iiay)ss) on the bus
+type tooltip struct {
+	IconName   string
+	IconPixmap []iconPixmap
+	Title      string
+	Text       string
+}
+
+type iconPixmap struct {
+	Width, Height int32
+	Data          []byte
+}
+
+// tray shows the daemon's state in the desktop panel, with a menu to pause,
+// switch profiles and pick a sensitivity
+type tray struct {
+	conn      *dbus.Conn
+	props     *prop.Properties
+	scrollers []*trackballscroll.Scroller
+	settings  *settings
+
+	mu       sync.Mutex
+	paused   bool
+	profiles []string
+	shown    string // everything the icon and menu show, to tell when it changes
+	revision uint32 // of the menu layout, bumped whenever it changes
+}
+
+// sniItem holds the methods exported on SNI_INTERFACE
+type sniItem struct {
+	tray *tray
+}
+
+// dbusMenu holds the methods exported on DBUSMENU_INTERFACE
+type dbusMenu struct {
+	tray *tray
+}
+
+// newTray puts an icon in the panel for scrollers, whose settings are changed
+// through current. It fails if no panel on the session bus shows
+// StatusNotifierItems
+func newTray(scrollers []*trackballscroll.Scroller, current *settings) (*tray, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+
+	t := &tray{conn: conn, scrollers: scrollers, settings: current, revision: 1}
+	t.update()
+	if err := t.export(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	name := fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid())
+	if _, err := conn.RequestName(name, dbus.NameFlagDoNotQueue); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request %s: %w", name, err)
+	}
+	watcher := conn.Object(SNI_WATCHER, SNI_WATCHER_PATH)
+	if err := watcher.Call(SNI_WATCHER+".RegisterStatusNotifierItem", 0, name).Err; err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no tray to show the icon in: %w", err)
+	}
+	return t, nil
+}
+
+// export makes the item, its menu and their properties callable
+func (t *tray) export() error {
+	item := &sniItem{tray: t}
+	menu := &dbusMenu{tray: t}
+	if err := t.conn.Export(item, SNI_PATH, SNI_INTERFACE); err != nil {
+		return fmt.Errorf("failed to export %s: %w", SNI_PATH, err)
+	}
+	if err := t.conn.Export(menu, DBUSMENU_PATH, DBUSMENU_INTERFACE); err != nil {
+		return fmt.Errorf("failed to export %s: %w", DBUSMENU_PATH, err)
+	}
+
+	props, err := prop.Export(t.conn, SNI_PATH, prop.Map{
+		SNI_INTERFACE: {
+			"Category":            {Value: "Hardware", Emit: prop.EmitConst},
+			"Id":                  {Value: "trackball-scroll", Emit: prop.EmitConst},
+			"Title":               {Value: "Trackball Scroll", Emit: prop.EmitConst},
+			"Status":              {Value: "Active", Emit: prop.EmitConst},
+			"WindowId":            {Value: uint32(0), Emit: prop.EmitConst},
+			"IconName":            {Value: t.iconName(), Emit: prop.EmitFalse},
+			"IconPixmap":          {Value: []iconPixmap{}, Emit: prop.EmitConst},
+			"OverlayIconName":     {Value: "", Emit: prop.EmitConst},
+			"AttentionIconName":   {Value: "", Emit: prop.EmitConst},
+			"AttentionIconPixmap": {Value: []iconPixmap{}, Emit: prop.EmitConst},
+			"ToolTip":             {Value: t.tooltip(), Emit: prop.EmitFalse},
+			"ItemIsMenu":          {Value: false, Emit: prop.EmitConst},
+			"Menu":                {Value: DBUSMENU_PATH, Emit: prop.EmitConst},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export tray properties: %w", err)
+	}
+	t.props = props
+	if _, err := prop.Export(t.conn, DBUSMENU_PATH, prop.Map{
+		DBUSMENU_INTERFACE: {
+			"Version":       {Value: uint32(3), Emit: prop.EmitConst},
+			"TextDirection": {Value: "ltr", Emit: prop.EmitConst},
+			"Status":        {Value: "normal", Emit: prop.EmitConst},
+			"IconThemePath": {Value: []string{}, Emit: prop.EmitConst},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to export menu properties: %w", err)
+	}
+
+	for path, node := range map[dbus.ObjectPath]*introspect.Node{
+		SNI_PATH: {Name: string(SNI_PATH), Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{Name: SNI_INTERFACE, Methods: introspect.Methods(item), Properties: props.Introspection(SNI_INTERFACE),
+				Signals: []introspect.Signal{{Name: "NewIcon"}, {Name: "NewToolTip"}}},
+		}},
+		DBUSMENU_PATH: {Name: string(DBUSMENU_PATH), Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{Name: DBUSMENU_INTERFACE, Methods: introspect.Methods(menu),
+				Signals: []introspect.Signal{{Name: "LayoutUpdated", Args: []introspect.Arg{{Name: "revision", Type: "u"}, {Name: "parent", Type: "i"}}}}},
+		}},
+	} {
+		if err := t.conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable"); err != nil {
+			return fmt.Errorf("failed to export introspection data: %w", err)
+		}
+	}
+	return nil
+}
+
+// run keeps the icon up to date with changes from SIGUSR1, ctl and the like
+// until ctx is done
+func (t *tray) run(ctx context.Context) {
+	ticker := time.NewTicker(TRAY_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.update()
+		}
+	}
+}
+
+// close removes the icon
+func (t *tray) close() {
+	t.conn.Close()
+}
+
+// update shows the current pause state, profiles and sensitivity,
+// signalling the panel if they changed
+func (t *tray) update() {
+	paused := t.isPaused()
+	profiles := t.settings.profiles()
+	shown := fmt.Sprint(paused, profiles, t.settings.currentProfile(), t.scrollers[0].Config().SensitivityY)
+
+	t.mu.Lock()
+	changed := shown != t.shown
+	t.paused, t.profiles, t.shown = paused, profiles, shown
+	t.mu.Unlock()
+	if changed && t.props != nil {
+		t.changed()
+	}
+}
+
+// changed tells the panel to fetch the icon, tooltip and menu again
+func (t *tray) changed() {
+	t.props.SetMust(SNI_INTERFACE, "IconName", t.iconName())
+	t.props.SetMust(SNI_INTERFACE, "ToolTip", t.tooltip())
+	t.emit(SNI_PATH, SNI_INTERFACE+".NewIcon")
+	t.emit(SNI_PATH, SNI_INTERFACE+".NewToolTip")
+
+	t.mu.Lock()
+	t.revision++
+	revision := t.revision
+	t.mu.Unlock()
+	t.emit(DBUSMENU_PATH, DBUSMENU_INTERFACE+".LayoutUpdated", revision, int32(MENU_ROOT))
+}
+
+func (t *tray) emit(path dbus.ObjectPath, signal string, values ...interface{}) {
+	if err := t.conn.Emit(path, signal, values...); err != nil {
+		slog.Warn("Failed to emit D-Bus signal", "signal", signal, "error", err)
+	}
+}
+
+func (t *tray) isPaused() bool {
+	return t.scrollers[0].Paused()
+}
+
+func (t *tray) iconName() string {
+	if t.isPaused() {
+		return TRAY_PAUSED_ICON
+	}
+	return TRAY_ICON
+}
+
+func (t *tray) tooltip() tooltip {
+	text := "Scrolling"
+	if t.isPaused() {
+		text = "Paused"
+	}
+	if profile := t.settings.currentProfile(); profile != "" {
+		text += ", profile " + profile
+	}
+	return tooltip{IconName: t.iconName(), IconPixmap: []iconPixmap{}, Title: "Trackball Scroll", Text: text}
+}
+
+// togglePause pauses or resumes every device, as SIGUSR1 does
+func (t *tray) togglePause() {
+	togglePause(t.scrollers)
+	t.update()
+}
+
+// menu builds the whole menu as it should look now
+func (t *tray) menu() menuLayout {
+	t.mu.Lock()
+	paused, profiles := t.paused, t.profiles
+	t.mu.Unlock()
+
+	status := "Scrolling"
+	if paused {
+		status = "Paused"
+	}
+	toggle := func(id int32, label, kind string, on bool) menuLayout {
+		state := int32(0)
+		if on {
+			state = 1
+		}
+		return menuItem(id, map[string]dbus.Variant{
+			"label":        dbus.MakeVariant(label),
+			"toggle-type":  dbus.MakeVariant(kind),
+			"toggle-state": dbus.MakeVariant(state),
+		})
+	}
+
+	var profileItems []menuLayout
+	current := t.settings.currentProfile()
+	for i, name := range profiles {
+		profileItems = append(profileItems, toggle(int32(MENU_PROFILE+i), name, "radio", name == current))
+	}
+	if len(profileItems) == 0 {
+		profileItems = append(profileItems, menuItem(MENU_PROFILE, map[string]dbus.Variant{
+			"label":   dbus.MakeVariant("No profiles"),
+			"enabled": dbus.MakeVariant(false),
+		}))
+	}
+
+	var presetItems []menuLayout
+	sensitivity := t.scrollers[0].Config().SensitivityY
+	for i, preset := range SENSITIVITY_PRESETS {
+		presetItems = append(presetItems, toggle(int32(MENU_PRESET+i), strconv.FormatFloat(preset, 'g', -1, 64), "radio", preset == sensitivity))
+	}
+
+	return menuItem(MENU_ROOT, map[string]dbus.Variant{"children-display": dbus.MakeVariant("submenu")},
+		menuItem(MENU_STATUS, map[string]dbus.Variant{
+			"label":   dbus.MakeVariant(status),
+			"enabled": dbus.MakeVariant(false),
+		}),
+		toggle(MENU_PAUSE, "Paused", "checkmark", paused),
+		menuItem(MENU_SEPARATOR, map[string]dbus.Variant{"type": dbus.MakeVariant("separator")}),
+		menuItem(MENU_PROFILES, map[string]dbus.Variant{
+			"label":            dbus.MakeVariant("Profile"),
+			"children-display": dbus.MakeVariant("submenu"),
+		}, profileItems...),
+		menuItem(MENU_SENSITIVITY, map[string]dbus.Variant{
+			"label":            dbus.MakeVariant("Sensitivity"),
+			"children-display": dbus.MakeVariant("submenu"),
+		}, presetItems...),
+	)
+}
+
+func menuItem(id int32, properties map[string]dbus.Variant, children ...menuLayout) menuLayout {
+	item := menuLayout{ID: id, Properties: properties, Children: []dbus.Variant{}}
+	for _, child := range children {
+		item.Children = append(item.Children, dbus.MakeVariant(child))
+	}
+	return item
+}
+
+// find returns the item with id in layout
+func (layout menuLayout) find(id int32) (menuLayout, bool) {
+	if layout.ID == id {
+		return layout, true
+	}
+	for _, child := range layout.Children {
+		if item, ok := child.Value().(menuLayout).find(id); ok {
+			return item, true
+		}
+	}
+	return menuLayout{}, false
+}
+
+// clicked carries out the menu item with id
+func (t *tray) clicked(id int32) error {
+	switch {
+	case id == MENU_PAUSE:
+		t.togglePause()
+	case id >= MENU_PRESET && int(id-MENU_PRESET) < len(SENSITIVITY_PRESETS):
+		preset := SENSITIVITY_PRESETS[id-MENU_PRESET]
+		if err := t.settings.set([]string{fmt.Sprintf("sensitivity=%g", preset)}); err != nil {
+			return err
+		}
+		t.update()
+	case id >= MENU_PROFILE && id < MENU_PRESET:
+		t.mu.Lock()
+		var name string
+		if i := int(id - MENU_PROFILE); i < len(t.profiles) {
+			name = t.profiles[i]
+		}
+		t.mu.Unlock()
+		if name == "" {
+			return nil
+		}
+		if err := t.settings.loadProfile(name); err != nil {
+			return err
+		}
+		t.update()
+	}
+	return nil
+}
+
+// Activate toggles pausing when the icon is clicked
+func (i *sniItem) Activate(x, y int32) *dbus.Error {
+	i.tray.togglePause()
+	return nil
+}
+
+// SecondaryActivate is a middle click, which does nothing
+func (i *sniItem) SecondaryActivate(x, y int32) *dbus.Error {
+	return nil
+}
+
+// ContextMenu is only called by panels that can't show Menu themselves
+func (i *sniItem) ContextMenu(x, y int32) *dbus.Error {
+	return nil
+}
+
+// Scroll over the icon does nothing
+func (i *sniItem) Scroll(delta int32, orientation string) *dbus.Error {
+	return nil
+}
+
+// GetLayout returns the menu from parentID down
+func (m *dbusMenu) GetLayout(parentID int32, recursionDepth int32, propertyNames []string) (uint32, menuLayout, *dbus.Error) {
+	m.tray.mu.Lock()
+	revision := m.tray.revision
+	m.tray.mu.Unlock()
+
+	layout, ok := m.tray.menu().find(parentID)
+	if !ok {
+		return 0, menuLayout{}, dbus.MakeFailedError(fmt.Errorf("no menu item %d", parentID))
+	}
+	return revision, layout, nil
+}
+
+// GetGroupProperties returns the properties of the items with ids, or of
+// every item if ids is empty
+func (m *dbusMenu) GetGroupProperties(ids []int32, propertyNames []string) ([]menuItemProperties, *dbus.Error) {
+	var items []menuItemProperties
+	var collect func(layout menuLayout)
+	collect = func(layout menuLayout) {
+		for _, id := range ids {
+			if id == layout.ID {
+				items = append(items, menuItemProperties{ID: layout.ID, Properties: layout.Properties})
+			}
+		}
+		if len(ids) == 0 {
+			items = append(items, menuItemProperties{ID: layout.ID, Properties: layout.Properties})
+		}
+		for _, child := range layout.Children {
+			collect(child.Value().(menuLayout))
+		}
+	}
+	collect(m.tray.menu())
+	return items, nil
+}
+
+// GetProperty returns one property of an item
+func (m *dbusMenu) GetProperty(id int32, name string) (dbus.Variant, *dbus.Error) {
+	item, ok := m.tray.menu().find(id)
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("no menu item %d", id))
+	}
+	value, ok := item.Properties[name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("menu item %d has no %s", id, name))
+	}
+	return value, nil
+}
+
+// Event handles a click on an item
+func (m *dbusMenu) Event(id int32, eventID string, data dbus.Variant, timestamp uint32) *dbus.Error {
+	if eventID != "clicked" {
+		return nil
+	}
+	if err := m.tray.clicked(id); err != nil {
+		slog.Error("Tray menu action failed", "error", err)
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// EventGroup handles several events, returning the IDs of unknown items
+func (m *dbusMenu) EventGroup(events []menuEvent) ([]int32, *dbus.Error) {
+	menu := m.tray.menu()
+	var unknown []int32
+	for _, event := range events {
+		if _, ok := menu.find(event.ID); !ok {
+			unknown = append(unknown, event.ID)
+			continue
+		}
+		if err := m.Event(event.ID, event.EventID, event.Data, event.Timestamp); err != nil {
+			return unknown, err
+		}
+	}
+	return unknown, nil
+}
+
+// AboutToShow rereads the profiles before the menu opens, reporting whether
+// it changed
+func (m *dbusMenu) AboutToShow(id int32) (bool, *dbus.Error) {
+	m.tray.mu.Lock()
+	revision := m.tray.revision
+	m.tray.mu.Unlock()
+
+	m.tray.update()
+
+	m.tray.mu.Lock()
+	defer m.tray.mu.Unlock()
+	return m.tray.revision != revision, nil
+}
+
+// AboutToShowGroup is AboutToShow for several items, which all share the
+// profile list
+func (m *dbusMenu) AboutToShowGroup(ids []int32) ([]int32, []int32, *dbus.Error) {
+	updated, err := m.AboutToShow(MENU_ROOT)
+	if err != nil || !updated {
+		return []int32{}, []int32{}, err
+	}
+	return ids, []int32{}, nil
+}
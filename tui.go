@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	TUI_REFRESH     = 50 * time.Millisecond // redraws at most this often
+	TUI_POLL        = time.Second           // status is re-read this often
+	TUI_LOG_LINES   = 12                    // recent motion and scroll shown
+	TUI_SLIDER_SIZE = 30
+)
+
+// tuiSlider is a setting adjusted with the arrow keys
+type tuiSlider struct {
+	label    string
+	option   string // set through the control socket as option=value
+	step     float64
+	min, max float64
+	value    func(device controlDevice) float64
+}
+
+var tuiSliders = []tuiSlider{
+	{"Sensitivity", "sensitivity", 0.05, 0.05, 2, func(d controlDevice) float64 { return d.SensitivityY }},
+	{"Dead zone", "deadzone", 1, 0, 10, func(d controlDevice) float64 { return float64(d.DeadZoneY) }},
+}
+
+// tuiState is what the terminal shows
+type tuiState struct {
+	device   controlDevice
+	selected int
+	log      []string // most recent last
+	motion   [2]float64
+	scroll   [2]float64
+	message  string
+}
+
+// tui shows what the running instance does, through the control socket, with
+// sliders for its sensitivity and dead zone: trackball-scroll tui
+func tui(args []string) error {
+	flags := flag.NewFlagSet("tui", flag.ContinueOnError)
+	socket := flags.String("socket", defaultControlSocketPath(), "Control socket of the running instance")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return fmt.Errorf("tui needs a terminal")
+	}
+
+	var state tuiState
+	if err := state.refresh(*socket); err != nil {
+		return err
+	}
+
+	restore, err := rawTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	// Use the alternate screen without a cursor, and put everything back
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	defer restore()
+
+	events := make(chan monitorEvent, MONITOR_BUFFER)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watchControl(*socket, func(event monitorEvent) { events <- event })
+	}()
+	keys := make(chan byte)
+	go readKeys(keys)
+
+	redraw := time.NewTicker(TUI_REFRESH)
+	defer redraw.Stop()
+	poll := time.NewTicker(TUI_POLL)
+	defer poll.Stop()
+
+	escape := 0 // bytes of an arrow key's escape sequence seen so far
+	dirty := true
+	for {
+		select {
+		case err := <-watchErr:
+			return err
+		case event := <-events:
+			state.record(event)
+			dirty = true
+		case <-poll.C:
+			if err := state.refresh(*socket); err != nil {
+				state.message = err.Error()
+			}
+			dirty = true
+		case <-redraw.C:
+			if dirty {
+				state.draw()
+				dirty = false
+			}
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			dirty = true
+			switch {
+			case escape == 0 && key == 0x1b, escape == 1 && key == '[':
+				escape++
+				continue
+			case escape == 2:
+				escape = 0
+				switch key {
+				case 'A':
+					state.selected = (state.selected + len(tuiSliders) - 1) % len(tuiSliders)
+				case 'B':
+					state.selected = (state.selected + 1) % len(tuiSliders)
+				case 'C':
+					state.adjust(*socket, 1)
+				case 'D':
+					state.adjust(*socket, -1)
+				}
+				continue
+			}
+			escape = 0
+			switch key {
+			case 'q', 0x03: // Ctrl+C doesn't signal in a raw terminal
+				return nil
+			case '+', '=', 'l':
+				state.adjust(*socket, 1)
+			case '-', 'h':
+				state.adjust(*socket, -1)
+			case 'k':
+				state.selected = (state.selected + len(tuiSliders) - 1) % len(tuiSliders)
+			case 'j':
+				state.selected = (state.selected + 1) % len(tuiSliders)
+			}
+		}
+	}
+}
+
+// refresh re-reads the first device's status
+func (s *tuiState) refresh(socket string) error {
+	response, err := callControl(socket, controlRequest{Command: CONTROL_STATUS})
+	if err != nil {
+		return err
+	}
+	if len(response.Devices) == 0 {
+		return fmt.Errorf("the running instance has no devices")
+	}
+	s.device = response.Devices[0]
+	return nil
+}
+
+// adjust moves the selected slider a step in direction and applies it
+func (s *tuiState) adjust(socket string, direction float64) {
+	slider := tuiSliders[s.selected]
+	value := slider.value(s.device) + direction*slider.step
+	value = math.Round(value/slider.step) * slider.step
+	value = math.Max(slider.min, math.Min(slider.max, value))
+
+	setting := fmt.Sprintf("%s=%g", slider.option, value)
+	if _, err := callControl(socket, controlRequest{Command: CONTROL_SET, Settings: []string{setting}}); err != nil {
+		s.message = err.Error()
+		return
+	}
+	s.message = "Set " + setting
+	if err := s.refresh(socket); err != nil {
+		s.message = err.Error()
+	}
+}
+
+// record adds an event from the first device to the log and totals
+func (s *tuiState) record(event monitorEvent) {
+	if event.Device != s.device.Path {
+		return
+	}
+	axis := 0
+	if event.Axis == "y" {
+		axis = 1
+	}
+
+	var line string
+	switch event.Kind {
+	case MONITOR_MOTION:
+		s.motion[axis] += event.Value
+		line = fmt.Sprintf("ball    %s %+4g", event.Axis, event.Value)
+	case MONITOR_SCROLL:
+		s.scroll[axis] += event.Value
+		line = fmt.Sprintf("  scroll %s %+6.2f", event.Axis, event.Value)
+	case MONITOR_MODE:
+		s.device.Mode = event.Mode
+		line = "mode    " + event.Mode
+	}
+	s.log = append(s.log, line)
+	if len(s.log) > TUI_LOG_LINES {
+		s.log = s.log[len(s.log)-TUI_LOG_LINES:]
+	}
+}
+
+// draw repaints the whole screen
+func (s *tuiState) draw() {
+	// Overwrite in place rather than clearing, which flickers
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\x1b[K\r\n", args...)
+	}
+
+	line("\x1b[1mtrackball-scroll\x1b[0m  %s (%s)", s.device.Name, s.device.Path)
+	paused := ""
+	if s.device.Paused {
+		paused = "  \x1b[7m paused \x1b[0m"
+	}
+	line("Mode: %s%s", s.device.Mode, paused)
+	line("")
+
+	for i, slider := range tuiSliders {
+		value := slider.value(s.device)
+		filled := int(math.Round((value - slider.min) / (slider.max - slider.min) * TUI_SLIDER_SIZE))
+		filled = max(0, min(TUI_SLIDER_SIZE, filled))
+		cursor := "  "
+		if i == s.selected {
+			cursor = "> "
+		}
+		line("%s%-12s %-6g [%s%s]", cursor, slider.label, value,
+			strings.Repeat("=", filled), strings.Repeat(" ", TUI_SLIDER_SIZE-filled))
+	}
+	line("")
+	line("Ball motion  x %+8g  y %+8g", s.motion[0], s.motion[1])
+	line("Scrolled     x %+8.2f  y %+8.2f", s.scroll[0], s.scroll[1])
+	line("")
+	for i := 0; i < TUI_LOG_LINES; i++ {
+		if i < len(s.log) {
+			line("%s", s.log[i])
+		} else {
+			line("")
+		}
+	}
+	line("")
+	line("%s", s.message)
+	line("\x1b[2mUp/Down select  Left/Right adjust  q quit\x1b[0m")
+	b.WriteString("\x1b[J")
+
+	os.Stdout.WriteString(b.String())
+}
+
+// readKeys passes each byte typed to keys
+func readKeys(keys chan<- byte) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buf); err != nil {
+			close(keys)
+			return
+		}
+		keys <- buf[0]
+	}
+}
+
+// rawTerminal switches the terminal at fd to reading each key as it is typed,
+// without echo, and returns a function that switches it back
+func rawTerminal(fd int) (func(), error) {
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, fmt.Errorf("failed to read terminal settings: %w", errno)
+	}
+
+	raw := old
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG
+	raw.Iflag &^= syscall.IXON | syscall.ICRNL
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, fmt.Errorf("failed to set up terminal: %w", errno)
+	}
+
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}, nil
+}
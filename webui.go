@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// webIndex is the configuration page served by the HTTP API
+//
+//go:embed web/index.html
+var webIndex []byte
+
+// serveWebUI serves the configuration page, which talks to the HTTP API with
+// the token given in its URL as /#token=<token>
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webIndex)
+}